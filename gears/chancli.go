@@ -62,6 +62,12 @@ func (gc *GearConn) Close() {
 // ===== Request functions =====
 
 func (gc *GearConn) doRequest(req *Request) error {
+	_, err := gc.doRequestReply(req)
+	return err
+}
+
+// doRequestReply sends a request and returns the reply for requests that produce a value
+func (gc *GearConn) doRequestReply(req *Request) (*Reply, error) {
 	replyRecv, replySend := libchan.Pipe()
 	req.Reply = replySend
 
@@ -69,35 +75,41 @@ func (gc *GearConn) doRequest(req *Request) error {
 	err := gc.mainChan.Send(req)
 	if err != nil {
 		replySend.Close()
-		return err
+		return nil, err
 	}
 
 	// wait for a reply
 	var r Reply
 	err = replyRecv.Receive(&r)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	switch r.Code {
 	case CodeOK:
-		return nil
+		return &r, nil
 	case CodeClientError:
-		return fmt.Errorf("client error: %s", r.Error)
+		return nil, fmt.Errorf("client error: %s", r.Error)
 	case CodeServerError:
-		return fmt.Errorf("server error: %s", r.Error)
+		return nil, fmt.Errorf("server error: %s", r.Error)
 	case CodeAckTimeout:
-		return AckTimeoutError
+		return nil, AckTimeoutError
 	default:
-		return fmt.Errorf("unknown error type: %s", r.Error)
+		return nil, fmt.Errorf("unknown error type: %s", r.Error)
 	}
 }
 
 func (gc *GearConn) RFSubscribe(start int64) (<-chan RFMessage, error) {
+	return gc.RFSubscribeMatch(start, RFMatch{})
+}
+
+// RFSubscribeMatch subscribes to the RF messages that satisfy the matcher, the filtering
+// happens in the hub
+func (gc *GearConn) RFSubscribeMatch(start int64, match RFMatch) (<-chan RFMessage, error) {
 	subRecv, subSend := libchan.Pipe()
 	c := make(chan RFMessage, 0)
 
 	req := Request{
-		RFS: &RFSubRequest{StartAt: start, Match: RFMessage{}, Messages: subSend},
+		RFS: &RFSubRequest{StartAt: start, Match: match, Messages: subSend},
 	}
 
 	err := gc.doRequest(&req)
@@ -128,6 +140,17 @@ func (gc *GearConn) RFSend(msg RFMessage) error {
 	return gc.doRequest(&req)
 }
 
+// RFPost sends an RF message like RFSend but tells whether it got held in the mailbox of a
+// sleeping node: it returns the status of the held message, or nil if it got sent right away
+func (gc *GearConn) RFPost(msg RFMessage) (*MailStatus, error) {
+	req := Request{RF: (*RFSendRequest)(&msg)}
+	r, err := gc.doRequestReply(&req)
+	if err != nil {
+		return nil, err
+	}
+	return r.MS, nil
+}
+
 func (gc *GearConn) SensorSubscribe(name string, startAt int64) (<-chan SensorDataValue, error) {
 	subRecv, subSend := libchan.Pipe()
 	c := make(chan SensorDataValue, 0)
@@ -213,8 +236,351 @@ func (gc *GearConn) SensorSendData(name string, si SensorInfo) (chan<- SensorDat
 	return c, nil
 }
 
+func (gc *GearConn) ParamPut(name, value string) error {
+	req := Request{PP: &ParamPutRequest{name, value}}
+	return gc.doRequest(&req)
+}
+
+func (gc *GearConn) ParamGet(name string) (string, error) {
+	req := Request{PG: &ParamGetRequest{name}}
+	r, err := gc.doRequestReply(&req)
+	if err != nil {
+		return "", err
+	}
+	if r.PG == nil {
+		return "", fmt.Errorf("reply is missing the parameter value")
+	}
+	return r.PG.Value, nil
+}
+
+func (gc *GearConn) ParamList(prefix string) (map[string]string, error) {
+	req := Request{PL: &ParamListRequest{prefix}}
+	r, err := gc.doRequestReply(&req)
+	if err != nil {
+		return nil, err
+	}
+	if r.PL == nil {
+		return nil, fmt.Errorf("reply is missing the parameter list")
+	}
+	return r.PL.Params, nil
+}
+
+func (gc *GearConn) ParamDelete(prefix string) error {
+	req := Request{PD: &ParamDelRequest{prefix}}
+	return gc.doRequest(&req)
+}
+
+func (gc *GearConn) ParamSubscribe(prefix string) (<-chan ParamChange, error) {
+	subRecv, subSend := libchan.Pipe()
+	c := make(chan ParamChange, 0)
+
+	req := Request{PS: &ParamSubRequest{prefix, subSend}}
+	err := gc.doRequest(&req)
+	if err != nil {
+		subSend.Close()
+		close(c)
+		return nil, err
+	}
+
+	go func() {
+		for {
+			var m ParamChange
+			err := subRecv.Receive(&m)
+			if err != nil {
+				log.Printf("Error receiving ParamChange message: %s", err.Error())
+				close(c)
+				return
+			}
+			c <- m
+		}
+	}()
+
+	return c, nil
+}
+
+func (gc *GearConn) NodeGet(group, node byte) (NodeInfo, error) {
+	req := Request{NG: &NodeGetRequest{group, node}}
+	r, err := gc.doRequestReply(&req)
+	if err != nil {
+		return NodeInfo{}, err
+	}
+	if r.NI == nil {
+		return NodeInfo{}, fmt.Errorf("reply is missing the node info")
+	}
+	return *r.NI, nil
+}
+
+func (gc *GearConn) NodePut(ni NodeInfo) error {
+	req := Request{NP: (*NodePutRequest)(&ni)}
+	return gc.doRequest(&req)
+}
+
+func (gc *GearConn) NodeList() ([]NodeInfo, error) {
+	req := Request{NL: &NodeListRequest{}}
+	r, err := gc.doRequestReply(&req)
+	if err != nil {
+		return nil, err
+	}
+	return r.NL, nil
+}
+
+func (gc *GearConn) NodeDelete(group, node byte) error {
+	req := Request{ND: &NodeDelRequest{group, node}}
+	return gc.doRequest(&req)
+}
+
+func (gc *GearConn) PairList() ([]Pairing, error) {
+	req := Request{PRL: &PairListRequest{}}
+	r, err := gc.doRequestReply(&req)
+	if err != nil {
+		return nil, err
+	}
+	return r.PRL, nil
+}
+
+// PairAssign pairs a hardware ID with a node ID, or with the first free node ID in the
+// group if p.Node is zero, and returns the resulting pairing
+func (gc *GearConn) PairAssign(p Pairing) (Pairing, error) {
+	req := Request{PRA: (*PairAssignRequest)(&p)}
+	r, err := gc.doRequestReply(&req)
+	if err != nil {
+		return Pairing{}, err
+	}
+	if r.PR == nil {
+		return Pairing{}, fmt.Errorf("reply is missing the pairing")
+	}
+	return *r.PR, nil
+}
+
+func (gc *GearConn) PairForget(hwId string) error {
+	req := Request{PRF: &PairForgetRequest{hwId}}
+	return gc.doRequest(&req)
+}
+
+// FwUpload adds a new version of the firmware for a node type given an Intel HEX image
+func (gc *GearConn) FwUpload(nodeType uint16, name, hex string) (Firmware, error) {
+	req := Request{FU: &FwUploadRequest{nodeType, name, hex}}
+	return gc.doFwRequest(&req)
+}
+
+// FwList lists the firmware versions for a node type, or for all node types if zero
+func (gc *GearConn) FwList(nodeType uint16) ([]Firmware, error) {
+	req := Request{FL: &FwListRequest{nodeType}}
+	r, err := gc.doRequestReply(&req)
+	if err != nil {
+		return nil, err
+	}
+	return r.FL, nil
+}
+
+// FwActivate makes a firmware version the one nodes get when they upgrade: all nodes of
+// its node type if node is zero, else just the one node
+func (gc *GearConn) FwActivate(swId uint16, group, node byte) (Firmware, error) {
+	req := Request{FA: &FwActivateRequest{swId, group, node, ""}}
+	return gc.doFwRequest(&req)
+}
+
+// FwPin makes a firmware version the one the node paired with a hardware ID gets
+func (gc *GearConn) FwPin(swId uint16, hwId string) (Firmware, error) {
+	req := Request{FA: &FwActivateRequest{SwId: swId, HwId: hwId}}
+	return gc.doFwRequest(&req)
+}
+
+// FwRollback re-activates the previously active firmware version and returns it
+func (gc *GearConn) FwRollback(nodeType uint16, group, node byte) (Firmware, error) {
+	req := Request{FR: &FwRollbackRequest{nodeType, group, node}}
+	return gc.doFwRequest(&req)
+}
+
+func (gc *GearConn) BootStatus() (BootStatus, error) {
+	req := Request{BS: &BootStatusRequest{}}
+	r, err := gc.doRequestReply(&req)
+	if err != nil {
+		return BootStatus{}, err
+	}
+	if r.BS == nil {
+		return BootStatus{}, fmt.Errorf("reply is missing the boot status")
+	}
+	return *r.BS, nil
+}
+
+// GatewayList returns the UDP/RF gateways and how well they hear each node
+func (gc *GearConn) GatewayList() ([]GatewayInfo, error) {
+	req := Request{GL: &GatewayListRequest{}}
+	r, err := gc.doRequestReply(&req)
+	if err != nil {
+		return nil, err
+	}
+	return r.GL, nil
+}
+
+// NodeStatusList returns whether each node that has ever been heard is online
+func (gc *GearConn) NodeStatusList() ([]NodeStatus, error) {
+	req := Request{NSL: &NodeStatusListRequest{}}
+	r, err := gc.doRequestReply(&req)
+	if err != nil {
+		return nil, err
+	}
+	return r.NSL, nil
+}
+
+// NodeStatusSubscribe returns a channel on which a node, or all nodes if node is zero, are
+// sent each time they go online or offline
+func (gc *GearConn) NodeStatusSubscribe(group, node byte) (<-chan NodeStatus, error) {
+	subRecv, subSend := libchan.Pipe()
+	c := make(chan NodeStatus, 0)
+
+	req := Request{NSS: &NodeStatusSubRequest{group, node, subSend}}
+	err := gc.doRequest(&req)
+	if err != nil {
+		subSend.Close()
+		close(c)
+		return nil, err
+	}
+
+	go func() {
+		for {
+			var s NodeStatus
+			err := subRecv.Receive(&s)
+			if err != nil {
+				log.Printf("Error receiving NodeStatus message: %s", err.Error())
+				close(c)
+				return
+			}
+			c <- s
+		}
+	}()
+
+	return c, nil
+}
+
+// MailList returns the messages held for a sleeping node, or for all nodes if node is zero
+func (gc *GearConn) MailList(group, node byte) ([]MailStatus, error) {
+	req := Request{ML: &MailListRequest{group, node}}
+	r, err := gc.doRequestReply(&req)
+	if err != nil {
+		return nil, err
+	}
+	return r.ML, nil
+}
+
+// MailSubscribe returns a channel on which the messages held for a sleeping node, or for all
+// nodes if node is zero, are sent each time they get queued, delivered, or dropped
+func (gc *GearConn) MailSubscribe(group, node byte) (<-chan MailStatus, error) {
+	subRecv, subSend := libchan.Pipe()
+	c := make(chan MailStatus, 0)
+
+	req := Request{MS: &MailSubRequest{group, node, subSend}}
+	err := gc.doRequest(&req)
+	if err != nil {
+		subSend.Close()
+		close(c)
+		return nil, err
+	}
+
+	go func() {
+		for {
+			var s MailStatus
+			err := subRecv.Receive(&s)
+			if err != nil {
+				log.Printf("Error receiving MailStatus message: %s", err.Error())
+				close(c)
+				return
+			}
+			c <- s
+		}
+	}()
+
+	return c, nil
+}
+
+// RolloutStart stages the rollout of a firmware version: the canary nodes in the group get it
+// first and all other nodes once the canaries are running it and sending data
+func (gc *GearConn) RolloutStart(swId uint16, group byte, canaries []byte) (Rollout, error) {
+	req := Request{RS: &RolloutStartRequest{swId, group, canaries}}
+	return gc.doRolloutRequest(&req)
+}
+
+func (gc *GearConn) RolloutList() ([]Rollout, error) {
+	req := Request{RL: &RolloutListRequest{}}
+	r, err := gc.doRequestReply(&req)
+	if err != nil {
+		return nil, err
+	}
+	return r.ROL, nil
+}
+
+// RolloutEnd promotes the rollout for a node type to all nodes without waiting for the
+// canaries, or aborts it
+func (gc *GearConn) RolloutEnd(nodeType uint16, promote bool) (Rollout, error) {
+	req := Request{RE: &RolloutEndRequest{nodeType, promote}}
+	return gc.doRolloutRequest(&req)
+}
+
+// UpgradeList lists the upgrade sessions of a node, or of all nodes if node is zero
+func (gc *GearConn) UpgradeList(group, node byte) ([]UpgradeSession, error) {
+	req := Request{UL: &UpgradeListRequest{group, node}}
+	r, err := gc.doRequestReply(&req)
+	if err != nil {
+		return nil, err
+	}
+	return r.UL, nil
+}
+
+// UpgradeSubscribe returns a channel on which the progress of the upgrade sessions of a node,
+// or of all nodes if node is zero, is sent
+func (gc *GearConn) UpgradeSubscribe(group, node byte) (<-chan UpgradeSession, error) {
+	subRecv, subSend := libchan.Pipe()
+	c := make(chan UpgradeSession, 0)
+
+	req := Request{US: &UpgradeSubRequest{group, node, subSend}}
+	err := gc.doRequest(&req)
+	if err != nil {
+		subSend.Close()
+		close(c)
+		return nil, err
+	}
+
+	go func() {
+		for {
+			var m UpgradeSession
+			err := subRecv.Receive(&m)
+			if err != nil {
+				log.Printf("Error receiving UpgradeSession message: %s", err.Error())
+				close(c)
+				return
+			}
+			c <- m
+		}
+	}()
+
+	return c, nil
+}
+
 // ===== Helper functions =====
 
+func (gc *GearConn) doRolloutRequest(req *Request) (Rollout, error) {
+	r, err := gc.doRequestReply(req)
+	if err != nil {
+		return Rollout{}, err
+	}
+	if r.RO == nil {
+		return Rollout{}, fmt.Errorf("reply is missing the rollout")
+	}
+	return *r.RO, nil
+}
+
+func (gc *GearConn) doFwRequest(req *Request) (Firmware, error) {
+	r, err := gc.doRequestReply(req)
+	if err != nil {
+		return Firmware{}, err
+	}
+	if r.FW == nil {
+		return Firmware{}, fmt.Errorf("reply is missing the firmware")
+	}
+	return *r.FW, nil
+}
+
 func (gc *GearConn) pinger() {
 	for {
 		t0 := time.Now()
@@ -14,15 +14,40 @@ const FormatAt = "2006-01-02 15:04:05.999"
 
 // "Union" of requests made over the main channel
 type Request struct {
-	ER    *EchoRequest       // simple ping-pong test request
-	RFS   *RFSubRequest      // subscribe to raw RF messages
-	RF    *RFSendRequest     // send a raw RF message
-	SI    *SensorInfoRequest // get sensor info
-	SD    *SensorDataRequest // send sensor data
-	SR    *SensorReadRequest // read averaged sensor data
-	SS    *SensorSubRequest  // subscribe to real-time sensor data
-	PP    *ParamPutRequest   // put an arbitrary parameter
-	PG    *ParamGetRequest   // get an arbitrary parameter
+	ER    *EchoRequest           // simple ping-pong test request
+	RFS   *RFSubRequest          // subscribe to raw RF messages
+	RF    *RFSendRequest         // send a raw RF message
+	SI    *SensorInfoRequest     // get sensor info
+	SD    *SensorDataRequest     // send sensor data
+	SR    *SensorReadRequest     // read averaged sensor data
+	SS    *SensorSubRequest      // subscribe to real-time sensor data
+	PP    *ParamPutRequest       // put an arbitrary parameter
+	PG    *ParamGetRequest       // get an arbitrary parameter
+	PL    *ParamListRequest      // list parameters by prefix
+	PD    *ParamDelRequest       // delete parameters by prefix
+	PS    *ParamSubRequest       // subscribe to parameter changes
+	NG    *NodeGetRequest        // get the info about a node
+	NP    *NodePutRequest        // create or update the info about a node
+	NL    *NodeListRequest       // list the info about all nodes
+	ND    *NodeDelRequest        // delete the info about a node
+	PRL   *PairListRequest       // list the JeeBoot pairings
+	PRA   *PairAssignRequest     // pair a hardware ID with a node ID
+	PRF   *PairForgetRequest     // forget the pairing of a hardware ID
+	FU    *FwUploadRequest       // upload a new firmware version
+	FL    *FwListRequest         // list firmware versions
+	FA    *FwActivateRequest     // activate a firmware version
+	FR    *FwRollbackRequest     // roll back to the previously active firmware version
+	UL    *UpgradeListRequest    // list over-the-air upgrade sessions
+	US    *UpgradeSubRequest     // subscribe to over-the-air upgrade progress
+	RS    *RolloutStartRequest   // start a staged rollout with canary nodes
+	RL    *RolloutListRequest    // list staged rollouts
+	RE    *RolloutEndRequest     // promote or abort a staged rollout
+	BS    *BootStatusRequest     // get the status of the boot config
+	GL    *GatewayListRequest    // list the UDP/RF gateways
+	NSL   *NodeStatusListRequest // list the liveness of the nodes
+	NSS   *NodeStatusSubRequest  // subscribe to nodes going online or offline
+	ML    *MailListRequest       // list the messages held for sleeping nodes
+	MS    *MailSubRequest        // subscribe to the delivery of messages to sleeping nodes
 	Reply libchan.Sender
 }
 
@@ -31,7 +56,22 @@ type Reply struct {
 	Error string
 	ER    *EchoReply
 	PG    *ParamReply
+	PL    *ParamListReply
 	SI    *SensorInfo
+	NI    *NodeInfo
+	NL    []NodeInfo
+	PR    *Pairing
+	PRL   []Pairing
+	FW    *Firmware
+	FL    []Firmware
+	UL    []UpgradeSession
+	RO    *Rollout
+	ROL   []Rollout
+	BS    *BootStatus
+	GL    []GatewayInfo
+	NSL   []NodeStatus
+	MS    *MailStatus // reply to an RF send to a sleeping node, whose message got held
+	ML    []MailStatus
 }
 
 const (
@@ -59,38 +99,402 @@ type ParamReply struct {
 	Value string
 }
 
-// RFMessage Subscription request - subscribes to all RF Messages received by hub. The subscription
-// can start in the past, in which case messages are replayed from the database and then seamlessly
-// switched-over into the real-time stream.
+// List all parameters whose name starts with the prefix
+type ParamListRequest struct {
+	Prefix string
+}
+type ParamListReply struct {
+	Params map[string]string // name -> value
+}
+
+// Delete all parameters whose name starts with the prefix
+type ParamDelRequest struct {
+	Prefix string
+}
+
+// Subscribe to changes of parameters whose name starts with the prefix
+type ParamSubRequest struct {
+	Prefix  string
+	Changes libchan.Sender // channel of ParamChange
+}
+type ParamChange struct {
+	Name    string
+	Value   string
+	Deleted bool // parameter was deleted, Value is empty
+}
+
+// RFMessage Subscription request - subscribes to the RF Messages received by hub that satisfy
+// the matcher. The subscription can start in the past, in which case messages are replayed from
+// the database and then seamlessly switched-over into the real-time stream.
 type RFSubRequest struct {
 	StartAt  int64          // timestamp of first message, 0=start with real-time stream
-	Match    RFMessage      // matcher for messages (not yet implemented)
+	Match    RFMatch        // matcher for messages
 	Messages libchan.Sender // channel of RFMessage
 }
+
+// RF Message matcher, a message matches if its group, node, and kind are each in the
+// respective set, an empty set matches everything
+type RFMatch struct {
+	Groups []byte
+	Nodes  []byte
+	Kinds  []byte
+}
+
+func (mt RFMatch) Matches(m RFMessage) bool {
+	return inSet(mt.Groups, m.Group) && inSet(mt.Nodes, m.Node) && inSet(mt.Kinds, m.Kind)
+}
+
+func inSet(set []byte, v byte) bool {
+	if len(set) == 0 {
+		return true
+	}
+	for _, s := range set {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// RFRange returns the set of values from lo to hi inclusive, for use in an RFMatch, bounds
+// that are the wrong way around are swapped as an empty set would match everything
+func RFRange(lo, hi byte) []byte {
+	if hi < lo {
+		lo, hi = hi, lo
+	}
+	set := make([]byte, 0, int(hi)-int(lo)+1)
+	for v := int(lo); v <= int(hi); v++ {
+		set = append(set, byte(v))
+	}
+	return set
+}
+
+// Send an RF message, messages to sleeping nodes are held in their mailbox
 type RFSendRequest RFMessage
 
 // RF Message
 type RFMessage struct {
-	At    int64  // milliseconds since unix epoch
-	Group byte   // RF network group
-	Node  byte   // RF node ID (Node=0 -> bcast)
-	DoAck bool   // Send with ack requested
-	Kind  byte   // Message payload type ("module" numbers)
-	Data  []byte // Message payload
+	At    int64   // milliseconds since unix epoch
+	Group byte    // RF network group
+	Node  byte    // RF node ID (Node=0 -> bcast)
+	DoAck bool    // Send with ack requested
+	Kind  byte    // Message payload type ("module" numbers)
+	Data  []byte  // Message payload
+	Rx    *RxInfo // How the message was received, nil for messages to send
+}
+
+// RxInfo tells which gateway received an RF message and how well. Only the gateway's address
+// is always known, the rest is zero unless the gateway reports it.
+type RxInfo struct {
+	Gateway string // IP address and port of the gateway
+	GwId    byte   // ID of the gateway
+	Rssi    int    // received signal strength in dBm
+	Lna     byte   // gain setting of the receiver's LNA
+	Seq     byte   // the gateway's sequence number of the packet, wraps around
 }
 
 func (m RFMessage) RfTag() string {
 	return fmt.Sprintf("RFg%03di%02dk%02d", m.Group, m.Node, m.Kind)
 }
 
+// Node info requests
+
+// Info about an RF node: what it runs, where it is, and what its readings are called. The
+// hierarchical sensor name of a reading is <location>/<sketch>/<name>, e.g. basement/heating/temp3.
+type NodeInfo struct {
+	Group    byte                  // RF network group
+	Node     byte                  // RF node ID
+	Sketch   string                // name of the sketch the node runs, e.g. "heating"
+	Location string                // where the node is, e.g. "basement"
+	Sensors  map[string]NodeSensor // decoded reading name (e.g. "temp0") -> sensor
+	Sleepy   bool                  // node only listens right after it transmits
+}
+type NodeSensor struct {
+	Name string // sensor name, replaces the reading name, e.g. "boiler_out"
+	Unit string // unit, replaces the unit produced by the decoder if not empty
+}
+
+// Label returns the friendly name of the node, e.g. basement/heating
+func (ni NodeInfo) Label() string {
+	label := ni.Location
+	if ni.Sketch != "" {
+		if label != "" {
+			label += "/"
+		}
+		label += ni.Sketch
+	}
+	if label == "" {
+		label = fmt.Sprintf("RFg%03di%02d", ni.Group, ni.Node)
+	}
+	return label
+}
+
+// SensorName returns the hierarchical name of a reading decoded from the node's messages
+// as well as its unit, which is the decoder's unit unless the node info overrides it
+func (ni NodeInfo) SensorName(reading, unit string) (string, string) {
+	if s, ok := ni.Sensors[reading]; ok {
+		if s.Name != "" {
+			reading = s.Name
+		}
+		if s.Unit != "" {
+			unit = s.Unit
+		}
+	}
+	return ni.Label() + "/" + reading, unit
+}
+
+type NodeGetRequest struct {
+	Group byte
+	Node  byte
+}
+type NodePutRequest NodeInfo
+type NodeListRequest struct{}
+type NodeDelRequest struct {
+	Group byte
+	Node  byte
+}
+
+// Pairing requests
+
+// A Pairing records the node ID that was handed out to a JeeBoot node with a given hardware ID
+type Pairing struct {
+	HwId     string   // hardware ID as 32 hex digits
+	NodeType uint16   // type of the node, selects the sketch it runs
+	Group    byte     // RF network group
+	Node     byte     // RF node ID
+	ShKey    [16]byte // shared key sent to the node when it was paired, 0's if none
+	At       int64    // when the node was paired, milliseconds since unix epoch
+}
+type PairListRequest struct{}
+type PairAssignRequest Pairing // Node=0 -> allocate a free node ID in the group
+type PairForgetRequest struct {
+	HwId string
+}
+
+// Firmware requests
+
+// A Firmware is one version of the software for a node type in the hub's firmware repository
+type Firmware struct {
+	SwId     uint16 // software ID, unique across node types, sent to nodes as version
+	NodeType uint16 // type of node the firmware is for
+	Name     string // description, e.g. the name of the hex file
+	Size     int    // size of the image in bytes
+	Crc      uint16 // CRC-16 over the image
+	At       int64  // when the firmware was uploaded, milliseconds since unix epoch
+}
+type FwUploadRequest struct {
+	NodeType uint16
+	Name     string
+	Hex      string // image in Intel HEX format
+}
+type FwListRequest struct {
+	NodeType uint16 // 0 -> all node types
+}
+type FwActivateRequest struct {
+	SwId  uint16
+	Group byte // Node=0 -> activate for all nodes of the node type
+	Node  byte
+	HwId  string // if not empty: activate for the node paired with this hardware ID
+}
+type FwRollbackRequest struct {
+	NodeType uint16
+	Group    byte // Node=0 -> roll back the version for all nodes of the node type
+	Node     byte
+}
+
+// Boot status requests
+
+// BootStatus tells whether the boot config got loaded. A config with errors is not loaded,
+// the previous config stays in effect.
+type BootStatus struct {
+	ConfigFile string
+	LoadedAt   int64  // when the config in effect was loaded, milliseconds since unix epoch
+	Nodes      int    // number of nodes in the config in effect
+	Sketches   int    // number of sketches in the config in effect
+	Legacy     bool   // config in effect is in the legacy two-document format
+	Error      string // error of the last reload, empty if it succeeded
+	ErrorAt    int64  // when the last reload with an error happened
+}
+type BootStatusRequest struct{}
+
+// Gateway requests
+
+// NodeReception is how well a gateway hears a node
+type NodeReception struct {
+	Node   byte
+	Heard  int   // packets of the node received through the gateway
+	First  int   // packets whose first copy arrived through the gateway
+	Rssi   int   // signal strength of the last packet in dBm, 0 if the gateway doesn't report it
+	LastAt int64 // when the gateway last heard the node, milliseconds since unix epoch
+}
+
+// GatewayInfo is a UDP/RF gateway serving an RF group, several gateways may serve the same
+// group and then hear the same packets
+type GatewayInfo struct {
+	Group  byte
+	Addr   string // IP address and port of the gateway
+	LastAt int64  // when the gateway was last heard from, milliseconds since unix epoch
+	Nodes  []NodeReception
+}
+type GatewayListRequest struct{}
+
+// Node status requests
+
+// NodeStatus tells whether a node is alive. A node goes offline when it hasn't been heard for
+// a few times its usual reporting interval and back online with the next packet it sends.
+type NodeStatus struct {
+	Group     byte
+	Node      byte
+	Online    bool
+	Since     int64   // when the node went online or offline, milliseconds since unix epoch
+	FirstSeen int64   // when the node was first heard
+	LastSeen  int64   // when the node was last heard
+	Packets   int     // packets received from the node
+	Rate      float64 // packets per hour since the node was first heard
+	Interval  int64   // expected interval between packets in milliseconds, 0 if not known yet
+}
+type NodeStatusListRequest struct{}
+
+// Subscribe to the online/offline transitions of a node, or of all nodes if node is zero
+type NodeStatusSubRequest struct {
+	Group  byte // Node=0 -> all nodes
+	Node   byte
+	Events libchan.Sender // channel of NodeStatus
+}
+
+// Mailbox requests
+
+// States of a message held for a sleeping node
+const (
+	MailQueued    = "queued"    // waiting for the node to wake up
+	MailDelivered = "delivered" // sent when the node woke up, and ACKed if requested
+	MailFailed    = "failed"    // not ACKed by the node or not sent at all
+	MailExpired   = "expired"   // the node didn't wake up in time
+	MailReplaced  = "replaced"  // a newer message of the same kind took its place
+)
+
+// MailStatus tells what happened to a message sent to a sleeping node. The hub holds such
+// messages in the node's mailbox and sends them right after it next hears from the node.
+type MailStatus struct {
+	Id       int64 // unique ID of the message
+	Group    byte
+	Node     byte
+	Kind     byte
+	State    string
+	Error    string // why the delivery failed
+	QueuedAt int64  // when the message got queued, milliseconds since unix epoch
+	Expires  int64  // when the message expires if the node doesn't wake up
+	DoneAt   int64  // when the message left the mailbox, 0 while it's queued
+}
+
+type MailListRequest struct {
+	Group byte // Node=0 -> all nodes
+	Node  byte
+}
+
+// Subscribe to the state changes of the messages held for a node, or for all nodes if node
+// is zero
+type MailSubRequest struct {
+	Group  byte // Node=0 -> all nodes
+	Node   byte
+	Status libchan.Sender // channel of MailStatus
+}
+
+// Rollout requests
+
+// States of a rollout
+const (
+	RolloutCanary   = "canary"   // only the canaries get the new version
+	RolloutPromoted = "promoted" // all nodes of the node type get the new version
+	RolloutAborted  = "aborted"  // the canaries went back to the previous version
+)
+
+// A Rollout stages the upgrade of a node type to a new firmware version: the canary nodes
+// get it first and it's promoted to all nodes once each canary has come back running it and
+// has sent data since
+type Rollout struct {
+	NodeType  uint16
+	SwId      uint16 // firmware version being rolled out
+	SwCheck   uint16 // CRC-16 of the firmware
+	Group     byte
+	Canaries  []byte // node IDs that get the new version first
+	Confirmed []byte // canaries that came back running the new version
+	Healthy   []byte // confirmed canaries that have sent data since
+	State     string
+	Start     int64 // milliseconds since unix epoch
+	EndAt     int64 // when the rollout was promoted or aborted
+}
+type RolloutStartRequest struct {
+	SwId     uint16
+	Group    byte
+	Canaries []byte
+}
+type RolloutListRequest struct{}
+type RolloutEndRequest struct {
+	NodeType uint16
+	Promote  bool // true: promote to all nodes, false: abort
+}
+
+// Upgrade session requests
+
+// States of an upgrade session
+const (
+	UpgradeDownloading = "downloading" // node is fetching the new software
+	UpgradeDownloaded  = "downloaded"  // node fetched the last chunk
+	UpgradeConfirmed   = "confirmed"   // node came back running the new software
+	UpgradeFailed      = "failed"      // node came back running something else
+)
+
+// An UpgradeSession tracks the over-the-air upgrade of a node from one software to another
+type UpgradeSession struct {
+	Group    byte
+	Node     byte
+	NodeType uint16
+	FromSwId uint16 // software ID the node ran when the upgrade started, 0 if unknown
+	SwId     uint16 // software ID the node is upgrading to
+	SwCheck  uint16 // CRC-16 of the new software
+	Chunks   int    // number of download chunks in the new software
+	Served   int    // number of distinct chunks served
+	Retries  int    // number of times a chunk was served again
+	State    string
+	Start    int64 // when the upgrade started, milliseconds since unix epoch
+	LastAt   int64 // when the last chunk was served
+	EndAt    int64 // when the upgrade was confirmed or failed, 0 while in progress
+}
+type UpgradeListRequest struct {
+	Group byte // Node=0 -> all nodes
+	Node  byte
+}
+type UpgradeSubRequest struct {
+	Group    byte // Node=0 -> all nodes
+	Node     byte
+	Sessions libchan.Sender // channel of UpgradeSession
+}
+
 // Sensor Info requests
 
 type SensorInfoRequest struct {
 	Name string
 }
 type SensorInfo struct {
-	Unit string
-	Rate bool
+	Unit   string
+	Rate   bool
+	Output SensorOutput // set for sensors that report the state of something that can be set
+}
+
+// Kinds of outputs
+const (
+	OutputSwitch   = "switch"   // on/off, e.g., a relay, set to 0 or 1
+	OutputPosition = "position" // e.g., a servo, set to 0..180 degrees
+)
+
+// SensorOutput tells how to set an output over RF: the hub sends a message of the Kind to the
+// node with the Index of the output and the new value as data
+type SensorOutput struct {
+	Type        string // OutputSwitch or OutputPosition, empty if the sensor isn't an output
+	Group, Node byte
+	Kind        byte // module that controls the output
+	Index       byte // output number within the module
 }
 
 // Sensor Data request
@@ -16,6 +16,16 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// fetch the node map to print friendly node names
+	labels := make(map[[2]byte]string)
+	nodes, err := gc.NodeList()
+	if err != nil {
+		log.Printf("Cannot get node map: %s", err.Error())
+	}
+	for _, ni := range nodes {
+		labels[[2]byte{ni.Group, ni.Node}] = ni.Label()
+	}
+
 	start := (time.Now().Unix() - 10*60) * 1000
 	rfChan, err := gc.RFSubscribe(start)
 	if err != nil {
@@ -24,6 +34,22 @@ func main() {
 
 	for m := range rfChan {
 		ts := time.Unix(m.At/1000, (m.At%1000)*1000000).Format("2006-01-02 15:04:05.999")
-		fmt.Printf("%-23s %-12s: %s\n", ts, m.RfTag(), RFFormat(m))
+		tag := m.RfTag()
+		if label, ok := labels[[2]byte{m.Group, m.Node}]; ok {
+			tag = fmt.Sprintf("%s:k%02d", label, m.Kind)
+		}
+		fmt.Printf("%-23s %-12s: %s%s\n", ts, tag, RFFormat(m), rxFormat(m.Rx))
+	}
+}
+
+// rxFormat shows which gateway received a message and how well, to diagnose weak links
+func rxFormat(rx *gears.RxInfo) string {
+	if rx == nil {
+		return ""
+	}
+	if rx.GwId == 0 && rx.Rssi == 0 {
+		return fmt.Sprintf(" [via %s]", rx.Gateway)
 	}
+	return fmt.Sprintf(" [via %s gw=%d rssi=%ddBm lna=%d seq=%d]", rx.Gateway, rx.GwId,
+		rx.Rssi, rx.Lna, rx.Seq)
 }
@@ -0,0 +1,419 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+// Boot config file parser
+//
+// The boot config is a single JSON document with a list of nodes and a list of sketches:
+//
+//	{
+//		"nodes": [
+//			{ "hwId": "00000000000000000000000000000000", "group": 252, "node": 2,
+//			  "type": 100, "label": "default entry" }
+//		],
+//		"sketches": [
+//			{ "type": 100, "path": "hex/default.hex", "version": "1.0", "notes": "blinker" }
+//		]
+//	}
+//
+// Everything from a # to the end of the line is a comment. The legacy format, which consists
+// of two JSON documents, the first mapping HwIds to [nodeType, groupId, nodeId] and the
+// second mapping nodeTypes to hex files, is still accepted and can be converted using
+// convertBootConfig.
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tve/widuino/hub/database"
+)
+
+// A nodeConfig is a node in the boot config
+type nodeConfig struct {
+	HwId  string `json:"hwId"`  // 32 hex digits
+	Group uint8  `json:"group"` // RF network group
+	Node  uint8  `json:"node"`  // RF node ID
+	Type  uint16 `json:"type"`  // node type, selects the sketch
+	Label string `json:"label,omitempty"`
+	line  int    // where the entry starts in the file
+}
+
+// A sketchConfig is a sketch in the boot config
+type sketchConfig struct {
+	Type    uint16 `json:"type"` // node type the sketch is for
+	Path    string `json:"path"` // hex file, relative to the config file
+	Version string `json:"version,omitempty"`
+	Notes   string `json:"notes,omitempty"`
+	line    int    // where the entry starts in the file
+}
+
+// A bootConfigFile is the parsed content of a boot config file
+type bootConfigFile struct {
+	Nodes    []nodeConfig   `json:"nodes"`
+	Sketches []sketchConfig `json:"sketches"`
+	Legacy   bool           `json:"-"` // file is in the legacy format
+}
+
+// parseBootConfig parses and validates a boot config in either format, errors carry the
+// line number they refer to
+func parseBootConfig(data []byte) (*bootConfigFile, error) {
+	data = stripComments(data)
+	p := configParser{data: data, d: json.NewDecoder(bytes.NewReader(data))}
+	p.d.DisallowUnknownFields()
+
+	if err := p.delim('{'); err != nil {
+		return nil, err
+	}
+	var c *bootConfigFile
+	var err error
+	if !p.d.More() {
+		c, err = p.legacy("", 0) // legacy config without pairings
+	} else {
+		var key string
+		line := p.line()
+		if key, err = p.key(); err != nil {
+			return nil, err
+		}
+		if key == "nodes" || key == "sketches" {
+			c, err = p.structured(key, line)
+		} else {
+			c, err = p.legacy(key, line)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.d.Token(); err != io.EOF {
+		return nil, p.errorf(p.line(), "unexpected data after the config")
+	}
+	return c, c.validate()
+}
+
+// validate checks that the config is consistent
+func (c *bootConfigFile) validate() error {
+	sketches := make(map[uint16]int) // type -> line
+	for _, s := range c.Sketches {
+		if s.Type == 0 {
+			return lineErrorf(s.line, "sketch has no type")
+		}
+		if s.Path == "" {
+			return lineErrorf(s.line, "sketch for type %d has no path", s.Type)
+		}
+		if l, ok := sketches[s.Type]; ok {
+			return lineErrorf(s.line, "type %d already has a sketch on line %d", s.Type, l)
+		}
+		sketches[s.Type] = s.line
+	}
+
+	hwIds := make(map[string]int)   // hwId -> line
+	nodes := make(map[[2]uint8]int) // group, node -> line
+	for i, n := range c.Nodes {
+		if b, err := hex.DecodeString(n.HwId); err != nil || len(b) != 16 {
+			return lineErrorf(n.line, "hwId %q is not 32 hex digits", n.HwId)
+		}
+		n.HwId = strings.ToLower(n.HwId)
+		c.Nodes[i].HwId = n.HwId
+		// node 31 is the gateway itself
+		if n.Node < database.FirstNodeId || n.Node > database.LastNodeId {
+			return lineErrorf(n.line, "node %s: node ID %d is not %d..%d", n.HwId, n.Node,
+				database.FirstNodeId, database.LastNodeId)
+		}
+		if _, ok := sketches[n.Type]; !ok {
+			return lineErrorf(n.line, "node %s: type %d has no sketch", n.HwId, n.Type)
+		}
+		if l, ok := hwIds[n.HwId]; ok {
+			return lineErrorf(n.line, "node %s is already on line %d", n.HwId, l)
+		}
+		hwIds[n.HwId] = n.line
+		gn := [2]uint8{n.Group, n.Node}
+		if l, ok := nodes[gn]; ok {
+			return lineErrorf(n.line, "node %s: RF%di%d is already assigned on line %d",
+				n.HwId, n.Group, n.Node, l)
+		}
+		nodes[gn] = n.line
+	}
+	return nil
+}
+
+// Write writes the config in the structured format
+func (c *bootConfigFile) Write(w io.Writer) error {
+	out, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(out, '\n'))
+	return err
+}
+
+// convertBootConfig reads a boot config file in either format and writes it in the
+// structured format
+func convertBootConfig(file string, w io.Writer) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	c, err := parseBootConfig(data)
+	if err != nil {
+		return fmt.Errorf("%s: %s", file, err.Error())
+	}
+	return c.Write(w)
+}
+
+func lineErrorf(line int, format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+// ===== Parser
+
+// configParser walks the JSON token by token so errors can point at the offending entry
+type configParser struct {
+	data []byte
+	d    *json.Decoder
+}
+
+// structured parses the rest of a structured config, the first key has been read already
+func (p *configParser) structured(key string, line int) (*bootConfigFile, error) {
+	c := &bootConfigFile{}
+	seen := make(map[string]bool)
+	for {
+		if seen[key] {
+			return nil, p.errorf(line, "duplicate %q", key)
+		}
+		seen[key] = true
+		var err error
+		switch key {
+		case "nodes":
+			err = p.array(func(line int) error {
+				n := nodeConfig{line: line}
+				c.Nodes = append(c.Nodes, n)
+				return p.d.Decode(&c.Nodes[len(c.Nodes)-1])
+			})
+		case "sketches":
+			err = p.array(func(line int) error {
+				s := sketchConfig{line: line}
+				c.Sketches = append(c.Sketches, s)
+				return p.d.Decode(&c.Sketches[len(c.Sketches)-1])
+			})
+		default:
+			return nil, p.errorf(line, "unknown section %q", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !p.d.More() {
+			break
+		}
+		line = p.line()
+		if key, err = p.key(); err != nil {
+			return nil, err
+		}
+	}
+	return c, p.delim('}')
+}
+
+// legacy parses the rest of a legacy config, the first key has been read already, line is
+// zero if there are no pairings
+func (p *configParser) legacy(key string, line int) (*bootConfigFile, error) {
+	c := &bootConfigFile{Legacy: true}
+	for line > 0 {
+		var info pairingInfo
+		if err := p.decode(&info, line); err != nil {
+			return nil, fmt.Errorf("error reading pairing: %s", err.Error())
+		}
+		if info[1] > 0xFF || info[2] > 0xFF {
+			return nil, p.errorf(line, "node %s: bad group or node ID", key)
+		}
+		c.Nodes = append(c.Nodes, nodeConfig{HwId: key, Type: info[0],
+			Group: uint8(info[1]), Node: uint8(info[2]), line: line})
+		line = 0
+		if p.d.More() {
+			var err error
+			line = p.line()
+			if key, err = p.key(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := p.delim('}'); err != nil {
+		return nil, err
+	}
+
+	if err := p.delim('{'); err != nil {
+		return nil, fmt.Errorf("error reading sketches: %s", err.Error())
+	}
+	for p.d.More() {
+		line := p.line()
+		key, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		t, err := strconv.Atoi(key)
+		if err != nil || t <= 0 || t > 0xFFFF {
+			return nil, p.errorf(line, "bad nodeType %q", key)
+		}
+		s := sketchConfig{Type: uint16(t), line: line}
+		if err := p.decode(&s.Path, line); err != nil {
+			return nil, fmt.Errorf("error reading sketches: %s", err.Error())
+		}
+		c.Sketches = append(c.Sketches, s)
+	}
+	if err := p.delim('}'); err != nil {
+		return nil, err
+	}
+
+	// JSON objects have no order, sort so the converted config is stable
+	sort.Sort(nodesByAddr(c.Nodes))
+	sort.Sort(sketchesByType(c.Sketches))
+	return c, nil
+}
+
+// array parses a JSON array calling fun to decode each element
+func (p *configParser) array(fun func(line int) error) error {
+	if err := p.delim('['); err != nil {
+		return err
+	}
+	for p.d.More() {
+		off := p.next()
+		line := p.lineAt(off)
+		if err := fun(line); err != nil {
+			return p.wrap(err, line, off)
+		}
+	}
+	return p.delim(']')
+}
+
+// decode decodes the next value
+func (p *configParser) decode(v interface{}, line int) error {
+	off := p.next()
+	return p.wrap(p.d.Decode(v), line, off)
+}
+
+// key reads an object key
+func (p *configParser) key() (string, error) {
+	line := p.line()
+	t, err := p.d.Token()
+	if err != nil {
+		return "", p.wrap(err, line, 0)
+	}
+	key, ok := t.(string)
+	if !ok {
+		return "", p.errorf(line, "expected a key, got %v", t)
+	}
+	return key, nil
+}
+
+// delim reads a delimiter
+func (p *configParser) delim(delim json.Delim) error {
+	line := p.line()
+	t, err := p.d.Token()
+	if err == io.EOF {
+		return p.errorf(line, "expected %v, got end of file", delim)
+	} else if err != nil {
+		return p.wrap(err, line, 0)
+	}
+	if t != delim {
+		return p.errorf(line, "expected %v, got %v", delim, t)
+	}
+	return nil
+}
+
+// next returns the offset of the next token
+func (p *configParser) next() int {
+	off := int(p.d.InputOffset())
+	for off < len(p.data) && strings.IndexByte(" \t\r\n,:", p.data[off]) >= 0 {
+		off++
+	}
+	return off
+}
+
+// line returns the line of the next token
+func (p *configParser) line() int {
+	return p.lineAt(p.next())
+}
+
+func (p *configParser) lineAt(off int) int {
+	if off > len(p.data) {
+		off = len(p.data)
+	}
+	return bytes.Count(p.data[:off], []byte{'\n'}) + 1
+}
+
+func (p *configParser) errorf(line int, format string, args ...interface{}) error {
+	return lineErrorf(line, format, args...)
+}
+
+// wrap adds the line to an error, syntax and type errors know where they are, the latter
+// relative to the start of the value being decoded at off
+func (p *configParser) wrap(err error, line, off int) error {
+	if err == nil {
+		return nil
+	}
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		line = p.lineAt(int(e.Offset))
+	case *json.UnmarshalTypeError:
+		line = p.lineAt(off + int(e.Offset))
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = fmt.Errorf("unexpected end of file")
+	}
+	return lineErrorf(line, "%s", err.Error())
+}
+
+// stripComments blanks everything from a # outside of a string to the end of the line,
+// keeping the offsets of everything else the same
+func stripComments(data []byte) []byte {
+	out := make([]byte, len(data))
+	copy(out, data)
+	inString, escaped, inComment := false, false, false
+	for i, c := range out {
+		switch {
+		case inComment:
+			if c == '\n' {
+				inComment = false
+			} else {
+				out[i] = ' '
+			}
+		case inString:
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '#':
+			inComment = true
+			out[i] = ' '
+		}
+	}
+	return out
+}
+
+type nodesByAddr []nodeConfig
+
+func (n nodesByAddr) Len() int      { return len(n) }
+func (n nodesByAddr) Swap(i, j int) { n[i], n[j] = n[j], n[i] }
+func (n nodesByAddr) Less(i, j int) bool {
+	if n[i].Group != n[j].Group {
+		return n[i].Group < n[j].Group
+	}
+	if n[i].Node != n[j].Node {
+		return n[i].Node < n[j].Node
+	}
+	return n[i].HwId < n[j].HwId
+}
+
+type sketchesByType []sketchConfig
+
+func (s sketchesByType) Len() int           { return len(s) }
+func (s sketchesByType) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s sketchesByType) Less(i, j int) bool { return s[i].Type < s[j].Type }
@@ -5,192 +5,291 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
-	"regexp"
-	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/golang/glog"
+	"github.com/tve/widuino/gears"
+	"github.com/tve/widuino/hub/database"
 	"gopkg.in/fsnotify.v1"
 )
 
 type software []byte
 
-type booter struct {
-	configFile string                 // path to config file
-	dir        string                 // directory with config and hex files
-	watcher    *fsnotify.Watcher      // watcher for all the files
-	nodeType   map[string]pairingInfo // map HwId -> nodeType, groupId, nodeId
-	sketch     map[uint16]string      // map NodeType -> .hex file
-	software   map[string]software    // map .hex file -> sketch hex data
+// A configSnapshot is a complete, validated boot configuration. It's never modified: a reload
+// builds a new one and swaps it in, so readers just need to grab the current one.
+type configSnapshot struct {
+	dir      string                 // directory with config and hex files
+	nodeType map[string]pairingInfo // map HwId -> nodeType, groupId, nodeId
+	sketch   map[uint16]string      // map NodeType -> .hex file
+	software map[string]software    // map .hex file path -> sketch hex data
+	legacy   bool                   // config file is in the legacy format
 }
 
-var commentRe = regexp.MustCompile(`(?m)#.*$`)
+type booter struct {
+	configFile string              // path to config file
+	watcher    *fsnotify.Watcher   // watcher for all the files
+	mutex      sync.RWMutex        // protects config, status, and firmware
+	config     *configSnapshot     // current config
+	status     gears.BootStatus    // outcome of the last config reloads
+	db         *database.DB        // pairings and firmware repository, may be nil
+	firmware   map[uint16]software // map SwId -> firmware image from the repository
+	track      *upgradeTracker     // progress of over-the-air upgrades
+	missing    map[string]bool     // hex files of the last rejected config that weren't read
+}
 
-func NewBooter(configFile string) *booter {
+// NewBooter creates a booter for the config file. New nodes are paired automatically and
+// the pairings are remembered in db, if db is nil they all get the config's default entry.
+func NewBooter(configFile string, db *database.DB) *booter {
 	b := booter{
 		configFile: configFile,
-		nodeType:   make(map[string]pairingInfo),
-		sketch:     make(map[uint16]string),
-		software:   make(map[string]software),
+		config: &configSnapshot{
+			nodeType: make(map[string]pairingInfo),
+			sketch:   make(map[uint16]string),
+			software: make(map[string]software),
+		},
+		status:   gears.BootStatus{ConfigFile: configFile},
+		db:       db,
+		firmware: make(map[uint16]software),
+		track:    newUpgradeTracker(db),
 	}
 
 	var err error
 	b.watcher, err = fsnotify.NewWatcher()
 	if err != nil {
 		glog.Warningf("Cannot watch config files: %s", err.Error())
+	} else {
+		b.watchHandler(b.watcher)
 	}
-	b.watchHandler(b.watcher)
-	//b.watcher.Add(configFile)
-	b.watcher.Events <- fsnotify.Event{configFile, fsnotify.Create}
+	b.reload()
 
 	return &b
 }
 
+// snapshot returns the current config
+func (b *booter) snapshot() *configSnapshot {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.config
+}
+
+// Status returns the outcome of the last config reloads
+func (b *booter) Status() gears.BootStatus {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.status
+}
+
+// reload reads the config and all the hex files it references and swaps the new config in.
+// If anything is wrong the previous config stays in effect.
+func (b *booter) reload() {
+	config, err := readBootConfig(b.configFile)
+	now := time.Now().UnixNano() / 1000000
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err != nil {
+		glog.Errorf("Config error in %s, keeping the previous config: %s",
+			b.configFile, err.Error())
+		b.status.Error = err.Error()
+		b.status.ErrorAt = now
+		// reload when the hex files that weren't read show up or get fixed
+		b.missing = make(map[string]bool)
+		if config != nil {
+			for _, file := range config.sketch {
+				file = config.sketchPath(file)
+				if _, ok := config.software[file]; !ok {
+					b.missing[file] = true
+					b.watch(path.Dir(file))
+				}
+			}
+		}
+		return
+	}
+	b.config = config
+	b.missing = nil
+	b.status.Error = ""
+	b.status.LoadedAt = now
+	b.status.Nodes = len(config.nodeType)
+	b.status.Sketches = len(config.sketch)
+	b.status.Legacy = config.legacy
+	glog.Infof("Loaded boot config %s", b.configFile)
+
+	// watch all the directories with files we need to reload on
+	b.watch(config.dir)
+	for file := range config.software {
+		b.watch(path.Dir(file))
+	}
+}
+
+// watch adds a directory to the watcher, if there is one
+func (b *booter) watch(dir string) {
+	if b.watcher != nil {
+		b.watcher.Add(dir)
+	}
+}
+
+// watched tells whether a change of file requires a reload
+func (b *booter) watched(file string) bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	_, ok := b.config.software[file]
+	return ok || b.missing[file] || file == b.configFile
+}
+
 // ===== Filesystem change notifications
 
 // eventHandler waits for filesystem event notifications and causes the config to be reloaded
 func (b *booter) watchHandler(watcher *fsnotify.Watcher) {
 	go func() {
 		for event := range watcher.Events {
-			glog.Info("config watcher event: ", event)
+			glog.V(2).Info("config watcher event: ", event)
 			if event.Op&(fsnotify.Create|fsnotify.Write) == 0 {
 				continue
 			}
-			if event.Name == b.configFile {
-				// reload the config, start by disposing of existing info
-				b.nodeType = make(map[string]pairingInfo)
-				b.sketch = make(map[uint16]string)
-				for k, _ := range b.software {
-					if k != b.configFile {
-						b.watcher.Remove(k)
-					}
-				}
-				b.software = make(map[string]software)
-				// now load fresh
-				err := b.readBootConfig()
-				if err != nil {
-					glog.Errorf("Config error in %s: %s",
-						b.configFile, err.Error())
-				}
-			} else {
-				if _, ok := b.software[event.Name]; ok {
-					b.readHexFile(event.Name)
-				} else {
-					b.watcher.Remove(event.Name)
-				}
+			if b.watched(event.Name) {
+				glog.Info("config watcher event: ", event)
+				b.reload()
 			}
 		}
 	}()
 	go func() {
 		for err := range watcher.Errors {
-			glog.Warningf("boot info watch error:", err.Error())
+			glog.Warningf("boot info watch error: %s", err.Error())
 		}
 	}()
 }
 
 // ===== Read boot configuration
 
-// read the boot config file
-func (b *booter) readBootConfig() error {
-	b.dir = path.Dir(b.configFile)
-	glog.V(2).Infof("  watching %s", b.dir)
-	b.watcher.Add(b.dir)
+// readBootConfig reads a boot config file and the hex files it references and validates them.
+// If a hex file can't be read it also returns the config without that file's software.
+func readBootConfig(configFile string) (*configSnapshot, error) {
+	c := &configSnapshot{
+		dir:      path.Dir(configFile),
+		software: make(map[string]software),
+	}
 
-	config, err := ioutil.ReadFile(b.configFile)
+	data, err := ioutil.ReadFile(configFile)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	// remove comments
-	config = commentRe.ReplaceAllLiteral(config, []byte{})
-
-	// parse json
-	d := json.NewDecoder(bytes.NewReader(config))
-
-	err = d.Decode(&b.nodeType)
+	config, err := parseBootConfig(data)
 	if err != nil {
-		return fmt.Errorf("error reading pairing: %s", err.Error())
+		return nil, fmt.Errorf("%s: %s", configFile, err.Error())
 	}
-	for i, v := range b.nodeType {
-		glog.Infof("  node %s -> nodeType=%d RF%di%d", i, v[0], v[1], v[2])
+	if config.Legacy {
+		glog.Warningf("%s is in the legacy format, see -convertBootConfig", configFile)
 	}
+	c.legacy = config.Legacy
 
-	var sketches map[string]string
-	err = d.Decode(&sketches)
-	if err != nil {
-		return fmt.Errorf("error reading sketches: %s", err.Error())
+	c.nodeType = make(map[string]pairingInfo)
+	for _, n := range config.Nodes {
+		c.nodeType[n.HwId] = pairingInfo{n.Type, uint16(n.Group), uint16(n.Node)}
+		glog.Infof("  node %s -> nodeType=%d RF%di%d %s", n.HwId, n.Type, n.Group, n.Node,
+			n.Label)
+	}
+	c.sketch = make(map[uint16]string)
+	for _, s := range config.Sketches {
+		c.sketch[s.Type] = s.Path
+		glog.Infof("  nodeType=%d -> %s %s", s.Type, s.Path, s.Version)
 	}
-	b.sketch = make(map[uint16]string)
-	for k, v := range sketches {
-		if i, err := strconv.Atoi(k); err == nil {
-			b.sketch[uint16(i)] = v
+
+	// load all sketches
+	for _, file := range c.sketch {
+		file = c.sketchPath(file)
+		if _, ok := c.software[file]; ok {
+			continue
+		}
+		sw, err := readHexFile(file)
+		if err != nil {
+			return c, err
 		}
+		c.software[file] = sw
 	}
-	for i, v := range b.sketch {
-		glog.Infof("  nodeType=%d -> %s", i, v)
+	return c, nil
+}
+
+// sketchPath returns the path of a hex file, relative paths are relative to the config file
+func (c *configSnapshot) sketchPath(file string) string {
+	if !path.IsAbs(file) {
+		file = path.Join(c.dir, file)
 	}
-	return nil
+	return file
 }
 
 // ===== Read Intel hex files
 
 func (b *booter) findSoftware(id uint16) (software, error) {
-	file, ok := b.sketch[id]
+	config := b.snapshot()
+	file, ok := config.sketch[id]
 	if !ok {
 		return []byte{}, fmt.Errorf("no sketch is configured")
 	}
-	if file[0] != '/' {
-		file = path.Join(b.dir, file)
-	}
-
-	sw, ok := b.software[file]
 	glog.V(2).Infof("findSoftware for nodeType=%d -> %s", id, file)
-	if !ok {
-		err := b.readHexFile(file)
-		if err != nil {
-			return []byte{}, err
-		}
-		sw = b.software[file]
-	} else {
-		glog.V(2).Infof("  retrieving cached software for nodeType=%d", id)
+	return config.software[config.sketchPath(file)], nil
+}
+
+// findFirmware returns a firmware image from the repository in the database, images never
+// change so they're cached forever
+func (b *booter) findFirmware(swId uint16) (software, error) {
+	b.mutex.RLock()
+	sw, ok := b.firmware[swId]
+	b.mutex.RUnlock()
+	if ok {
+		return sw, nil
+	}
+	if b.db == nil {
+		return []byte{}, fmt.Errorf("no firmware repository")
 	}
+	sw, err := b.db.GetFirmwareImage(swId)
+	if err != nil {
+		return []byte{}, fmt.Errorf("firmware %d: %s", swId, err.Error())
+	}
+	glog.V(2).Infof("  saving firmware %d in cache (%d bytes)", swId, len(sw))
+	b.mutex.Lock()
+	b.firmware[swId] = sw
+	b.mutex.Unlock()
 	return sw, nil
 }
 
 // read software
-func (b *booter) readHexFile(file string) error {
-	glog.V(2).Infof("  watching %s", path.Dir(file))
-	b.watcher.Add(path.Dir(file))
-	// load it
+func readHexFile(file string) (software, error) {
 	glog.V(2).Infof("  reading %s", file)
 	f, err := os.Open(file)
 	if err != nil {
-		return fmt.Errorf("opening %s: %s", file, err.Error())
+		return []byte{}, fmt.Errorf("opening %s: %s", file, err.Error())
 	}
+	defer f.Close()
 	sw, err := readHex(f)
-	// add to cache
 	if err != nil {
-		return err
+		return []byte{}, fmt.Errorf("%s: %s", file, err.Error())
 	}
-	glog.V(2).Infof("  saving software %s in cache (%d bytes)", file, len(sw))
-	b.software[file] = sw
-	return nil
+	return sw, nil
 }
 
+// maximum image size we accept, ATmega1284-class chips have 128KB of flash
+const maxHexSize = 256 * 1024
+
+// readHex reads an Intel HEX file and returns the memory image it describes, starting at
+// address zero. Gaps between records are filled with 0xFF, which is what erased flash
+// contains, and the length is rounded up to a multiple of BOOT_SIZE_ROUND.
 func readHex(rd io.Reader) ([]byte, error) {
 	scanner := bufio.NewScanner(rd)
 	i := 0
 	sw := make([]byte, 0, 64*1024)
-	for scanner.Scan() {
-		l := scanner.Text()
+	used := make([]bool, 0, 64*1024) // which bytes of sw have been written
+	base := 0                        // address base set by extended address records
+	eof := false
+	for scanner.Scan() && !eof {
+		l := strings.TrimSpace(scanner.Text())
 		i += 1
 		if strings.HasPrefix(l, ":") {
 			b, err := hex.DecodeString(l[1:])
@@ -212,32 +311,62 @@ func readHex(rd io.Reader) ([]byte, error) {
 
 			// get & check length
 			length := int(b[0])
-			if len(b) < 5+length {
-				return []byte{}, fmt.Errorf("line %d: short line (%d<%d)", len(b),
+			if len(b) != 5+length {
+				return []byte{}, fmt.Errorf("line %d: bad length (%d!=%d)", i, len(b),
 					5+length)
 			}
+			data := b[4 : 4+length]
 
-			// get address, note 64KB limit...
-			addr := int(b[2]) + int(b[1])<<8
+			// get address, it's relative to the base set by extended address records
+			addr := base + int(b[2]) + int(b[1])<<8
 
-			// TODO: doesn't handle hex files over 64 KB
 			switch b[3] { // switch on record type byte
 			case 0x00: // data record
-				if addr+length-1 > len(sw) {
-					sw = sw[:addr+length]
+				if addr+length > maxHexSize {
+					return []byte{}, fmt.Errorf("line %d: address 0x%x beyond %dKB",
+						i, addr+length, maxHexSize/1024)
+				}
+				for len(sw) < addr+length {
+					sw = append(sw, 0xFF)
+					used = append(used, false)
+				}
+				for j := addr; j < addr+length; j++ {
+					if used[j] {
+						return []byte{}, fmt.Errorf("line %d: overlapping data at 0x%x",
+							i, j)
+					}
+					used[j] = true
 				}
-				copy(sw[addr:addr+length], b[4:4+length])
+				copy(sw[addr:addr+length], data)
+			case 0x01: // end of file record
+				eof = true
+			case 0x02: // extended segment address record
+				if length != 2 {
+					return []byte{}, fmt.Errorf("line %d: bad segment address record", i)
+				}
+				base = (int(data[0])<<8 | int(data[1])) << 4
+			case 0x04: // extended linear address record
+				if length != 2 {
+					return []byte{}, fmt.Errorf("line %d: bad linear address record", i)
+				}
+				base = (int(data[0])<<8 | int(data[1])) << 16
+			case 0x03, 0x05: // start segment/linear address records
+				// the entry point doesn't matter to the bootloader
+			default:
+				return []byte{}, fmt.Errorf("line %d: unknown record type %d", i, b[3])
 			}
 		}
 	}
+	if err := scanner.Err(); err != nil {
+		return []byte{}, err
+	}
 
 	// round length up to BOOT_SIZE_ROUND multiple
-	len := len(sw)
-	if len%BOOT_SIZE_ROUND != 0 {
-		len += BOOT_SIZE_ROUND - (len % BOOT_SIZE_ROUND)
+	for len(sw)%BOOT_SIZE_ROUND != 0 {
+		sw = append(sw, 0xFF)
 	}
 
-	sw2 := make([]byte, len) // save some space by reallocating
+	sw2 := make([]byte, len(sw)) // save some space by reallocating
 	copy(sw2, sw)
 	return sw2, nil
 }
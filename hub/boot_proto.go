@@ -6,8 +6,11 @@ package main
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"time"
 
 	"github.com/golang/glog"
+	"github.com/tve/widuino/gears"
+	"github.com/tve/widuino/hub/database"
 )
 
 //===== Boot protocol messages
@@ -64,8 +67,8 @@ type DownloadReply struct {
 
 type Booter interface {
 	Pair(PairingRequest) *PairingReply
-	Upgrade(UpgradeRequest) *UpgradeReply
-	Download(DownloadRequest) *DownloadReply
+	Upgrade(group, node byte, req UpgradeRequest) *UpgradeReply
+	Download(group, node byte, req DownloadRequest) *DownloadReply
 }
 
 type pairingInfo [3]uint16 // reading json: nodeType, groupId, nodeId
@@ -80,6 +83,13 @@ func hwIdIsZero(hwId [16]uint8) bool {
 	return true
 }
 
+// zeroHwId is the boot config entry used for nodes that don't have an entry of their own
+const zeroHwId = "00000000000000000000000000000000"
+
+// Pair replies with the node type, group and node ID for the hardware ID of the requesting
+// node. Entries in the boot config take precedence, otherwise the node gets the pairing it
+// got previously or, if it's new, a freshly allocated node ID in the default entry's group
+// with the default entry's node type.
 func (b *booter) Pair(req PairingRequest) *PairingReply {
 	repl := PairingReply{}
 	var hwId string
@@ -89,7 +99,7 @@ func (b *booter) Pair(req PairingRequest) *PairingReply {
 		// We need to assign a random hwId...
 		_, err := rand.Read(repl.ShKey[0:8])
 		if err != nil {
-			glog.Error("Can't generate random hwId: %s", err.Error())
+			glog.Errorf("Can't generate random hwId: %s", err.Error())
 		}
 		glog.Infof("New HwID: %x", repl.ShKey)
 		// convert hwId to a string
@@ -100,45 +110,126 @@ func (b *booter) Pair(req PairingRequest) *PairingReply {
 	}
 
 	// see what we should reply with...
-	info, ok := b.nodeType[hwId]
-	if !ok {
-		info = b.nodeType["00000000000000000000000000000000"]
+	config := b.snapshot()
+	info, ok := config.nodeType[hwId]
+	if ok || b.db == nil {
+		if !ok {
+			info = config.nodeType[zeroHwId]
+		}
+		repl.NodeType = info[0]
+		repl.GroupId = uint8(info[1])
+		repl.NodeId = uint8(info[2])
+	} else {
+		p, err := b.db.GetPairing(hwId)
+		if err == database.ErrNotFound {
+			// new node: allocate a node ID and remember it
+			def := config.nodeType[zeroHwId]
+			p = gears.Pairing{HwId: hwId, NodeType: def[0], Group: uint8(def[1]),
+				ShKey: repl.ShKey, At: time.Now().UnixNano() / 1000000}
+			p, err = b.db.PutPairing(p, config.reservedNodes(p.Group))
+			if err != nil {
+				glog.Warningf("Cannot pair hwId=%s: %s", hwId, err.Error())
+				return nil
+			}
+			glog.Infof("  Paired hwId=%s with RFg%di%d", hwId, p.Group, p.Node)
+		} else if err != nil {
+			glog.Errorf("Error reading database: %s", err.Error())
+			return nil
+		} else {
+			repl.ShKey = [16]byte{} // the node already has its hwId
+		}
+		repl.NodeType = p.NodeType
+		repl.GroupId = p.Group
+		repl.NodeId = p.Node
 	}
 
-	// construct reply
-	repl.NodeType = info[0]
-	repl.GroupId = uint8(info[1])
-	repl.NodeId = uint8(info[2])
-
 	glog.Infof("  Reply: RF%di%d new NodeType=%d hwId=%x",
 		repl.GroupId, repl.NodeId, repl.NodeType, repl.ShKey)
 	return &repl
 }
 
-func (b *booter) Upgrade(req UpgradeRequest) *UpgradeReply {
-	sw, err := b.findSoftware(req.NodeType)
+// reservedNodes returns the node IDs the boot config assigns explicitly in a group, these
+// must not be handed out to other nodes
+func (c *configSnapshot) reservedNodes(group uint8) []byte {
+	reserved := []byte{}
+	for hwId, info := range c.nodeType {
+		if hwId != zeroHwId && uint8(info[1]) == group {
+			reserved = append(reserved, uint8(info[2]))
+		}
+	}
+	return reserved
+}
+
+// Upgrade replies with the software the node should run: the firmware activated for the node
+// in the firmware repository, else the firmware being rolled out if the node is a canary,
+// else the firmware activated for its node type, else the sketch in the boot config, whose
+// software ID is the node type
+func (b *booter) Upgrade(group, node byte, req UpgradeRequest) *UpgradeReply {
+	swId, err := b.activeSwId(req.NodeType, group, node)
+	if err != nil {
+		glog.Errorf("Error reading database: %s", err.Error())
+		return nil
+	}
+	var sw software
+	if swId >= database.FirstSwId {
+		sw, err = b.findFirmware(swId)
+	} else {
+		sw, err = b.findSoftware(req.NodeType)
+	}
 	if err != nil {
 		glog.Warningf("Cannot load sketch for nodeType %d: %s", req.NodeType, err.Error())
 		return nil
 	}
 
-	glog.Infof("  Reply: NodeType=%d sw=%d (0x%x)", req.NodeType, req.SwId, sw.Crc16())
-	return &UpgradeReply{
+	glog.Infof("  Reply: NodeType=%d sw=%d->%d (0x%x)", req.NodeType, req.SwId, swId, sw.Crc16())
+	repl := UpgradeReply{
 		NodeType: req.NodeType,
-		SwId:     req.NodeType,
+		SwId:     swId,
 		SwSize:   uint16(len(sw) / 16), // sw size in units of 16 bytes
 		SwCheck:  sw.Crc16(),
 	}
+	b.track.upgrade(group, node, req, &repl)
+	if b.db != nil && req.SwId == repl.SwId && req.SwCheck == repl.SwCheck {
+		err := b.db.RolloutConfirm(req.NodeType, group, node, req.SwId, req.SwCheck)
+		if err != nil {
+			glog.Errorf("Error writing database: %s", err.Error())
+		}
+	}
+	return &repl
 }
 
-func (b *booter) Download(req DownloadRequest) *DownloadReply {
-	sw, err := b.findSoftware(req.SwId)
+// activeSwId returns the software ID a node should run, see Upgrade
+func (b *booter) activeSwId(nodeType uint16, group, node byte) (uint16, error) {
+	if b.db == nil {
+		return nodeType, nil
+	}
+	swId, err := b.db.ActiveFirmware(nodeType, group, node)
+	if err == database.ErrNotFound {
+		swId, err = b.db.RolloutTarget(nodeType, group, node)
+	}
+	if err == database.ErrNotFound {
+		swId, err = b.db.ActiveFirmware(nodeType, 0, 0)
+	}
+	if err == database.ErrNotFound {
+		return nodeType, nil
+	}
+	return swId, err
+}
+
+func (b *booter) Download(group, node byte, req DownloadRequest) *DownloadReply {
+	var sw software
+	var err error
+	if req.SwId >= database.FirstSwId {
+		sw, err = b.findFirmware(req.SwId)
+	} else {
+		sw, err = b.findSoftware(req.SwId)
+	}
 	if err != nil {
-		glog.Warningf("Cannot load sketch for NodeType %d: %s", req.SwId, err.Error())
+		glog.Warningf("Cannot load sketch for SwId %d: %s", req.SwId, err.Error())
 		return nil
 	}
-	offset := req.SwIndex * BOOT_DATA_MAX
-	if offset >= uint16(len(sw)) {
+	offset := int(req.SwIndex) * BOOT_DATA_MAX // int: images can be larger than 64KB
+	if offset >= len(sw) {
 		glog.Warningf("Request beyond end of sw: ix=%d -> off=%d, SwSize=%d",
 			req.SwIndex, offset, len(sw))
 		return nil
@@ -152,6 +243,7 @@ func (b *booter) Download(req DownloadRequest) *DownloadReply {
 	repl := DownloadReply{SwIdXorIx: req.SwId ^ req.SwIndex}
 	glog.Infof("  Reply: sw=%d %d bytes", req.SwId, len(data))
 	deWhiten(data, repl.Data[:])
+	b.track.download(group, node, req, len(sw))
 	return &repl
 }
 
@@ -0,0 +1,121 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+// Upgrade session tracking
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/tve/widuino/gears"
+	"github.com/tve/widuino/hub/database"
+)
+
+// upgradeTracker follows the over-the-air upgrade of each node: a session starts when the
+// booter tells a node to run different software, counts the chunks the node downloads, and
+// ends when the node comes back with an upgrade request reporting what it runs. Sessions
+// are saved in the database after each change, if there is one.
+type upgradeTracker struct {
+	mutex    sync.Mutex
+	db       *database.DB               // where to save sessions, may be nil
+	sessions map[uint16]*upgradeSession // open sessions by group<<8|node
+	last     int64                      // start time of the last session, keeps keys unique
+}
+
+type upgradeSession struct {
+	gears.UpgradeSession
+	served []bool // which chunks have been served
+}
+
+func newUpgradeTracker(db *database.DB) *upgradeTracker {
+	return &upgradeTracker{db: db, sessions: make(map[uint16]*upgradeSession)}
+}
+
+func nodeKey(group, node byte) uint16 {
+	return uint16(group)<<8 | uint16(node)
+}
+
+// upgrade processes an upgrade request and the reply the booter is about to send
+func (t *upgradeTracker) upgrade(group, node byte, req UpgradeRequest, repl *UpgradeReply) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now().UnixNano() / 1000000
+
+	s := t.sessions[nodeKey(group, node)]
+	if s != nil {
+		switch {
+		case req.SwId == s.SwId && req.SwCheck == s.SwCheck:
+			s.State = gears.UpgradeConfirmed
+		case s.State == gears.UpgradeDownloaded || repl.SwId != s.SwId:
+			s.State = gears.UpgradeFailed
+		default:
+			return // node restarted the download
+		}
+		s.EndAt = now
+		glog.Infof("  Upgrade of RFg%di%d to sw=%d %s", group, node, s.SwId, s.State)
+		t.save(s)
+		delete(t.sessions, nodeKey(group, node))
+	}
+
+	if req.SwId != repl.SwId || req.SwCheck != repl.SwCheck {
+		s = t.start(group, node, repl.SwId, int(repl.SwSize)*16)
+		s.NodeType = req.NodeType
+		s.FromSwId = req.SwId
+		s.SwCheck = repl.SwCheck
+		glog.Infof("  Upgrade of RFg%di%d from sw=%d to sw=%d started",
+			group, node, s.FromSwId, s.SwId)
+		t.save(s)
+	}
+}
+
+// download processes a download request for software of the given size that got served
+func (t *upgradeTracker) download(group, node byte, req DownloadRequest, size int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	ix := int(req.SwIndex)
+	s := t.sessions[nodeKey(group, node)]
+	if s == nil || s.SwId != req.SwId || ix >= s.Chunks {
+		// we don't know how the node got here, e.g. the hub restarted
+		s = t.start(group, node, req.SwId, size)
+	}
+	if s.served[ix] {
+		s.Retries += 1
+	} else {
+		s.served[ix] = true
+		s.Served += 1
+	}
+	s.LastAt = time.Now().UnixNano() / 1000000
+	if ix == s.Chunks-1 && s.State == gears.UpgradeDownloading {
+		s.State = gears.UpgradeDownloaded
+		glog.Infof("  Upgrade of RFg%di%d to sw=%d downloaded, %d chunks, %d retries",
+			group, node, s.SwId, s.Chunks, s.Retries)
+	}
+	t.save(s)
+}
+
+// start opens a new session
+func (t *upgradeTracker) start(group, node byte, swId uint16, size int) *upgradeSession {
+	chunks := (size + BOOT_DATA_MAX - 1) / BOOT_DATA_MAX
+	t.last += 1
+	if now := time.Now().UnixNano() / 1000000; now > t.last {
+		t.last = now
+	}
+	s := &upgradeSession{
+		UpgradeSession: gears.UpgradeSession{Group: group, Node: node, SwId: swId,
+			Chunks: chunks, State: gears.UpgradeDownloading, Start: t.last},
+		served: make([]bool, chunks),
+	}
+	t.sessions[nodeKey(group, node)] = s
+	return s
+}
+
+func (t *upgradeTracker) save(s *upgradeSession) {
+	if t.db == nil {
+		return
+	}
+	if err := t.db.PutUpgradeSession(s.UpgradeSession); err != nil {
+		glog.Errorf("Error writing database: %s", err.Error())
+	}
+}
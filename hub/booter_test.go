@@ -5,6 +5,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -15,6 +16,8 @@ import (
 	"github.com/golang/glog"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/tve/widuino/gears"
+	"github.com/tve/widuino/hub/database"
 )
 
 //===== tests =====
@@ -26,7 +29,7 @@ var _ = Describe("Booter", func() {
 		var boo Booter
 
 		BeforeEach(func() {
-			boo = NewBooter("test_config1.json")
+			boo = NewBooter("test_config1.json", nil)
 			time.Sleep(10 * time.Millisecond)
 		})
 
@@ -35,7 +38,7 @@ var _ = Describe("Booter", func() {
 		})
 
 		It("returns hardware ID mappings", func() {
-			b := boo.(*booter)
+			b := boo.(*booter).snapshot()
 			Ω(len(b.nodeType)).Should(Equal(2))
 			Ω(b.nodeType["00000000000000000000000000000000"]).
 				Should(Equal(pairingInfo{100, 252, 2}))
@@ -44,12 +47,25 @@ var _ = Describe("Booter", func() {
 		})
 
 		It("returns sketch mappings", func() {
-			b := boo.(*booter)
-			Eventually(
-				func() map[uint16]string { return b.sketch }).
-				Should(HaveLen(3))
+			b := boo.(*booter).snapshot()
+			Ω(b.sketch).Should(HaveLen(2))
 			Ω(b.sketch[100]).Should(Equal("hex/default.hex"))
-			Ω(b.sketch[101]).Should(Equal("hex/tempNode.hex"))
+			Ω(b.sketch[101]).Should(Equal("hex/short.hex"))
+		})
+
+		It("loads all sketches", func() {
+			b := boo.(*booter).snapshot()
+			Ω(b.software).Should(HaveLen(2))
+			Ω(b.software["hex/default.hex"]).Should(HaveLen(5024))
+			Ω(b.software["hex/short.hex"]).Should(HaveLen(240))
+		})
+
+		It("reports its status", func() {
+			status := boo.(*booter).Status()
+			Ω(status.Error).Should(BeEmpty())
+			Ω(status.LoadedAt).ShouldNot(BeZero())
+			Ω(status.Nodes).Should(Equal(2))
+			Ω(status.Sketches).Should(Equal(2))
 		})
 
 	})
@@ -82,7 +98,7 @@ var _ = Describe("Booter", func() {
 		var req PairingRequest
 
 		BeforeEach(func() {
-			boo = NewBooter("test_config1.json")
+			boo = NewBooter("test_config1.json", nil)
 			time.Sleep(10 * time.Millisecond)
 			req = PairingRequest{101, 13, 14, 0, [16]uint8{}}
 		})
@@ -103,6 +119,64 @@ var _ = Describe("Booter", func() {
 		})
 	})
 
+	Describe("Pair with a pairing database", func() {
+		var boo Booter
+		var req PairingRequest
+		var pdb *database.DB
+		var dbDir string
+
+		BeforeEach(func() {
+			dbDir = fmt.Sprintf("/tmp/db-p-%d", os.Getpid())
+			var err error
+			pdb, err = database.Open(dbDir)
+			Ω(err).ShouldNot(HaveOccurred())
+			boo = NewBooter("test_config1.json", pdb)
+			time.Sleep(10 * time.Millisecond)
+			req = PairingRequest{101, 0, 0, 0, [16]uint8{}}
+		})
+		AfterEach(func() {
+			pdb.Close()
+			os.RemoveAll(dbDir)
+		})
+
+		It("uses the config first", func() {
+			req.HwId = [16]uint8{1, 2, 3, 4}
+			rep := boo.Pair(req)
+			Ω(rep.NodeId).Should(Equal(uint8(3)))
+			Ω(pdb.ListPairings()).Should(BeEmpty())
+		})
+		It("allocates node IDs and remembers them", func() {
+			req.HwId = [16]uint8{9}
+			rep := boo.Pair(req)
+			Ω(rep.NodeType).Should(Equal(uint16(100)))
+			Ω(rep.GroupId).Should(Equal(uint8(252)))
+			Ω(rep.NodeId).Should(Equal(uint8(1)))
+			Ω(rep.ShKey).Should(Equal([16]uint8{}))
+
+			// a virgin node gets a new hwId and the next free ID, skipping the config's
+			req.HwId = [16]uint8{}
+			rep = boo.Pair(req)
+			Ω(rep.NodeId).Should(Equal(uint8(2)))
+			req.HwId = [16]uint8{}
+			rep = boo.Pair(req)
+			Ω(rep.NodeId).Should(Equal(uint8(4)))
+			Ω(rep.ShKey).ShouldNot(Equal([16]uint8{}))
+			p, err := pdb.GetPairing(hex.EncodeToString(rep.ShKey[:]))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(p.ShKey).Should(Equal(rep.ShKey))
+
+			// coming back with the hwId it got yields the same pairing
+			req.HwId = rep.ShKey
+			rep = boo.Pair(req)
+			Ω(rep.NodeId).Should(Equal(uint8(4)))
+			Ω(rep.ShKey).Should(Equal([16]uint8{}))
+			req.HwId = [16]uint8{9}
+			rep = boo.Pair(req)
+			Ω(rep.NodeId).Should(Equal(uint8(1)))
+			Ω(pdb.ListPairings()).Should(HaveLen(3))
+		})
+	})
+
 	Describe("readHex", func() {
 		var hex, bad_hex string
 		BeforeEach(func() {
@@ -127,44 +201,205 @@ var _ = Describe("Booter", func() {
 			Ω(err).ShouldNot(BeNil())
 			Ω(sw).Should(BeEmpty())
 		})
+		It("fills gaps with 0xFF", func() {
+			sw, err := readHex(strings.NewReader(
+				":0400000001020304F2\n:020010000506E3\n:00000001FF\n"))
+			Ω(err).Should(BeNil())
+			Ω(fmt.Sprintf("%X", sw)).Should(Equal(
+				"01020304FFFFFFFFFFFFFFFFFFFFFFFF" +
+					"0506FFFFFFFFFFFFFFFFFFFFFFFFFFFF"))
+		})
+		It("stops at the end of file record", func() {
+			sw, err := readHex(strings.NewReader(
+				":0400000001020304F2\n:00000001FF\n:020010000506E3\n"))
+			Ω(err).Should(BeNil())
+			Ω(sw).Should(HaveLen(16))
+		})
+		It("handles extended linear addresses", func() {
+			sw, err := readHex(strings.NewReader(":0400000001020304F2\n" +
+				":020000040001F9\n:020000000708EF\n:0400000500000000F7\n:00000001FF\n"))
+			Ω(err).Should(BeNil())
+			Ω(sw).Should(HaveLen(0x10010))
+			Ω(sw[0x10000:0x10003]).Should(Equal([]byte{7, 8, 0xFF}))
+			Ω(sw[0x8000]).Should(Equal(byte(0xFF)))
+		})
+		It("handles extended segment addresses", func() {
+			sw, err := readHex(strings.NewReader(":020000021000EC\n:0100040009F2\n"))
+			Ω(err).Should(BeNil())
+			Ω(sw).Should(HaveLen(0x10010))
+			Ω(sw[0x10004]).Should(Equal(byte(9)))
+		})
+		It("rejects overlapping records", func() {
+			_, err := readHex(strings.NewReader(":0400000001020304F2\n:02000200AABB97\n"))
+			Ω(err).Should(MatchError("line 2: overlapping data at 0x2"))
+		})
+		It("rejects unknown records", func() {
+			_, err := readHex(strings.NewReader(":00000006FA\n"))
+			Ω(err).Should(MatchError("line 1: unknown record type 6"))
+		})
 	})
 
 	Describe("findSoftware", func() {
 		var boo, boo2 *booter
 
 		BeforeEach(func() {
-			boo = NewBooter("test_config1.json")
-			boo2 = NewBooter("hex/test_config3.json")
+			boo = NewBooter("test_config1.json", nil)
+			boo2 = NewBooter("hex/test_config3.json", nil)
 			time.Sleep(10 * time.Millisecond)
 		})
 		It("finds existing software", func() {
 			sw, err := boo.findSoftware(100)
 			Ω(err).Should(BeNil())
-			Ω(sw).ShouldNot(BeEmpty())
-			Ω(boo.software).Should(HaveLen(1))
-		})
-		It("errors for non-existing software", func() {
-			sw, err := boo.findSoftware(101)
-			Ω(err).ShouldNot(BeNil())
-			Ω(sw).Should(BeEmpty())
-			Ω(boo.software).Should(HaveLen(0))
+			Ω(sw).Should(HaveLen(5024))
 		})
 		It("errors for non-existing software", func() {
 			sw, err := boo.findSoftware(102)
 			Ω(err).ShouldNot(BeNil())
 			Ω(sw).Should(BeEmpty())
 		})
-		It("errors for bad sketch files", func() {
-			sw, err := boo.findSoftware(113)
-			Ω(err).Should(MatchError("line 9: bad checksum -5"))
-			Ω(sw).Should(BeEmpty())
-		})
 		It("finds relative hex files", func() {
 			glog.Warningf("Boo2: %#v", boo2)
 			sw, err := boo2.findSoftware(100)
 			Ω(err).Should(BeNil())
 			Ω(sw).ShouldNot(BeEmpty())
-			Ω(boo2.software).Should(HaveLen(1))
+			Ω(boo2.snapshot().software).Should(HaveLen(2))
+		})
+	})
+
+	Describe("readBootConfig", func() {
+		var configPath string
+		const hw1 = "01000000000000000000000000000000"
+		const hw2 = "02000000000000000000000000000000"
+
+		// readConfig writes a config with the pairings and sketches given and reads it
+		readConfig := func(pairings, sketches string) error {
+			ioutil.WriteFile(configPath, []byte(pairings+"\n"+sketches+"\n"), 0600)
+			_, err := readBootConfig(configPath)
+			return err
+		}
+
+		BeforeEach(func() {
+			configPath = path.Join("hex", fmt.Sprintf("config-%d.json", os.Getpid()))
+		})
+		AfterEach(func() {
+			os.Remove(configPath)
+		})
+
+		It("accepts good configs", func() {
+			err := readConfig(`{ "`+hw1+`": [ 100, 252, 3 ], "`+hw2+`": [ 100, 252, 4 ] }`,
+				`{ "100": "default.hex" }`)
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+		It("rejects bad sketch files", func() {
+			err := readConfig(`{}`, `{ "100": "default.hex", "113": "./bad_sketch.hex" }`)
+			Ω(err).Should(MatchError("hex/bad_sketch.hex: line 9: bad checksum -5"))
+		})
+		It("rejects missing sketch files", func() {
+			err := readConfig(`{}`, `{ "101": "tempNode.hex" }`)
+			Ω(err).Should(MatchError(ContainSubstring("opening hex/tempNode.hex")))
+		})
+		It("rejects node types without sketch", func() {
+			err := readConfig(`{ "`+hw1+`": [ 101, 252, 3 ] }`, `{ "100": "default.hex" }`)
+			Ω(err).Should(MatchError(configPath + ": line 1: node " + hw1 +
+				": type 101 has no sketch"))
+		})
+		It("rejects duplicate node IDs", func() {
+			err := readConfig(`{ "`+hw1+`": [ 100, 252, 3 ],`+"\n"+`"`+hw2+`": [ 100, 252, 3 ] }`,
+				`{ "100": "default.hex" }`)
+			Ω(err).Should(MatchError(ContainSubstring("line 2: node " + hw2 +
+				": RF252i3 is already assigned on line 1")))
+		})
+		It("rejects node IDs outside 1..30", func() {
+			err := readConfig(`{ "`+hw1+`": [ 100, 252, 31 ] }`, `{ "100": "default.hex" }`)
+			Ω(err).Should(MatchError(ContainSubstring("line 1: node " + hw1 +
+				": node ID 31 is not 1..30")))
+		})
+		It("rejects bad JSON", func() {
+			err := readConfig(`{ "`+hw1+`": "55" }`, `{ "100": "default.hex" }`)
+			Ω(err).Should(MatchError(ContainSubstring("error reading pairing: line 1")))
+		})
+		It("rejects bad hwIds", func() {
+			err := readConfig(`{ "01": [ 100, 252, 3 ] }`, `{ "100": "default.hex" }`)
+			Ω(err).Should(MatchError(ContainSubstring(`line 1: hwId "01" is not 32 hex digits`)))
+		})
+
+		Context("structured format", func() {
+			// writeConfig writes a structured config and reads it
+			writeConfig := func(config string) error {
+				ioutil.WriteFile(configPath, []byte(config), 0600)
+				_, err := readBootConfig(configPath)
+				return err
+			}
+
+			It("reads configs", func() {
+				ioutil.WriteFile(configPath, []byte(`# structured config
+{
+	"nodes": [
+		{ "hwId": "`+hw1+`", "group": 252, "node": 3, "type": 100,
+		  "label": "kitchen # 1" }, # comment
+		{ "hwId": "`+strings.ToUpper(hw2)+`", "group": 252, "node": 4, "type": 101 }
+	],
+	"sketches": [
+		{ "type": 100, "path": "default.hex", "version": "1.0" },
+		{ "type": 101, "path": "short.hex", "notes": "for #2" }
+	]
+}
+`), 0600)
+				c, err := readBootConfig(configPath)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(c.legacy).Should(BeFalse())
+				Ω(c.nodeType).Should(Equal(map[string]pairingInfo{
+					hw1: pairingInfo{100, 252, 3}, hw2: pairingInfo{101, 252, 4}}))
+				Ω(c.sketch).Should(Equal(map[uint16]string{100: "default.hex", 101: "short.hex"}))
+				Ω(c.software).Should(HaveLen(2))
+			})
+			It("reports syntax errors with their line", func() {
+				err := writeConfig("{\n\"nodes\": [\n{ \"hwId\": \"" + hw1 + "\",, }\n]}")
+				Ω(err).Should(MatchError(ContainSubstring("line 3: invalid character ','")))
+			})
+			It("reports type errors with their line", func() {
+				err := writeConfig("{\n\"nodes\": [\n{ \"hwId\": \"" + hw1 + "\",\n" +
+					"\"node\": 300 }\n]}")
+				Ω(err).Should(MatchError(ContainSubstring("line 4: json: cannot unmarshal")))
+			})
+			It("rejects unknown fields", func() {
+				err := writeConfig("{\"nodes\": [],\n\"sketches\": [\n{ \"typ\": 100 } ] }")
+				Ω(err).Should(MatchError(ContainSubstring(`line 3: json: unknown field "typ"`)))
+			})
+			It("rejects unknown sections", func() {
+				err := writeConfig("{\"nodes\": [],\n\"sketch\": [] }")
+				Ω(err).Should(MatchError(ContainSubstring(`line 2: unknown section "sketch"`)))
+			})
+			It("rejects duplicate hwIds", func() {
+				err := writeConfig(`{"sketches": [ { "type": 100, "path": "default.hex" } ],
+"nodes": [ { "hwId": "` + hw1 + `", "group": 252, "node": 3, "type": 100 },
+	{ "hwId": "` + hw1 + `", "group": 252, "node": 4, "type": 100 } ] }`)
+				Ω(err).Should(MatchError(ContainSubstring("line 3: node " + hw1 +
+					" is already on line 2")))
+			})
+			It("rejects duplicate sketches", func() {
+				err := writeConfig(`{"sketches": [ { "type": 100, "path": "default.hex" },
+	{ "type": 100, "path": "short.hex" } ] }`)
+				Ω(err).Should(MatchError(ContainSubstring(
+					"line 2: type 100 already has a sketch on line 1")))
+			})
+		})
+
+		It("converts legacy configs", func() {
+			var buf bytes.Buffer
+			Ω(convertBootConfig("test_config1.json", &buf)).Should(Succeed())
+			Ω(buf.String()).Should(ContainSubstring(`"hwId": "01020304000000000000000000000000"`))
+			// the converted config needs to be next to the original for the paths to work
+			configPath = path.Base(configPath)
+			ioutil.WriteFile(configPath, buf.Bytes(), 0600)
+			c1, err := readBootConfig("test_config1.json")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(c1.legacy).Should(BeTrue())
+			c2, err := readBootConfig(configPath)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(c2.legacy).Should(BeFalse())
+			Ω(c2.nodeType).Should(Equal(c1.nodeType))
+			Ω(c2.sketch).Should(Equal(c1.sketch))
 		})
 	})
 
@@ -173,12 +408,12 @@ var _ = Describe("Booter", func() {
 		var req UpgradeRequest
 
 		BeforeEach(func() {
-			boo = NewBooter("test_config1.json")
+			boo = NewBooter("test_config1.json", nil)
 			time.Sleep(10 * time.Millisecond)
 			req = UpgradeRequest{100, 55, 1024, 0}
 		})
 		It("handles an existing software", func() {
-			rep := boo.Upgrade(req)
+			rep := boo.Upgrade(252, 5, req)
 			Ω(rep).ShouldNot(BeNil())
 			Ω(rep.NodeType).Should(Equal(req.NodeType))
 			Ω(rep.SwId).Should(Equal(req.NodeType))
@@ -186,23 +421,148 @@ var _ = Describe("Booter", func() {
 			Ω(rep.SwCheck).Should(Equal(uint16(61194)))
 		})
 		It("handles an missing software", func() {
-			req.NodeType = 101
-			rep := boo.Upgrade(req)
+			req.NodeType = 102
+			rep := boo.Upgrade(252, 5, req)
 			Ω(rep).Should(BeNil())
 		})
 	})
 
+	Describe("Upgrade from the firmware repository", func() {
+		var boo Booter
+		var pdb *database.DB
+		var dbDir string
+		var fw1, fw2 gears.Firmware
+
+		BeforeEach(func() {
+			dbDir = fmt.Sprintf("/tmp/db-p-%d", os.Getpid())
+			var err error
+			pdb, err = database.Open(dbDir)
+			Ω(err).ShouldNot(HaveOccurred())
+			boo = NewBooter("test_config1.json", pdb)
+			time.Sleep(10 * time.Millisecond)
+			img1 := bytes.Repeat([]byte{1}, 80)
+			fw1, err = pdb.PutFirmware(gears.Firmware{NodeType: 100,
+				Crc: software(img1).Crc16()}, img1)
+			Ω(err).ShouldNot(HaveOccurred())
+			img2 := bytes.Repeat([]byte{2}, 96)
+			fw2, err = pdb.PutFirmware(gears.Firmware{NodeType: 100,
+				Crc: software(img2).Crc16()}, img2)
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			pdb.Close()
+			os.RemoveAll(dbDir)
+		})
+
+		It("falls back to the config", func() {
+			rep := boo.Upgrade(252, 5, UpgradeRequest{100, 55, 1024, 0})
+			Ω(rep).ShouldNot(BeNil())
+			Ω(rep.SwId).Should(Equal(uint16(100)))
+			Ω(rep.SwSize).Should(Equal(uint16(5024 / 16)))
+		})
+		It("serves the active firmware", func() {
+			_, err := pdb.ActivateFirmware(fw1.SwId, 0, 0)
+			Ω(err).ShouldNot(HaveOccurred())
+			_, err = pdb.ActivateFirmware(fw2.SwId, 252, 6)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			rep := boo.Upgrade(252, 5, UpgradeRequest{100, 55, 1024, 0})
+			Ω(rep.SwId).Should(Equal(fw1.SwId))
+			Ω(rep.SwSize).Should(Equal(uint16(5)))
+			Ω(rep.SwCheck).Should(Equal(fw1.Crc))
+			rep = boo.Upgrade(252, 6, UpgradeRequest{100, 55, 1024, 0})
+			Ω(rep.SwId).Should(Equal(fw2.SwId))
+			Ω(rep.SwSize).Should(Equal(uint16(6)))
+
+			dr := boo.Download(252, 6, DownloadRequest{fw2.SwId, 1})
+			Ω(dr).ShouldNot(BeNil())
+			Ω(dr.SwIdXorIx).Should(Equal(fw2.SwId ^ 1))
+			data := make([]byte, BOOT_DATA_MAX)
+			deWhiten(dr.Data[:], data)
+			Ω(data[:32]).Should(Equal(bytes.Repeat([]byte{2}, 32)))
+			Ω(boo.Download(252, 6, DownloadRequest{fw2.SwId, 2})).Should(BeNil())
+		})
+		It("stages rollouts", func() {
+			_, err := pdb.ActivateFirmware(fw1.SwId, 0, 0)
+			Ω(err).ShouldNot(HaveOccurred())
+			_, err = pdb.StartRollout(fw2.SwId, 252, []byte{6})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(boo.Upgrade(252, 5, UpgradeRequest{100, 0, 0, 0}).SwId).Should(Equal(fw1.SwId))
+			Ω(boo.Upgrade(252, 6, UpgradeRequest{100, 0, 0, 0}).SwId).Should(Equal(fw2.SwId))
+			Ω(pdb.RolloutHeard(252, 6)).Should(Succeed()) // not confirmed yet
+			boo.Upgrade(252, 6, UpgradeRequest{100, fw2.SwId, 6, fw2.Crc})
+			r, err := pdb.GetRollout(100)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(r.Confirmed).Should(Equal([]byte{6}))
+			Ω(r.State).Should(Equal(gears.RolloutCanary))
+
+			Ω(pdb.RolloutHeard(252, 6)).Should(Succeed())
+			r, err = pdb.GetRollout(100)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(r.State).Should(Equal(gears.RolloutPromoted))
+			Ω(boo.Upgrade(252, 5, UpgradeRequest{100, 0, 0, 0}).SwId).Should(Equal(fw2.SwId))
+		})
+		It("lets pinned nodes ignore rollouts", func() {
+			_, err := pdb.ActivateFirmware(fw1.SwId, 252, 6)
+			Ω(err).ShouldNot(HaveOccurred())
+			_, err = pdb.StartRollout(fw2.SwId, 252, []byte{6})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(boo.Upgrade(252, 6, UpgradeRequest{100, 0, 0, 0}).SwId).Should(Equal(fw1.SwId))
+		})
+		It("tracks upgrade sessions", func() {
+			_, err := pdb.ActivateFirmware(fw1.SwId, 0, 0)
+			Ω(err).ShouldNot(HaveOccurred())
+			sub := pdb.UpgradeSubscribe(252, 5)
+			defer pdb.UpgradeUnsubscribe(sub)
+
+			boo.Upgrade(252, 5, UpgradeRequest{100, 100, 314, 0x1234})
+			Ω((<-sub).State).Should(Equal(gears.UpgradeDownloading))
+			for _, ix := range []uint16{0, 0, 1} {
+				Ω(boo.Download(252, 5, DownloadRequest{fw1.SwId, ix})).ShouldNot(BeNil())
+			}
+			boo.Upgrade(252, 5, UpgradeRequest{100, fw1.SwId, 5, fw1.Crc})
+
+			sessions, err := pdb.ListUpgradeSessions(252, 5)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(sessions).Should(HaveLen(1))
+			s := sessions[0]
+			Ω(s.State).Should(Equal(gears.UpgradeConfirmed))
+			Ω(s.FromSwId).Should(Equal(uint16(100)))
+			Ω(s.SwId).Should(Equal(fw1.SwId))
+			Ω(s.Chunks).Should(Equal(2))
+			Ω(s.Served).Should(Equal(2))
+			Ω(s.Retries).Should(Equal(1))
+			Ω(s.EndAt).ShouldNot(BeZero())
+			Ω(sub).Should(HaveLen(4))
+		})
+		It("detects failed upgrades", func() {
+			_, err := pdb.ActivateFirmware(fw1.SwId, 0, 0)
+			Ω(err).ShouldNot(HaveOccurred())
+			boo.Upgrade(252, 5, UpgradeRequest{100, 100, 314, 0x1234})
+			boo.Download(252, 5, DownloadRequest{fw1.SwId, 1})
+			boo.Upgrade(252, 5, UpgradeRequest{100, 100, 314, 0x1234})
+
+			sessions, err := pdb.ListUpgradeSessions(0, 0)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(sessions).Should(HaveLen(2))
+			Ω(sessions[0].State).Should(Equal(gears.UpgradeFailed))
+			Ω(sessions[0].Served).Should(Equal(1))
+			Ω(sessions[1].State).Should(Equal(gears.UpgradeDownloading))
+		})
+	})
+
 	Describe("Download", func() {
 		var boo Booter
 		var req DownloadRequest
 
 		BeforeEach(func() {
-			boo = NewBooter("test_config1.json")
+			boo = NewBooter("test_config1.json", nil)
 			time.Sleep(10 * time.Millisecond)
 			req = DownloadRequest{100, 0}
 		})
 		It("handles the first chunk of an existing software", func() {
-			rep := boo.Download(req)
+			rep := boo.Download(252, 5, req)
 			Ω(rep).ShouldNot(BeNil())
 			Ω(rep.SwIdXorIx).Should(Equal(req.SwId ^ req.SwIndex))
 			data := make([]byte, len(rep.Data))
@@ -215,7 +575,7 @@ var _ = Describe("Booter", func() {
 		})
 		It("handles the third chunk of an existing software", func() {
 			req.SwIndex = 2
-			rep := boo.Download(req)
+			rep := boo.Download(252, 5, req)
 			Ω(rep).ShouldNot(BeNil())
 			Ω(rep.SwIdXorIx).Should(Equal(req.SwId ^ req.SwIndex))
 			data := make([]byte, len(rep.Data))
@@ -228,7 +588,7 @@ var _ = Describe("Booter", func() {
 		})
 		It("handles an missing software", func() {
 			req.SwId = 105
-			rep := boo.Download(req)
+			rep := boo.Download(252, 5, req)
 			Ω(rep).Should(BeNil())
 		})
 
@@ -260,9 +620,12 @@ var _ = Describe("Booter", func() {
 			// replace the default sketch hex
 			config = bytes.Replace(config, []byte("hex/default.hex"),
 				[]byte(defaultName), -1)
+			wd, _ := os.Getwd()
+			config = bytes.Replace(config, []byte("hex/short.hex"),
+				[]byte(path.Join(wd, "hex/short.hex")), -1)
 			ioutil.WriteFile(configPath, config, 0600)
 			// create booter
-			boo = NewBooter(configPath)
+			boo = NewBooter(configPath, nil)
 			time.Sleep(10 * time.Millisecond)
 		})
 
@@ -276,7 +639,7 @@ var _ = Describe("Booter", func() {
 			b := boo.(*booter)
 
 			hasShortSketch := func() bool {
-				for _, s := range b.sketch {
+				for _, s := range b.snapshot().sketch {
 					if s == shortPath {
 						return true
 					}
@@ -307,5 +670,49 @@ var _ = Describe("Booter", func() {
 			}).Should(Equal(240))
 		})
 
+		It("keeps the previous config on errors", func() {
+			b := boo.(*booter)
+			// writeFile replaces a file atomically so no reload sees it truncated
+			writeFile := func(file string, data []byte) {
+				ioutil.WriteFile(file+".tmp", data, 0600)
+				os.Rename(file+".tmp", file)
+			}
+			writeFile(configPath, config[:len(config)/2])
+			Eventually(func() string { return b.Status().Error }).ShouldNot(BeEmpty())
+			Ω(b.snapshot().sketch).Should(HaveLen(2))
+			sw, _ := b.findSoftware(100)
+			Ω(sw).Should(HaveLen(5024))
+
+			writeFile(configPath, config)
+			Eventually(func() string { return b.Status().Error }).Should(BeEmpty())
+			writeFile(defaultPath, []byte(":0400000001020304F0\n"))
+			Eventually(func() string { return b.Status().Error }).
+				Should(ContainSubstring("bad checksum"))
+			sw, _ = b.findSoftware(100)
+			Ω(sw).Should(HaveLen(5024))
+
+			writeFile(defaultPath, shortHex)
+			Eventually(func() string { return b.Status().Error }).Should(BeEmpty())
+			Eventually(func() int {
+				sw, _ := b.findSoftware(100)
+				return len(sw)
+			}).Should(Equal(240))
+		})
+
+		It("reloads when a missing sketch shows up", func() {
+			b := boo.(*booter)
+			os.Remove(defaultPath)
+			ioutil.WriteFile(configPath, config, 0600)
+			Eventually(func() string { return b.Status().Error }).
+				Should(ContainSubstring("opening " + defaultPath))
+
+			ioutil.WriteFile(defaultPath, shortHex, 0600)
+			Eventually(func() int {
+				sw, _ := b.findSoftware(100)
+				return len(sw)
+			}).Should(Equal(240))
+			Ω(b.Status().Error).Should(BeEmpty())
+		})
+
 	})
 })
@@ -3,11 +3,15 @@
 package main
 
 import (
+	"fmt"
 	"io"
+	"strings"
 	"time"
 
 	"github.com/golang/glog"
 	"github.com/tve/widuino/gears"
+	"github.com/tve/widuino/hub/database"
+	"github.com/tve/widuino/interpol8"
 )
 
 func HandleEchoRequest(req *gears.EchoRequest) gears.Reply {
@@ -21,12 +25,12 @@ func HandleRFSubRequest(req *gears.RFSubRequest) gears.Reply {
 	if req.Messages == nil {
 		return gears.Reply{Code: gears.CodeClientError, Error: "Messages channel is nil"}
 	}
-	c := db.RFSubscribe(req.StartAt)
+	c := db.RFSubscribe(req.StartAt, req.Match)
 	dt := req.StartAt/1000 - time.Now().Unix()
 	if req.StartAt <= 0 {
 		dt = 0
 	}
-	glog.Infof("Start RF subscriber %v at now%+dsecs", c, dt)
+	glog.Infof("Start RF subscriber %v at now%+dsecs match=%+v", c, dt, req.Match)
 
 	// goroutine that will actually stream the subscription data
 	go func() {
@@ -50,11 +54,332 @@ func HandleRFSubRequest(req *gears.RFSubRequest) gears.Reply {
 	return gears.Reply{Code: gears.CodeOK}
 }
 
+// send an RF message, if an ACK is requested the reply is only sent once the ACK arrives
 func HandleRFSendRequest(req *gears.RFSendRequest) gears.Reply {
-	xmitChan <- gears.RFMessage(*req)
+	if udpGw != nil {
+		if s, held := udpGw.Post(gears.RFMessage(*req)); held {
+			return gears.Reply{Code: gears.CodeOK, MS: &s}
+		}
+	}
+	done := make(chan error, 1)
+	xmitChan <- XmitRequest{Msg: gears.RFMessage(*req), Reply: done}
+	err := <-done
+	switch {
+	case err == gears.AckTimeoutError:
+		return gears.Reply{Code: gears.CodeAckTimeout, Error: err.Error()}
+	case err != nil:
+		return gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+	}
+	return gears.Reply{Code: gears.CodeOK}
+}
+
+// Node Requests
+
+func HandleNodeGetRequest(req *gears.NodeGetRequest) gears.Reply {
+	ni, err := db.GetNodeInfo(req.Group, req.Node)
+	if err == database.ErrNotFound {
+		return gears.Reply{Code: gears.CodeClientError, Error: err.Error()}
+	} else if err != nil {
+		return gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+	}
+	return gears.Reply{Code: gears.CodeOK, NI: &ni}
+}
+
+func HandleNodePutRequest(req *gears.NodePutRequest) gears.Reply {
+	if req.Node < database.FirstNodeId || req.Node > database.LastNodeId {
+		return gears.Reply{Code: gears.CodeClientError, Error: fmt.Sprintf(
+			"node ID must be %d..%d", database.FirstNodeId, database.LastNodeId)}
+	}
+	err := db.PutNodeInfo(gears.NodeInfo(*req))
+	if err != nil {
+		return gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+	}
+	glog.Infof("Node RFg%03di%02d is now %s", req.Group, req.Node, gears.NodeInfo(*req).Label())
+	return gears.Reply{Code: gears.CodeOK}
+}
+
+func HandleNodeListRequest(req *gears.NodeListRequest) gears.Reply {
+	nodes, err := db.ListNodeInfo()
+	if err != nil {
+		return gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+	}
+	return gears.Reply{Code: gears.CodeOK, NL: nodes}
+}
+
+func HandleNodeDelRequest(req *gears.NodeDelRequest) gears.Reply {
+	err := db.DeleteNodeInfo(req.Group, req.Node)
+	if err != nil {
+		return gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+	}
+	return gears.Reply{Code: gears.CodeOK}
+}
+
+// Pairing Requests
+
+func HandlePairListRequest(req *gears.PairListRequest) gears.Reply {
+	pairings, err := db.ListPairings()
+	if err != nil {
+		return gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+	}
+	return gears.Reply{Code: gears.CodeOK, PRL: pairings}
+}
+
+func HandlePairAssignRequest(req *gears.PairAssignRequest) gears.Reply {
+	p := gears.Pairing(*req)
+	if len(p.HwId) != 32 {
+		return gears.Reply{Code: gears.CodeClientError, Error: "hwId must be 32 hex digits"}
+	}
+	if p.At == 0 {
+		p.At = time.Now().UnixNano() / 1000000
+	}
+	p, err := db.PutPairing(p, nil)
+	if err != nil {
+		return gears.Reply{Code: gears.CodeClientError, Error: err.Error()}
+	}
+	glog.Infof("Paired hwId=%s with RFg%03di%02d", p.HwId, p.Group, p.Node)
+	return gears.Reply{Code: gears.CodeOK, PR: &p}
+}
+
+func HandlePairForgetRequest(req *gears.PairForgetRequest) gears.Reply {
+	err := db.DeletePairing(req.HwId)
+	if err != nil {
+		return gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+	}
+	return gears.Reply{Code: gears.CodeOK}
+}
+
+// Firmware Requests
+
+func HandleFwUploadRequest(req *gears.FwUploadRequest) gears.Reply {
+	if req.NodeType == 0 {
+		return gears.Reply{Code: gears.CodeClientError, Error: "node type must not be 0"}
+	}
+	image, err := readHex(strings.NewReader(req.Hex))
+	if err != nil {
+		return gears.Reply{Code: gears.CodeClientError, Error: err.Error()}
+	}
+	if len(image) == 0 {
+		return gears.Reply{Code: gears.CodeClientError, Error: "firmware image is empty"}
+	}
+	fw := gears.Firmware{NodeType: req.NodeType, Name: req.Name,
+		Crc: software(image).Crc16(), At: time.Now().UnixNano() / 1000000}
+	fw, err = db.PutFirmware(fw, image)
+	if err != nil {
+		return gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+	}
+	glog.Infof("Firmware %d for nodeType=%d: %s, %d bytes, crc=0x%04x",
+		fw.SwId, fw.NodeType, fw.Name, fw.Size, fw.Crc)
+	return gears.Reply{Code: gears.CodeOK, FW: &fw}
+}
+
+func HandleFwListRequest(req *gears.FwListRequest) gears.Reply {
+	list, err := db.ListFirmware(req.NodeType)
+	if err != nil {
+		return gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+	}
+	return gears.Reply{Code: gears.CodeOK, FL: list}
+}
+
+func HandleFwActivateRequest(req *gears.FwActivateRequest) gears.Reply {
+	if req.HwId != "" {
+		// pin the version for a node given its hardware ID
+		p, err := db.GetPairing(req.HwId)
+		if err == database.ErrNotFound {
+			return gears.Reply{Code: gears.CodeClientError, Error: "hwId is not paired"}
+		} else if err != nil {
+			return gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+		}
+		req.Group, req.Node = p.Group, p.Node
+	}
+	fw, err := db.ActivateFirmware(req.SwId, req.Group, req.Node)
+	if err == database.ErrNotFound {
+		return gears.Reply{Code: gears.CodeClientError, Error: "no such firmware"}
+	} else if err != nil {
+		return gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+	}
+	glog.Infof("Firmware %d active for nodeType=%d %s", fw.SwId, fw.NodeType,
+		fwTarget(req.Group, req.Node))
+	return gears.Reply{Code: gears.CodeOK, FW: &fw}
+}
+
+func HandleFwRollbackRequest(req *gears.FwRollbackRequest) gears.Reply {
+	fw, err := db.RollbackFirmware(req.NodeType, req.Group, req.Node)
+	if err == database.ErrNotFound {
+		return gears.Reply{Code: gears.CodeClientError, Error: "no active firmware"}
+	} else if err == database.ErrNoRollback {
+		return gears.Reply{Code: gears.CodeClientError, Error: err.Error()}
+	} else if err != nil {
+		return gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+	}
+	glog.Infof("Firmware rolled back to %d for nodeType=%d %s", fw.SwId, fw.NodeType,
+		fwTarget(req.Group, req.Node))
+	return gears.Reply{Code: gears.CodeOK, FW: &fw}
+}
+
+func HandleBootStatusRequest(req *gears.BootStatusRequest) gears.Reply {
+	if boot == nil {
+		return gears.Reply{Code: gears.CodeServerError, Error: "boot server is not running"}
+	}
+	status := boot.Status()
+	return gears.Reply{Code: gears.CodeOK, BS: &status}
+}
+
+func HandleGatewayListRequest(req *gears.GatewayListRequest) gears.Reply {
+	if udpGw == nil {
+		return gears.Reply{Code: gears.CodeServerError, Error: "UDP gateway is not running"}
+	}
+	return gears.Reply{Code: gears.CodeOK, GL: udpGw.Gateways()}
+}
+
+func HandleNodeStatusListRequest(req *gears.NodeStatusListRequest) gears.Reply {
+	if liveness == nil {
+		return gears.Reply{Code: gears.CodeServerError, Error: "node liveness is not tracked"}
+	}
+	return gears.Reply{Code: gears.CodeOK, NSL: liveness.list()}
+}
+
+func HandleNodeStatusSubRequest(req *gears.NodeStatusSubRequest) gears.Reply {
+	if req.Events == nil {
+		return gears.Reply{Code: gears.CodeClientError, Error: "Events channel is nil"}
+	}
+	c := db.NodeStatusSubscribe(req.Group, req.Node)
+	glog.Infof("Start node status subscriber %v for %s", c, fwTarget(req.Group, req.Node))
+
+	go func() {
+		defer req.Events.Close()
+		for s := range c {
+			glog.V(2).Infof("Sending to %v: %+v", c, s)
+			err := req.Events.Send(s)
+			if err != nil {
+				db.NodeStatusUnsubscribe(c)
+				glog.Infof("Closing subscriber %v due to error: %s", c, err.Error())
+				for _ = range c {
+					// drain the channel so the sender doesn't block
+				}
+				return
+			}
+		}
+		glog.Infof("Closed subscriber %v due to incoming EOF", c)
+		return
+	}()
+	return gears.Reply{Code: gears.CodeOK}
+}
+
+func HandleMailListRequest(req *gears.MailListRequest) gears.Reply {
+	if udpGw == nil {
+		return gears.Reply{Code: gears.CodeServerError, Error: "UDP gateway is not running"}
+	}
+	return gears.Reply{Code: gears.CodeOK, ML: udpGw.mailbox.list(req.Group, req.Node)}
+}
+
+func HandleMailSubRequest(req *gears.MailSubRequest) gears.Reply {
+	if req.Status == nil {
+		return gears.Reply{Code: gears.CodeClientError, Error: "Status channel is nil"}
+	}
+	if udpGw == nil {
+		return gears.Reply{Code: gears.CodeServerError, Error: "UDP gateway is not running"}
+	}
+	c := udpGw.mailbox.subscribe(req.Group, req.Node)
+	glog.Infof("Start mail subscriber %v for %s", c, fwTarget(req.Group, req.Node))
+
+	go func() {
+		defer req.Status.Close()
+		for s := range c {
+			glog.V(2).Infof("Sending to %v: %+v", c, s)
+			err := req.Status.Send(s)
+			if err != nil {
+				udpGw.mailbox.unsubscribe(c)
+				glog.Infof("Closing subscriber %v due to error: %s", c, err.Error())
+				for _ = range c {
+					// drain the channel so the sender doesn't block
+				}
+				return
+			}
+		}
+		glog.Infof("Closed subscriber %v due to incoming EOF", c)
+		return
+	}()
 	return gears.Reply{Code: gears.CodeOK}
 }
 
+func HandleRolloutStartRequest(req *gears.RolloutStartRequest) gears.Reply {
+	r, err := db.StartRollout(req.SwId, req.Group, req.Canaries)
+	if err == database.ErrNotFound {
+		return gears.Reply{Code: gears.CodeClientError, Error: "no such firmware"}
+	} else if err == database.ErrNoCanaries {
+		return gears.Reply{Code: gears.CodeClientError, Error: err.Error()}
+	} else if err != nil {
+		return gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+	}
+	glog.Infof("Rollout of sw=%d for nodeType=%d started with canaries RFg%d %v",
+		r.SwId, r.NodeType, r.Group, r.Canaries)
+	return gears.Reply{Code: gears.CodeOK, RO: &r}
+}
+
+func HandleRolloutListRequest(req *gears.RolloutListRequest) gears.Reply {
+	rollouts, err := db.ListRollouts()
+	if err != nil {
+		return gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+	}
+	return gears.Reply{Code: gears.CodeOK, ROL: rollouts}
+}
+
+func HandleRolloutEndRequest(req *gears.RolloutEndRequest) gears.Reply {
+	r, err := db.EndRollout(req.NodeType, req.Promote)
+	if err == database.ErrNotFound {
+		return gears.Reply{Code: gears.CodeClientError, Error: "no rollout for this node type"}
+	} else if err == database.ErrRolloutEnded {
+		return gears.Reply{Code: gears.CodeClientError,
+			Error: fmt.Sprintf("rollout of sw=%d is already %s", r.SwId, r.State)}
+	} else if err != nil {
+		return gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+	}
+	return gears.Reply{Code: gears.CodeOK, RO: &r}
+}
+
+func HandleUpgradeListRequest(req *gears.UpgradeListRequest) gears.Reply {
+	sessions, err := db.ListUpgradeSessions(req.Group, req.Node)
+	if err != nil {
+		return gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+	}
+	return gears.Reply{Code: gears.CodeOK, UL: sessions}
+}
+
+func HandleUpgradeSubRequest(req *gears.UpgradeSubRequest) gears.Reply {
+	if req.Sessions == nil {
+		return gears.Reply{Code: gears.CodeClientError, Error: "Sessions channel is nil"}
+	}
+	c := db.UpgradeSubscribe(req.Group, req.Node)
+	glog.Infof("Start upgrade subscriber %v for %s", c, fwTarget(req.Group, req.Node))
+
+	go func() {
+		defer req.Sessions.Close()
+		for m := range c {
+			glog.V(2).Infof("Sending to %v: %+v", c, m)
+			err := req.Sessions.Send(m)
+			if err != nil {
+				db.UpgradeUnsubscribe(c)
+				glog.Infof("Closing subscriber %v due to error: %s", c, err.Error())
+				for _ = range c {
+					// drain the channel so the sender doesn't block
+				}
+				return
+			}
+		}
+		glog.Infof("Closed subscriber %v due to incoming EOF", c)
+		return
+	}()
+	return gears.Reply{Code: gears.CodeOK}
+}
+
+// fwTarget describes the nodes a firmware, upgrade, status, or mail request applies to
+func fwTarget(group, node byte) string {
+	if node == 0 {
+		return "(all nodes)"
+	}
+	return fmt.Sprintf("(RFg%03di%02d)", group, node)
+}
+
 // Sensor Requests
 
 func HandleSensorInfoRequest(req *gears.SensorInfoRequest) gears.Reply {
@@ -103,7 +428,10 @@ func HandleSensorDataRequest(req *gears.SensorDataRequest) gears.Reply {
 		return gears.Reply{Code: gears.CodeClientError, Error: "Values channel is nil"}
 	}
 
-	// TODO: handle req.Info !!!
+	err := db.PutSensorInfo(req.Name, req.Info)
+	if err != nil {
+		return gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+	}
 
 	go func() {
 		for {
@@ -124,19 +452,160 @@ func HandleSensorDataRequest(req *gears.SensorDataRequest) gears.Reply {
 	return gears.Reply{Code: gears.CodeOK}
 }
 
+const fillFct = 4 // steps to interpolate over when raw data points are missing
+
 func HandleSensorReadRequest(req *gears.SensorReadRequest) gears.Reply {
 	glog.Infof("Start sensor read of %s start=%d end=%d step=%d",
 		req.Name, req.StartAt/1000-time.Now().Unix(),
 		req.EndAt/1000-time.Now().Unix(), req.Step)
-	return gears.Reply{Code: gears.CodeServerError, Error: "Not yet implemented"}
+	if req.Values == nil {
+		return gears.Reply{Code: gears.CodeClientError, Error: "Values channel is nil"}
+	}
+	if e := checkSensorRead(req.StartAt, req.EndAt, req.Step); e != "" {
+		return gears.Reply{Code: gears.CodeClientError, Error: e}
+	}
+
+	values, err := sensorRead(req.Name, req.StartAt, req.EndAt, req.Step)
+	if err != nil {
+		return gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+	}
+
+	go func() {
+		defer req.Values.Close()
+		for _, v := range values {
+			err := req.Values.Send(v)
+			if err != nil {
+				glog.Infof("Aborting sensor read of %s due to error: %s",
+					req.Name, err.Error())
+				return
+			}
+		}
+	}()
+	return gears.Reply{Code: gears.CodeOK}
+}
+
+// checkSensorRead returns why a sensor read from start to end by step is invalid, or ""
+func checkSensorRead(start, end, step int64) string {
+	switch {
+	case start <= 0 || end < start:
+		return "bad time range"
+	case step < 2:
+		return "step must be > 1"
+	case (end-start)%step != 0:
+		return "time range is not a multiple of step"
+	}
+	return ""
+}
+
+// sensorRead produces interpolated values for a sensor from start to end inclusive by step
+func sensorRead(name string, start, end, step int64) ([]gears.SensorDataValue, error) {
+	points, err := sensorPoints(name, start, end, step)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]gears.SensorDataValue, len(points))
+	for i, p := range points {
+		values[i] = gears.SensorDataValue{At: int64(p.Asof), Value: p.Avg}
+	}
+	return values, nil
+}
+
+// sensorPoints produces the interpolated average, min, and max of a sensor for each step
+// from start to end inclusive
+func sensorPoints(name string, start, end, step int64) ([]interpol8.IntPoint, error) {
+	// gauge or counter?
+	kind := interpol8.Kind(interpol8.Absolute)
+	info, err := db.GetSensorInfo(name)
+	if err != nil && err != database.ErrNotFound {
+		return nil, err
+	}
+	if info.Rate {
+		kind = interpol8.Rate
+	}
+
+	// fetch the raw data, including one point on either side of the interval, note that the
+	// last data point produced covers end..end+step
+	rawValues, err := db.SensorReadRaw(name, start, end+step)
+	if err != nil {
+		return nil, err
+	}
+	raw := make([]interpol8.RawPoint, len(rawValues))
+	for i, v := range rawValues {
+		raw[i] = interpol8.RawPoint{Asof: uint64(v.At), Value: v.Value}
+	}
+
+	// interpolate, interpol8 treats end as exclusive
+	return interpol8.Raw(raw, kind, uint64(start), uint64(end+1), uint64(step),
+		uint64(fillFct*step))
 }
 
 // Params Requests
 
 func HandleParamPutRequest(req *gears.ParamPutRequest) gears.Reply {
-	return gears.Reply{Code: gears.CodeServerError, Error: "Not yet implemented"}
+	if req.Name == "" {
+		return gears.Reply{Code: gears.CodeClientError, Error: "param name is empty"}
+	}
+	err := db.PutParam(req.Name, req.Value)
+	if err != nil {
+		return gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+	}
+	return gears.Reply{Code: gears.CodeOK}
 }
 
 func HandleParamGetRequest(req *gears.ParamGetRequest) gears.Reply {
-	return gears.Reply{Code: gears.CodeServerError, Error: "Not yet implemented"}
+	value, err := db.GetParam(req.Name)
+	if err == database.ErrNotFound {
+		return gears.Reply{Code: gears.CodeClientError, Error: err.Error()}
+	} else if err != nil {
+		return gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+	}
+	return gears.Reply{Code: gears.CodeOK, PG: &gears.ParamReply{Value: value}}
+}
+
+func HandleParamListRequest(req *gears.ParamListRequest) gears.Reply {
+	params, err := db.ListParams(req.Prefix)
+	if err != nil {
+		return gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+	}
+	return gears.Reply{Code: gears.CodeOK, PL: &gears.ParamListReply{Params: params}}
+}
+
+func HandleParamDelRequest(req *gears.ParamDelRequest) gears.Reply {
+	// don't delete all params by accident
+	if req.Prefix == "" {
+		return gears.Reply{Code: gears.CodeClientError, Error: "param prefix is empty"}
+	}
+	n, err := db.DeleteParams(req.Prefix)
+	if err != nil {
+		return gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+	}
+	glog.Infof("Deleted %d params with prefix '%s'", n, req.Prefix)
+	return gears.Reply{Code: gears.CodeOK}
+}
+
+func HandleParamSubRequest(req *gears.ParamSubRequest) gears.Reply {
+	if req.Changes == nil {
+		return gears.Reply{Code: gears.CodeClientError, Error: "Changes channel is nil"}
+	}
+	c := db.ParamSubscribe(req.Prefix)
+	glog.Infof("Start param subscriber %v for '%s'", c, req.Prefix)
+
+	go func() {
+		defer req.Changes.Close()
+		for m := range c {
+			glog.V(2).Infof("Sending to %v: %+v", c, m)
+			err := req.Changes.Send(m)
+			if err != nil {
+				db.ParamUnsubscribe(c)
+				glog.Infof("Closing subscriber %v due to error: %s", c, err.Error())
+				for _ = range c {
+					// drain the channel so the sender doesn't block
+				}
+				return
+			}
+		}
+		glog.Infof("Closed subscriber %v due to incoming EOF", c)
+		return
+	}()
+	return gears.Reply{Code: gears.CodeOK}
 }
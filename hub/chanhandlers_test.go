@@ -0,0 +1,114 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+package main
+
+// Omega: Alt+937
+
+import (
+	"fmt"
+	"math"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tve/widuino/gears"
+	"github.com/tve/widuino/hub/database"
+)
+
+//===== tests =====
+
+var _ = Describe("Request handlers", func() {
+
+	var dbDir string
+
+	BeforeEach(func() {
+		dbDir = fmt.Sprintf("/tmp/db-h-%d", os.Getpid())
+		var err error
+		db, err = database.Open(dbDir) // db is global defined in main.go
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		db.Close()
+		os.RemoveAll(dbDir)
+	})
+
+	Describe("sensorRead", func() {
+		BeforeEach(func() {
+			// gauge ramping up by 1 per 100ms, counter incrementing by 10 per 100ms
+			for i := int64(0); i <= 20; i += 1 {
+				db.PutSensorValue("gauge", gears.SensorDataValue{At: 1000 + i*100, Value: float64(i)})
+				db.PutSensorValue("counter", gears.SensorDataValue{At: 1000 + i*100, Value: float64(i * 10)})
+			}
+			db.PutSensorInfo("counter", gears.SensorInfo{Unit: "Wh", Rate: true})
+		})
+
+		It("interpolates gauges", func() {
+			values, err := sensorRead("gauge", 1200, 1800, 200)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(values).Should(HaveLen(4))
+			for i, v := range values {
+				Ω(v.At).Should(Equal(int64(1200 + i*200)))
+				Ω(v.Value).Should(BeNumerically("~", float64(3+2*i)))
+			}
+		})
+
+		It("interpolates rates", func() {
+			values, err := sensorRead("counter", 1200, 1800, 200)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(values).Should(HaveLen(4))
+			for _, v := range values {
+				Ω(v.Value).Should(BeNumerically("~", 0.1)) // per millisecond
+			}
+		})
+
+		It("produces NaN where there is no data", func() {
+			values, err := sensorRead("gauge", 5000, 6000, 500)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(values).Should(HaveLen(3))
+			Ω(math.IsNaN(values[2].Value)).Should(BeTrue())
+		})
+	})
+
+	It("rolls back firmware", func() {
+		req := &gears.FwRollbackRequest{NodeType: 100}
+		Ω(HandleFwRollbackRequest(req).Code).Should(Equal(gears.CodeClientError))
+		fw, err := db.PutFirmware(gears.Firmware{NodeType: 100}, []byte{1})
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = db.ActivateFirmware(fw.SwId, 0, 0)
+		Ω(err).ShouldNot(HaveOccurred())
+		rep := HandleFwRollbackRequest(req)
+		Ω(rep.Code).Should(Equal(gears.CodeClientError))
+		Ω(rep.Error).Should(Equal(database.ErrNoRollback.Error()))
+
+		db.Close()
+		Ω(HandleFwRollbackRequest(req).Code).Should(Equal(gears.CodeServerError))
+	})
+
+	It("deletes params by prefix", func() {
+		Ω(db.PutParam("heat/attic", "70")).Should(Succeed())
+		rep := HandleParamDelRequest(&gears.ParamDelRequest{Prefix: ""})
+		Ω(rep.Code).Should(Equal(gears.CodeClientError))
+		Ω(db.GetParam("heat/attic")).Should(Equal("70"))
+		rep = HandleParamDelRequest(&gears.ParamDelRequest{Prefix: "heat/"})
+		Ω(rep.Code).Should(Equal(gears.CodeOK))
+		_, err := db.GetParam("heat/attic")
+		Ω(err).Should(Equal(database.ErrNotFound))
+	})
+
+	It("starts and ends rollouts", func() {
+		start := &gears.RolloutStartRequest{SwId: 1000, Group: 252, Canaries: []byte{6}}
+		Ω(HandleRolloutStartRequest(start).Code).Should(Equal(gears.CodeClientError))
+		end := &gears.RolloutEndRequest{NodeType: 100}
+		Ω(HandleRolloutEndRequest(end).Code).Should(Equal(gears.CodeClientError))
+		fw, err := db.PutFirmware(gears.Firmware{NodeType: 100}, []byte{1})
+		Ω(err).ShouldNot(HaveOccurred())
+		start.SwId = fw.SwId
+		Ω(HandleRolloutStartRequest(start).Code).Should(Equal(gears.CodeOK))
+		Ω(HandleRolloutEndRequest(end).Code).Should(Equal(gears.CodeOK))
+		Ω(HandleRolloutEndRequest(end).Code).Should(Equal(gears.CodeClientError))
+
+		db.Close()
+		Ω(HandleRolloutStartRequest(start).Code).Should(Equal(gears.CodeServerError))
+		Ω(HandleRolloutEndRequest(end).Code).Should(Equal(gears.CodeServerError))
+	})
+})
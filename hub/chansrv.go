@@ -57,8 +57,9 @@ func handleRequests(t *spdy.Transport) {
 	}
 }
 
-// handle one request, errors that are returned are deemed fatal and should cause the
-// connection to be closed
+// receive one request and handle it in its own goroutine so a slow request, e.g., an RF
+// send waiting for its ACK, doesn't hold up the ones that follow, errors that are returned
+// are deemed fatal and should cause the connection to be closed
 func handleRequest(receiver libchan.Receiver) error {
 	// receive a request
 	var req gears.Request
@@ -74,6 +75,12 @@ func handleRequest(receiver libchan.Receiver) error {
 		return fmt.Errorf("request is missing reply channel")
 	}
 
+	go serveRequest(req)
+	return nil
+}
+
+// serveRequest handles one request and sends the reply
+func serveRequest(req gears.Request) {
 	var rep gears.Reply
 	switch {
 	case req.ER != nil:
@@ -94,22 +101,71 @@ func handleRequest(receiver libchan.Receiver) error {
 		rep = HandleParamPutRequest(req.PP)
 	case req.PG != nil:
 		rep = HandleParamGetRequest(req.PG)
+	case req.PL != nil:
+		rep = HandleParamListRequest(req.PL)
+	case req.PD != nil:
+		rep = HandleParamDelRequest(req.PD)
+	case req.PS != nil:
+		rep = HandleParamSubRequest(req.PS)
+	case req.NG != nil:
+		rep = HandleNodeGetRequest(req.NG)
+	case req.NP != nil:
+		rep = HandleNodePutRequest(req.NP)
+	case req.NL != nil:
+		rep = HandleNodeListRequest(req.NL)
+	case req.ND != nil:
+		rep = HandleNodeDelRequest(req.ND)
+	case req.PRL != nil:
+		rep = HandlePairListRequest(req.PRL)
+	case req.PRA != nil:
+		rep = HandlePairAssignRequest(req.PRA)
+	case req.PRF != nil:
+		rep = HandlePairForgetRequest(req.PRF)
+	case req.FU != nil:
+		rep = HandleFwUploadRequest(req.FU)
+	case req.FL != nil:
+		rep = HandleFwListRequest(req.FL)
+	case req.FA != nil:
+		rep = HandleFwActivateRequest(req.FA)
+	case req.FR != nil:
+		rep = HandleFwRollbackRequest(req.FR)
+	case req.BS != nil:
+		rep = HandleBootStatusRequest(req.BS)
+	case req.GL != nil:
+		rep = HandleGatewayListRequest(req.GL)
+	case req.NSL != nil:
+		rep = HandleNodeStatusListRequest(req.NSL)
+	case req.NSS != nil:
+		rep = HandleNodeStatusSubRequest(req.NSS)
+	case req.ML != nil:
+		rep = HandleMailListRequest(req.ML)
+	case req.MS != nil:
+		rep = HandleMailSubRequest(req.MS)
+	case req.RS != nil:
+		rep = HandleRolloutStartRequest(req.RS)
+	case req.RL != nil:
+		rep = HandleRolloutListRequest(req.RL)
+	case req.RE != nil:
+		rep = HandleRolloutEndRequest(req.RE)
+	case req.UL != nil:
+		rep = HandleUpgradeListRequest(req.UL)
+	case req.US != nil:
+		rep = HandleUpgradeSubRequest(req.US)
 	default:
 		rep = gears.Reply{
 			Code:  gears.CodeClientError,
 			Error: fmt.Sprintf("unknown request: %+v", req),
 		}
 	}
-	err = req.Reply.Send(rep)
-	if err != nil {
-		return fmt.Errorf("cannot send reply: %s", err.Error())
+	if err := req.Reply.Send(rep); err != nil {
+		// the connection is likely gone, the request loop notices that and closes it
+		glog.Errorf("Cannot send reply: %s", err.Error())
+		return
 	}
 	if rep.Code != gears.CodeOK {
-		// we don't return an error 'cause this is not fatal and we don't
-		// want to close the connection (maybe we should for CodeServerError)
-		// but we can also leave that decision up to the client and thereby
-		// avoid killing pipelined incoming requests
+		// this is not fatal and we don't want to close the connection (maybe we
+		// should for CodeServerError) but we can also leave that decision up to
+		// the client and thereby avoid killing pipelined incoming requests
 		glog.Infof("Request handler error: %s", rep.Error)
 	}
-	return nil
 }
@@ -0,0 +1,155 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+package database
+
+import (
+	"fmt"
+
+	"github.com/tve/widuino/gears"
+)
+
+// ===== Firmware =====
+
+// The firmware repository holds versioned images for each node type. Each image gets a
+// software ID that is unique across node types because download requests only carry the
+// software ID. Software IDs start at FirstSwId so they can't be confused with the node types
+// (100..999) that serve as software IDs for the images listed in the boot config.
+
+const firmwarePrefix = "firmware" // firmware/<swId> -> gears.Firmware
+const fwImagePrefix = "fwimage"   // fwimage/<swId> -> image bytes
+const fwActivePrefix = "fwactive" // fwactive/<nodeType>[/<group>/<node>] -> activeFirmware
+const FirstSwId = 1000            // first software ID allocated to firmware images
+const maxFwHistory = 10           // number of previous versions remembered for rollback
+
+// ErrNoRollback is returned when rolling back a firmware that has no previous version
+var ErrNoRollback = fmt.Errorf("no previous firmware to roll back to")
+
+// activeFirmware points to the firmware a node type or a node should run and remembers the
+// previously active versions, most recent last
+type activeFirmware struct {
+	SwId uint16
+	Prev []uint16
+}
+
+// PutFirmware stores a new firmware image, allocating the next software ID
+func (db *DB) PutFirmware(fw gears.Firmware, image []byte) (gears.Firmware, error) {
+	db.firmwareMutex.Lock()
+	defer db.firmwareMutex.Unlock()
+
+	fw.SwId = FirstSwId
+	var last gears.Firmware
+	_, err := db.Last(firmwarePrefix+"/", "", &last)
+	if err == nil {
+		if last.SwId == 0xFFFF {
+			return fw, fmt.Errorf("out of software IDs")
+		}
+		fw.SwId = last.SwId + 1
+	} else if err != ErrNotFound {
+		return fw, err
+	}
+	fw.Size = len(image)
+	if err := db.Put(genFwImageKey(fw.SwId), image); err != nil {
+		return fw, err
+	}
+	return fw, db.Put(genFirmwareKey(fw.SwId), fw)
+}
+
+func (db *DB) GetFirmware(swId uint16) (gears.Firmware, error) {
+	var fw gears.Firmware
+	err := db.Get(genFirmwareKey(swId), &fw)
+	return fw, err
+}
+
+func (db *DB) GetFirmwareImage(swId uint16) ([]byte, error) {
+	var image []byte
+	err := db.Get(genFwImageKey(swId), &image)
+	return image, err
+}
+
+// ListFirmware returns the firmware for a node type, or for all node types if nodeType is
+// zero, sorted by software ID
+func (db *DB) ListFirmware(nodeType uint16) ([]gears.Firmware, error) {
+	list := make([]gears.Firmware, 0)
+	var fw gears.Firmware
+	err := db.Iterate(firmwarePrefix+"/", "", &fw, func(key string) error {
+		if nodeType == 0 || fw.NodeType == nodeType {
+			list = append(list, fw)
+		}
+		return nil
+	})
+	return list, err
+}
+
+// ActiveFirmware returns the software ID activated for a node or, if node is zero, for its
+// node type. Returns ErrNotFound if there is none.
+func (db *DB) ActiveFirmware(nodeType uint16, group, node byte) (uint16, error) {
+	var act activeFirmware
+	err := db.Get(genFwActiveKey(nodeType, group, node), &act)
+	return act.SwId, err
+}
+
+// ActivateFirmware makes a firmware image the one to run for all nodes of its node type, if
+// node is zero, or for the one node. The previously active version is remembered for rollback.
+func (db *DB) ActivateFirmware(swId uint16, group, node byte) (gears.Firmware, error) {
+	fw, err := db.GetFirmware(swId)
+	if err != nil {
+		return fw, err
+	}
+	db.firmwareMutex.Lock()
+	defer db.firmwareMutex.Unlock()
+
+	key := genFwActiveKey(fw.NodeType, group, node)
+	var act activeFirmware
+	if err := db.Get(key, &act); err != nil && err != ErrNotFound {
+		return fw, err
+	}
+	if act.SwId == swId {
+		return fw, nil
+	}
+	if act.SwId != 0 {
+		act.Prev = append(act.Prev, act.SwId)
+		if len(act.Prev) > maxFwHistory {
+			act.Prev = act.Prev[len(act.Prev)-maxFwHistory:]
+		}
+	}
+	act.SwId = swId
+	return fw, db.Put(key, act)
+}
+
+// RollbackFirmware re-activates the previously active firmware of a node type, if node is
+// zero, or of the one node, and returns it
+func (db *DB) RollbackFirmware(nodeType uint16, group, node byte) (gears.Firmware, error) {
+	db.firmwareMutex.Lock()
+	defer db.firmwareMutex.Unlock()
+
+	key := genFwActiveKey(nodeType, group, node)
+	var act activeFirmware
+	if err := db.Get(key, &act); err != nil {
+		return gears.Firmware{}, err
+	}
+	if len(act.Prev) == 0 {
+		return gears.Firmware{}, ErrNoRollback
+	}
+	act.SwId = act.Prev[len(act.Prev)-1]
+	act.Prev = act.Prev[:len(act.Prev)-1]
+	fw, err := db.GetFirmware(act.SwId)
+	if err != nil {
+		return fw, err
+	}
+	return fw, db.Put(key, act)
+}
+
+func genFirmwareKey(swId uint16) string {
+	return fmt.Sprintf("%s/%05d", firmwarePrefix, swId)
+}
+
+func genFwImageKey(swId uint16) string {
+	return fmt.Sprintf("%s/%05d", fwImagePrefix, swId)
+}
+
+func genFwActiveKey(nodeType uint16, group, node byte) string {
+	if node == 0 {
+		return fmt.Sprintf("%s/%05d", fwActivePrefix, nodeType)
+	}
+	return fmt.Sprintf("%s/%05d/%03d/%02d", fwActivePrefix, nodeType, group, node)
+}
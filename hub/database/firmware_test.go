@@ -0,0 +1,93 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+package database
+
+// Omega: Alt+937
+
+import (
+	"fmt"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tve/widuino/gears"
+)
+
+//===== tests =====
+
+var _ = Describe("Database Firmware", func() {
+
+	var dir string
+	var db *DB
+
+	BeforeEach(func() {
+		dir = fmt.Sprintf("/tmp/db-%d", os.Getpid())
+		var err error
+		db, err = Open(dir)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		db.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("stores versioned firmware", func() {
+		fw1, err := db.PutFirmware(gears.Firmware{NodeType: 100, Name: "a.hex", Crc: 1},
+			[]byte{1, 2, 3})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(fw1.SwId).Should(Equal(uint16(FirstSwId)))
+		Ω(fw1.Size).Should(Equal(3))
+		fw2, err := db.PutFirmware(gears.Firmware{NodeType: 101}, []byte{4})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(fw2.SwId).Should(Equal(uint16(FirstSwId + 1)))
+
+		fw, err := db.GetFirmware(fw1.SwId)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(fw).Should(Equal(fw1))
+		image, err := db.GetFirmwareImage(fw1.SwId)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(image).Should(Equal([]byte{1, 2, 3}))
+
+		list, err := db.ListFirmware(101)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(list).Should(Equal([]gears.Firmware{fw2}))
+		list, err = db.ListFirmware(0)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(list).Should(HaveLen(2))
+	})
+
+	It("activates and rolls back firmware", func() {
+		var sw [3]uint16
+		for i := range sw {
+			fw, err := db.PutFirmware(gears.Firmware{NodeType: 100}, []byte{byte(i)})
+			Ω(err).ShouldNot(HaveOccurred())
+			sw[i] = fw.SwId
+		}
+		_, err := db.ActiveFirmware(100, 2, 3)
+		Ω(err).Should(MatchError(ErrNotFound))
+
+		for _, s := range sw[:2] {
+			_, err = db.ActivateFirmware(s, 0, 0)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+		_, err = db.ActivateFirmware(sw[2], 2, 3)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(db.ActiveFirmware(100, 2, 3)).Should(Equal(sw[2]))
+		Ω(db.ActiveFirmware(100, 0, 0)).Should(Equal(sw[1]))
+		_, err = db.ActiveFirmware(100, 2, 4)
+		Ω(err).Should(MatchError(ErrNotFound))
+
+		fw, err := db.RollbackFirmware(100, 0, 0)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(fw.SwId).Should(Equal(sw[0]))
+		Ω(db.ActiveFirmware(100, 0, 0)).Should(Equal(sw[0]))
+		_, err = db.RollbackFirmware(100, 0, 0)
+		Ω(err).Should(MatchError(ErrNoRollback))
+		_, err = db.RollbackFirmware(100, 2, 3)
+		Ω(err).Should(MatchError(ErrNoRollback))
+
+		_, err = db.ActivateFirmware(FirstSwId+10, 0, 0)
+		Ω(err).Should(MatchError(ErrNotFound))
+	})
+})
@@ -0,0 +1,46 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+package database
+
+import (
+	"fmt"
+
+	"github.com/tve/widuino/gears"
+)
+
+// ===== NodeInfo =====
+
+const nodeInfoPrefix = "nodeinfo"
+
+func (db *DB) PutNodeInfo(m gears.NodeInfo) error {
+	key := genNodeInfoKey(m.Group, m.Node)
+	return db.Put(key, m)
+}
+
+func (db *DB) GetNodeInfo(group, node byte) (gears.NodeInfo, error) {
+	key := genNodeInfoKey(group, node)
+	var m gears.NodeInfo
+	err := db.Get(key, &m)
+	return m, err
+}
+
+func (db *DB) DeleteNodeInfo(group, node byte) error {
+	key := genNodeInfoKey(group, node)
+	return db.Put(key, nil)
+}
+
+// ListNodeInfo returns the info of all nodes sorted by group and node
+func (db *DB) ListNodeInfo() ([]gears.NodeInfo, error) {
+	nodes := make([]gears.NodeInfo, 0)
+	var m gears.NodeInfo
+	err := db.Iterate(nodeInfoPrefix+"/", "", &m, func(key string) error {
+		nodes = append(nodes, m)
+		m = gears.NodeInfo{} // don't reuse the Sensors map
+		return nil
+	})
+	return nodes, err
+}
+
+func genNodeInfoKey(group, node byte) string {
+	return fmt.Sprintf("%s/%03d/%02d", nodeInfoPrefix, group, node)
+}
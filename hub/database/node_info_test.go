@@ -0,0 +1,65 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+package database
+
+// Omega: Alt+937
+
+import (
+	"fmt"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tve/widuino/gears"
+)
+
+//===== tests =====
+
+var _ = Describe("Database NodeInfo", func() {
+
+	var dir string
+	var db *DB
+
+	BeforeEach(func() {
+		dir = fmt.Sprintf("/tmp/db-%d", os.Getpid())
+		var err error
+		db, err = Open(dir)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		db.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("stores node info", func() {
+		ni := gears.NodeInfo{Group: 2, Node: 3, Sketch: "heating", Location: "basement",
+			Sensors: map[string]gears.NodeSensor{"temp3": {Name: "boiler_out"}}}
+		Ω(db.PutNodeInfo(ni)).Should(Succeed())
+
+		m, err := db.GetNodeInfo(2, 3)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(m).Should(Equal(ni))
+
+		_, err = db.GetNodeInfo(2, 4)
+		Ω(err).Should(MatchError(ErrNotFound))
+
+		Ω(db.DeleteNodeInfo(2, 3)).Should(Succeed())
+		_, err = db.GetNodeInfo(2, 3)
+		Ω(err).Should(MatchError(ErrNotFound))
+	})
+
+	It("lists node info in order", func() {
+		for _, n := range []byte{20, 3, 11} {
+			Ω(db.PutNodeInfo(gears.NodeInfo{Group: 2, Node: n})).Should(Succeed())
+		}
+		Ω(db.PutNodeInfo(gears.NodeInfo{Group: 1, Node: 30})).Should(Succeed())
+
+		nodes, err := db.ListNodeInfo()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(nodes).Should(HaveLen(4))
+		Ω(nodes[0].Group).Should(Equal(byte(1)))
+		Ω(nodes[1].Node).Should(Equal(byte(3)))
+		Ω(nodes[3].Node).Should(Equal(byte(20)))
+	})
+})
@@ -0,0 +1,77 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+package database
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/tve/widuino/gears"
+)
+
+// ===== Node status =====
+
+// The liveness of each node is kept so it survives hub restarts, subscribers get the status
+// of a node each time it goes online or offline
+
+const nodeStatusPrefix = "nodestatus"
+
+func (db *DB) PutNodeStatus(s gears.NodeStatus) error {
+	return db.Put(genNodeStatusKey(s.Group, s.Node), s)
+}
+
+// ListNodeStatus returns the status of all nodes sorted by group and node
+func (db *DB) ListNodeStatus() ([]gears.NodeStatus, error) {
+	statuses := make([]gears.NodeStatus, 0)
+	var s gears.NodeStatus
+	err := db.Iterate(nodeStatusPrefix+"/", "", &s, func(key string) error {
+		statuses = append(statuses, s)
+		return nil
+	})
+	return statuses, err
+}
+
+func genNodeStatusKey(group, node byte) string {
+	return fmt.Sprintf("%s/%03d/%02d", nodeStatusPrefix, group, node)
+}
+
+// Subscribe to the online/offline transitions of a node, or of all nodes if node is zero,
+// returns a channel to read the node status from.
+func (db *DB) NodeStatusSubscribe(group, node byte) chan gears.NodeStatus {
+	db.nodeStatusSubscriberMutex.Lock()
+	defer db.nodeStatusSubscriberMutex.Unlock()
+	c := make(chan gears.NodeStatus, 100)
+	db.nodeStatusSubscribers = append(db.nodeStatusSubscribers, c)
+	db.nodeStatusSubscriberNode = append(db.nodeStatusSubscriberNode, [2]byte{group, node})
+	return c
+}
+
+// Unsubscribe the given channel from node status transitions, this closes the channel.
+func (db *DB) NodeStatusUnsubscribe(c chan gears.NodeStatus) {
+	db.nodeStatusSubscriberMutex.Lock()
+	defer db.nodeStatusSubscriberMutex.Unlock()
+	for i := 0; i < len(db.nodeStatusSubscribers); i += 1 {
+		if db.nodeStatusSubscribers[i] != c {
+			continue
+		}
+		close(db.nodeStatusSubscribers[i])
+		db.nodeStatusSubscribers = append(db.nodeStatusSubscribers[0:i],
+			db.nodeStatusSubscribers[i+1:]...)
+		db.nodeStatusSubscriberNode = append(db.nodeStatusSubscriberNode[0:i],
+			db.nodeStatusSubscriberNode[i+1:]...)
+		return
+	}
+}
+
+// Forward a node going online or offline to all subscribers for the node.
+func (db *DB) NodeStatusPublish(s gears.NodeStatus) {
+	db.nodeStatusSubscriberMutex.Lock()
+	defer db.nodeStatusSubscriberMutex.Unlock()
+	for i, n := range db.nodeStatusSubscriberNode {
+		if n[1] == 0 || n == [2]byte{s.Group, s.Node} {
+			db.nodeStatusSubscribers[i] <- s
+		}
+	}
+	glog.V(2).Infof("Published: RFg%03di%02d online=%v to %d nodeStatusSubscribers",
+		s.Group, s.Node, s.Online, len(db.nodeStatusSubscribers))
+}
@@ -0,0 +1,61 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+package database
+
+// Omega: Alt+937
+
+import (
+	"fmt"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tve/widuino/gears"
+)
+
+//===== tests =====
+
+var _ = Describe("Database NodeStatus", func() {
+
+	var dir string
+	var db *DB
+
+	BeforeEach(func() {
+		dir = fmt.Sprintf("/tmp/db-%d", os.Getpid())
+		var err error
+		db, err = Open(dir)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		db.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("stores and lists the status of nodes", func() {
+		s := gears.NodeStatus{Group: 2, Node: 3, Online: true, Packets: 1}
+		Ω(db.PutNodeStatus(s)).Should(Succeed())
+		s.Packets = 2
+		Ω(db.PutNodeStatus(s)).Should(Succeed())
+		Ω(db.PutNodeStatus(gears.NodeStatus{Group: 1, Node: 4})).Should(Succeed())
+
+		statuses, err := db.ListNodeStatus()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(statuses).Should(HaveLen(2))
+		Ω(statuses[0].Group).Should(Equal(byte(1)))
+		Ω(statuses[1]).Should(Equal(s))
+	})
+
+	It("publishes transitions to subscribers", func() {
+		all := db.NodeStatusSubscribe(0, 0)
+		one := db.NodeStatusSubscribe(2, 4)
+		db.NodeStatusPublish(gears.NodeStatus{Group: 2, Node: 3})
+		db.NodeStatusPublish(gears.NodeStatus{Group: 2, Node: 4, Online: true})
+		Ω(all).Should(HaveLen(2))
+		Ω(one).Should(HaveLen(1))
+		Ω((<-one).Online).Should(BeTrue())
+		db.NodeStatusUnsubscribe(all)
+		db.NodeStatusUnsubscribe(one)
+		Ω(one).Should(BeClosed())
+	})
+})
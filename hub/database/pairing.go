@@ -0,0 +1,108 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+package database
+
+import (
+	"fmt"
+
+	"github.com/tve/widuino/gears"
+)
+
+// ===== Pairing =====
+
+const pairingPrefix = "pairing"
+
+// Range of node IDs handed out to nodes, 0 is broadcast and 31 is the gateway
+const (
+	FirstNodeId = 1
+	LastNodeId  = 30
+)
+
+func (db *DB) GetPairing(hwId string) (gears.Pairing, error) {
+	key := genPairingKey(hwId)
+	var p gears.Pairing
+	err := db.Get(key, &p)
+	return p, err
+}
+
+func (db *DB) DeletePairing(hwId string) error {
+	key := genPairingKey(hwId)
+	return db.Put(key, nil)
+}
+
+// ListPairings returns all pairings sorted by hardware ID
+func (db *DB) ListPairings() ([]gears.Pairing, error) {
+	pairings := make([]gears.Pairing, 0)
+	var p gears.Pairing
+	err := db.Iterate(pairingPrefix+"/", "", &p, func(key string) error {
+		pairings = append(pairings, p)
+		return nil
+	})
+	return pairings, err
+}
+
+// PutPairing stores a pairing, replacing any previous pairing of the same hardware ID. If
+// p.Node is zero it allocates the lowest node ID in the group that is not paired with
+// another hardware ID, not in the node map, and not in reserved. It fails if the node ID
+// is paired with another hardware ID. Returns the pairing as stored.
+func (db *DB) PutPairing(p gears.Pairing, reserved []byte) (gears.Pairing, error) {
+	if p.HwId == "" {
+		return p, fmt.Errorf("pairing has no hardware ID")
+	}
+	if p.Node != 0 && (p.Node < FirstNodeId || p.Node > LastNodeId) {
+		return p, fmt.Errorf("node ID must be %d..%d", FirstNodeId, LastNodeId)
+	}
+
+	// serialize allocations so two nodes can't grab the same free ID
+	db.pairingMutex.Lock()
+	defer db.pairingMutex.Unlock()
+
+	pairings, err := db.ListPairings()
+	if err != nil {
+		return p, err
+	}
+	var used [LastNodeId + 1]bool
+	for _, q := range pairings {
+		if q.Group != p.Group || q.HwId == p.HwId {
+			continue
+		}
+		if q.Node == p.Node {
+			return p, fmt.Errorf("RFg%03di%02d is already paired with %s",
+				p.Group, p.Node, q.HwId)
+		}
+		if q.Node <= LastNodeId {
+			used[q.Node] = true
+		}
+	}
+
+	if p.Node == 0 {
+		nodes, err := db.ListNodeInfo()
+		if err != nil {
+			return p, err
+		}
+		for _, ni := range nodes {
+			if ni.Group == p.Group && ni.Node <= LastNodeId {
+				used[ni.Node] = true
+			}
+		}
+		for _, n := range reserved {
+			if n <= LastNodeId {
+				used[n] = true
+			}
+		}
+		for n := FirstNodeId; n <= LastNodeId && p.Node == 0; n++ {
+			if !used[n] {
+				p.Node = byte(n)
+			}
+		}
+		if p.Node == 0 {
+			return p, fmt.Errorf("no free node ID in group %d", p.Group)
+		}
+	}
+
+	return p, db.Put(genPairingKey(p.HwId), p)
+}
+
+func genPairingKey(hwId string) string {
+	return fmt.Sprintf("%s/%s", pairingPrefix, hwId)
+}
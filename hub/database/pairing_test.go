@@ -0,0 +1,92 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+package database
+
+// Omega: Alt+937
+
+import (
+	"fmt"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tve/widuino/gears"
+)
+
+//===== tests =====
+
+var _ = Describe("Database Pairing", func() {
+
+	var dir string
+	var db *DB
+
+	BeforeEach(func() {
+		dir = fmt.Sprintf("/tmp/db-%d", os.Getpid())
+		var err error
+		db, err = Open(dir)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		db.Close()
+		os.RemoveAll(dir)
+	})
+
+	hwId := func(i int) string { return fmt.Sprintf("%032x", i) }
+
+	It("stores pairings", func() {
+		p, err := db.PutPairing(gears.Pairing{HwId: hwId(1), NodeType: 100, Group: 2, Node: 5,
+			ShKey: [16]byte{1, 2, 3}}, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(p.Node).Should(Equal(byte(5)))
+
+		q, err := db.GetPairing(hwId(1))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(q).Should(Equal(p))
+
+		Ω(db.DeletePairing(hwId(1))).Should(Succeed())
+		_, err = db.GetPairing(hwId(1))
+		Ω(err).Should(MatchError(ErrNotFound))
+	})
+
+	It("allocates free node IDs", func() {
+		Ω(db.PutNodeInfo(gears.NodeInfo{Group: 2, Node: 2})).Should(Succeed())
+		_, err := db.PutPairing(gears.Pairing{HwId: hwId(1), Group: 2, Node: 1}, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = db.PutPairing(gears.Pairing{HwId: hwId(2), Group: 3, Node: 4}, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		p, err := db.PutPairing(gears.Pairing{HwId: hwId(3), Group: 2}, []byte{3})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(p.Node).Should(Equal(byte(4)))
+		p, err = db.PutPairing(gears.Pairing{HwId: hwId(4), Group: 2}, []byte{3})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(p.Node).Should(Equal(byte(5)))
+
+		pairings, err := db.ListPairings()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pairings).Should(HaveLen(4))
+		Ω(pairings[3].HwId).Should(Equal(hwId(4)))
+	})
+
+	It("runs out of node IDs", func() {
+		for i := FirstNodeId; i <= LastNodeId; i++ {
+			_, err := db.PutPairing(gears.Pairing{HwId: hwId(i), Group: 2}, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+		_, err := db.PutPairing(gears.Pairing{HwId: hwId(99), Group: 2}, nil)
+		Ω(err).Should(MatchError("no free node ID in group 2"))
+	})
+
+	It("rejects duplicate node IDs", func() {
+		_, err := db.PutPairing(gears.Pairing{HwId: hwId(1), Group: 2, Node: 7}, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = db.PutPairing(gears.Pairing{HwId: hwId(2), Group: 2, Node: 7}, nil)
+		Ω(err).Should(HaveOccurred())
+		// re-pairing the same hwId is fine
+		_, err = db.PutPairing(gears.Pairing{HwId: hwId(1), Group: 2, Node: 7}, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = db.PutPairing(gears.Pairing{HwId: hwId(3), Group: 2, Node: 31}, nil)
+		Ω(err).Should(HaveOccurred())
+	})
+})
@@ -0,0 +1,110 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+package database
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/tve/widuino/gears"
+)
+
+// ===== Params =====
+
+// Params are arbitrary name-value strings that clients store in the hub, such as setpoints
+// and node configuration. Names are hierarchical, e.g. "heating/basement/setpoint", so they
+// can be listed and deleted by prefix.
+
+const paramPrefix = "param"
+
+func (db *DB) PutParam(name, value string) error {
+	err := db.Put(genParamKey(name), value)
+	if err != nil {
+		return err
+	}
+	db.ParamPublish(gears.ParamChange{Name: name, Value: value})
+	return nil
+}
+
+func (db *DB) GetParam(name string) (string, error) {
+	var value string
+	err := db.Get(genParamKey(name), &value)
+	return value, err
+}
+
+// ListParams returns all params whose name starts with prefix
+func (db *DB) ListParams(prefix string) (map[string]string, error) {
+	params := make(map[string]string)
+	var value string
+	err := db.Iterate(genParamKey(prefix), "", &value, func(key string) error {
+		params[parseParamKey(key)] = value
+		return nil
+	})
+	return params, err
+}
+
+// DeleteParams deletes all params whose name starts with prefix and returns the number deleted
+func (db *DB) DeleteParams(prefix string) (int, error) {
+	params, err := db.ListParams(prefix)
+	if err != nil {
+		return 0, err
+	}
+	for name := range params {
+		err := db.Put(genParamKey(name), nil)
+		if err != nil {
+			return 0, err
+		}
+		db.ParamPublish(gears.ParamChange{Name: name, Deleted: true})
+	}
+	return len(params), nil
+}
+
+func genParamKey(name string) string {
+	return fmt.Sprintf("%s/%s", paramPrefix, name)
+}
+
+func parseParamKey(key string) (name string) {
+	return strings.TrimPrefix(key, paramPrefix+"/")
+}
+
+// ===== Param change subscriptions =====
+
+// Subscribe to changes of params whose name starts with prefix, returns a channel to read
+// changes from.
+func (db *DB) ParamSubscribe(prefix string) chan gears.ParamChange {
+	db.paramSubscriberMutex.Lock()
+	defer db.paramSubscriberMutex.Unlock()
+	c := make(chan gears.ParamChange, 100)
+	db.paramSubscribers = append(db.paramSubscribers, c)
+	db.paramSubscriberPrefix = append(db.paramSubscriberPrefix, prefix)
+	return c
+}
+
+// Unsubscribe the given channel from param changes, this closes the channel.
+func (db *DB) ParamUnsubscribe(c chan gears.ParamChange) {
+	db.paramSubscriberMutex.Lock()
+	defer db.paramSubscriberMutex.Unlock()
+	for i := 0; i < len(db.paramSubscribers); i += 1 {
+		if db.paramSubscribers[i] != c {
+			continue
+		}
+		close(db.paramSubscribers[i])
+		db.paramSubscribers = append(db.paramSubscribers[0:i], db.paramSubscribers[i+1:]...)
+		db.paramSubscriberPrefix = append(db.paramSubscriberPrefix[0:i],
+			db.paramSubscriberPrefix[i+1:]...)
+		return
+	}
+}
+
+// Forward a param change to all subscribers whose prefix matches.
+func (db *DB) ParamPublish(m gears.ParamChange) {
+	db.paramSubscriberMutex.Lock()
+	defer db.paramSubscriberMutex.Unlock()
+	for i := range db.paramSubscribers {
+		if strings.HasPrefix(m.Name, db.paramSubscriberPrefix[i]) {
+			db.paramSubscribers[i] <- m
+		}
+	}
+	glog.V(2).Infof("Published: %s to %d paramSubscribers", m.Name, len(db.paramSubscribers))
+}
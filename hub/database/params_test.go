@@ -0,0 +1,86 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+package database
+
+// Omega: Alt+937
+
+import (
+	"fmt"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tve/widuino/gears"
+)
+
+//===== tests =====
+
+var _ = Describe("Database Params", func() {
+
+	var dir string
+	var db *DB
+
+	BeforeEach(func() {
+		dir = fmt.Sprintf("/tmp/db-%d", os.Getpid())
+		var err error
+		db, err = Open(dir)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(db.PutParam("heat/basement/setpoint", "68")).Should(Succeed())
+		Ω(db.PutParam("heat/basement/mode", "auto")).Should(Succeed())
+		Ω(db.PutParam("heat/attic/setpoint", "55")).Should(Succeed())
+		Ω(db.PutParam("water/alarm", "5.2")).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		db.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("gets params", func() {
+		v, err := db.GetParam("heat/basement/setpoint")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(v).Should(Equal("68"))
+
+		_, err = db.GetParam("heat/basement")
+		Ω(err).Should(MatchError(ErrNotFound))
+	})
+
+	It("lists params by prefix", func() {
+		params, err := db.ListParams("heat/basement/")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(params).Should(Equal(map[string]string{
+			"heat/basement/setpoint": "68",
+			"heat/basement/mode":     "auto",
+		}))
+
+		params, err = db.ListParams("")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(params).Should(HaveLen(4))
+	})
+
+	It("deletes params by prefix", func() {
+		n, err := db.DeleteParams("heat/")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(n).Should(Equal(3))
+
+		params, err := db.ListParams("")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(params).Should(Equal(map[string]string{"water/alarm": "5.2"}))
+	})
+
+	It("notifies subscribers of changes", func() {
+		c := db.ParamSubscribe("heat/")
+		Ω(db.PutParam("water/alarm", "6")).Should(Succeed())
+		Ω(db.PutParam("heat/attic/setpoint", "58")).Should(Succeed())
+		_, err := db.DeleteParams("heat/attic/")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(<-c).Should(Equal(gears.ParamChange{Name: "heat/attic/setpoint", Value: "58"}))
+		Ω(<-c).Should(Equal(gears.ParamChange{Name: "heat/attic/setpoint", Deleted: true}))
+		Consistently(c).ShouldNot(Receive())
+
+		db.ParamUnsubscribe(c)
+		Ω(c).Should(BeClosed())
+	})
+})
@@ -12,9 +12,11 @@ import (
 // and factoring out the inner portions of the logic so the outer structure can be shared
 // makes it all but unreadable.
 
-func (db *DB) RFSubscribe(start int64) chan gears.RFMessage {
+// Subscribe to RF messages that satisfy match starting at the timestamp given by start in
+// milliseconds since the epoch, returns a channel to read messages from.
+func (db *DB) RFSubscribe(start int64, match gears.RFMatch) chan gears.RFMessage {
 	c := make(chan gears.RFMessage, 100)
-	go db.catchUpRFSubscribe(start, c)
+	go db.catchUpRFSubscribe(start, match, c)
 	return c
 }
 
@@ -29,9 +31,11 @@ func (db *DB) RFUnsubscribe(c chan gears.RFMessage) {
 		if i+1 == len(db.rfSubscribers) {
 			db.rfSubscribers = db.rfSubscribers[0:i]
 			db.rfSubscriberStart = db.rfSubscriberStart[0:i]
+			db.rfSubscriberMatch = db.rfSubscriberMatch[0:i]
 		} else {
 			db.rfSubscribers = append(db.rfSubscribers[0:i], db.rfSubscribers[i+1:]...)
 			db.rfSubscriberStart = append(db.rfSubscriberStart[0:i], db.rfSubscriberStart[i+1:]...)
+			db.rfSubscriberMatch = append(db.rfSubscriberMatch[0:i], db.rfSubscriberMatch[i+1:]...)
 		}
 	}
 	if len(db.rfSubscribers) != len(db.rfSubscriberStart) {
@@ -44,7 +48,7 @@ func (db *DB) RFPublish(m gears.RFMessage) {
 	db.rfSubscriberMutex.Lock()
 	defer db.rfSubscriberMutex.Unlock()
 	for i := range db.rfSubscribers {
-		if m.At >= db.rfSubscriberStart[i] {
+		if m.At >= db.rfSubscriberStart[i] && db.rfSubscriberMatch[i].Matches(m) {
 			db.rfSubscribers[i] <- m
 		}
 	}
@@ -53,7 +57,7 @@ func (db *DB) RFPublish(m gears.RFMessage) {
 
 // catch-up on old messages from the database and then switch atomically into
 // a subscription
-func (db *DB) catchUpRFSubscribe(start int64, c chan gears.RFMessage) {
+func (db *DB) catchUpRFSubscribe(start int64, match gears.RFMatch, c chan gears.RFMessage) {
 
 	// replay messages from the database while holding the subscribers lock to
 	// prevent anything from being published. Use non-blocking channel send
@@ -68,8 +72,11 @@ func (db *DB) catchUpRFSubscribe(start int64, c chan gears.RFMessage) {
 		locked := true
 		count := 0
 		db.RFIterate(start, 0, func(m gears.RFMessage) error {
-			count += 1
 			lastAt = m.At
+			if !match.Matches(m) {
+				return nil
+			}
+			count += 1
 			//glog.V(2).Infof("Sending m=%x d=%x", &m, &(m.Data))
 			select {
 			case c <- m:
@@ -101,6 +108,7 @@ func (db *DB) catchUpRFSubscribe(start int64, c chan gears.RFMessage) {
 			defer db.rfSubscriberMutex.Unlock()
 			db.rfSubscribers = append(db.rfSubscribers, c)
 			db.rfSubscriberStart = append(db.rfSubscriberStart, lastAt+1)
+			db.rfSubscriberMatch = append(db.rfSubscriberMatch, match)
 			if len(db.rfSubscribers) != len(db.rfSubscriberStart) {
 				glog.Fatalf("rfSubscriber array mismatch %d != %d",
 					len(db.rfSubscribers), len(db.rfSubscriberStart))
@@ -11,6 +11,7 @@ import (
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/tve/widuino/gears"
 )
 
 //===== tests =====
@@ -35,20 +36,20 @@ var _ = Describe("Database Subscribe", func() {
 	It("functions correctly", func() {
 		now := time.Now().Unix()
 		for i := 0; i < 150; i += 1 {
-			m := RFMessage{At: now + int64(i), Group: byte(2 * i),
+			m := gears.RFMessage{At: now + int64(i), Group: byte(2 * i),
 				Node: 13, Data: []byte(fmt.Sprintf("Hello %d", i))}
 			err := db.PutRFMessage(m)
 			Ω(err).ShouldNot(HaveOccurred())
 		}
 
 		cnt := 0
-		c := db.Subscribe(now + 4)
+		c := db.RFSubscribe(now+4, gears.RFMatch{})
 		go func() {
 			for _ = range c {
 				cnt += 1
 				//fmt.Printf("Subscriber got %d=%d\n", m.At, m.At-now)
 				if cnt >= 2 && cnt <= 4 {
-					m1 := RFMessage{At: now + int64(1000+cnt)}
+					m1 := gears.RFMessage{At: now + int64(1000+cnt)}
 					err := db.PutRFMessage(m1)
 					Ω(err).ShouldNot(HaveOccurred())
 				}
@@ -57,18 +58,18 @@ var _ = Describe("Database Subscribe", func() {
 
 		time.Sleep(time.Millisecond)
 		for i := 1020; i < 1025; i += 1 {
-			m := RFMessage{At: now + int64(i), Group: byte(2 * i),
+			m := gears.RFMessage{At: now + int64(i), Group: byte(2 * i),
 				Node: 13, Data: []byte(fmt.Sprintf("Hello %d", i))}
 			err := db.PutRFMessage(m)
 			Ω(err).ShouldNot(HaveOccurred())
 		}
 
 		time.Sleep(time.Millisecond)
-		db.Unsubscribe(c)
+		db.RFUnsubscribe(c)
 		time.Sleep(time.Millisecond)
 
 		for i := 1030; i < 1035; i += 1 {
-			m := RFMessage{At: now + int64(i), Group: byte(2 * i),
+			m := gears.RFMessage{At: now + int64(i), Group: byte(2 * i),
 				Node: 13, Data: []byte(fmt.Sprintf("Hello %d", i))}
 			err := db.PutRFMessage(m)
 			Ω(err).ShouldNot(HaveOccurred())
@@ -77,4 +78,32 @@ var _ = Describe("Database Subscribe", func() {
 		Eventually(func() int { return cnt }).Should(Equal(150 - 4 + 3 + 5))
 	})
 
+	It("filters messages", func() {
+		now := time.Now().Unix()
+		for i := 0; i < 30; i += 1 {
+			m := gears.RFMessage{At: now + int64(i), Group: 5, Node: byte(i % 10),
+				Kind: byte(i % 3)}
+			err := db.PutRFMessage(m)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+
+		match := gears.RFMatch{Nodes: gears.RFRange(2, 4), Kinds: []byte{1}}
+		c := db.RFSubscribe(now+5, match)
+		for i := 30; i < 60; i += 1 {
+			m := gears.RFMessage{At: now + int64(i), Group: 5, Node: byte(i % 10),
+				Kind: byte(i % 3)}
+			err := db.PutRFMessage(m)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+
+		// i in 5..59 with node 2..4 and kind 1: 13, 22, 34, 43, 52
+		for _, i := range []int64{13, 22, 34, 43, 52} {
+			var m gears.RFMessage
+			Eventually(c).Should(Receive(&m))
+			Ω(m.At).Should(Equal(now + i))
+		}
+		Consistently(c).ShouldNot(Receive())
+		db.RFUnsubscribe(c)
+	})
+
 })
@@ -11,6 +11,7 @@ import (
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/tve/widuino/gears"
 )
 
 //===== tests =====
@@ -41,14 +42,14 @@ var _ = Describe("Database RFMessage", func() {
 	It("iterates", func() {
 		now := time.Now().Unix()
 		for i := 0; i < 20; i += 1 {
-			m := RFMessage{At: now + int64(i), Group: byte(2 * i),
+			m := gears.RFMessage{At: now + int64(i), Group: byte(2 * i),
 				Node: 13, Data: []byte(fmt.Sprintf("Hello %d", i))}
 			err := db.PutRFMessage(m)
 			Ω(err).ShouldNot(HaveOccurred())
 		}
 
 		cnt := 0
-		err := db.RFIterate(now+3, now+16, func(m RFMessage) error {
+		err := db.RFIterate(now+3, now+16, func(m gears.RFMessage) error {
 			Ω(m.At).Should(Equal(now + int64(cnt+3)))
 			Ω(m.Group).Should(Equal(byte(2 * (cnt + 3))))
 			Ω(m.Node).Should(Equal(byte(13)))
@@ -60,20 +61,44 @@ var _ = Describe("Database RFMessage", func() {
 		Ω(cnt).Should(Equal(13))
 	})
 
+	It("keeps the reception metadata", func() {
+		now := time.Now().Unix()
+		rx := &gears.RxInfo{Gateway: "10.0.0.5:9999", GwId: 2, Rssi: -87, Lna: 1, Seq: 200}
+		Ω(db.PutRFMessage(gears.RFMessage{At: now, Group: 5, Node: 3, Rx: rx})).Should(Succeed())
+		// a record written before there was any metadata
+		old := struct {
+			At          int64
+			Group, Node byte
+			Data        []byte
+		}{now + 1, 5, 4, []byte{1}}
+		Ω(db.Put(genRFKey(now+1), old)).Should(Succeed())
+
+		msgs := []gears.RFMessage{}
+		err := db.RFIterate(now, 0, func(m gears.RFMessage) error {
+			msgs = append(msgs, m)
+			return nil
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(msgs).Should(HaveLen(2))
+		Ω(msgs[0].Rx).Should(Equal(rx))
+		Ω(msgs[1].Node).Should(Equal(byte(4)))
+		Ω(msgs[1].Rx).Should(BeNil())
+	})
+
 	It("processes a channel", func() {
-		c := make(chan RFMessage)
-		NewProcessor(db)(c)
+		c := make(chan gears.RFMessage)
+		db.NewProcessor()(c)
 
 		now := time.Now().Unix()
 		for i := 0; i < 20; i += 1 {
-			m := RFMessage{At: now + int64(i), Group: byte(2 * i),
+			m := gears.RFMessage{At: now + int64(i), Group: byte(2 * i),
 				Node: 13, Data: []byte(fmt.Sprintf("Hello %d", i))}
 			c <- m
 		}
 		time.Sleep(time.Millisecond)
 
 		cnt := 0
-		err := db.RFIterate(now+3, now+16, func(m RFMessage) error {
+		err := db.RFIterate(now+3, now+16, func(m gears.RFMessage) error {
 			Ω(m.At).Should(Equal(now + int64(cnt+3)))
 			Ω(m.Group).Should(Equal(byte(2 * (cnt + 3))))
 			Ω(m.Node).Should(Equal(byte(13)))
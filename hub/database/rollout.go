@@ -0,0 +1,216 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/tve/widuino/gears"
+)
+
+// ===== Rollout =====
+
+// Each node type has at most one rollout, starting a new one replaces the previous one. While
+// a rollout is in the canary stage the canaries get its version, unless they have a version
+// activated for them specifically, and all other nodes keep the version of their node type.
+
+const rolloutPrefix = "rollout" // rollout/<nodeType> -> gears.Rollout
+
+// ErrNoCanaries is returned when starting a rollout without canaries
+var ErrNoCanaries = fmt.Errorf("a rollout needs at least one canary")
+
+// ErrRolloutEnded is returned when ending a rollout that was already promoted or aborted
+var ErrRolloutEnded = fmt.Errorf("rollout has already ended")
+
+// StartRollout stages the rollout of a firmware version to the canary nodes of a group
+func (db *DB) StartRollout(swId uint16, group byte, canaries []byte) (gears.Rollout, error) {
+	if len(canaries) == 0 {
+		return gears.Rollout{}, ErrNoCanaries
+	}
+	fw, err := db.GetFirmware(swId)
+	if err != nil {
+		return gears.Rollout{}, err
+	}
+	r := gears.Rollout{NodeType: fw.NodeType, SwId: swId, SwCheck: fw.Crc, Group: group,
+		Canaries: canaries, Confirmed: []byte{}, Healthy: []byte{},
+		State: gears.RolloutCanary, Start: time.Now().UnixNano() / 1000000}
+
+	db.rolloutMutex.Lock()
+	defer db.rolloutMutex.Unlock()
+	return r, db.putRollout(r)
+}
+
+func (db *DB) GetRollout(nodeType uint16) (gears.Rollout, error) {
+	var r gears.Rollout
+	err := db.Get(genRolloutKey(nodeType), &r)
+	return r, err
+}
+
+// ListRollouts returns the rollouts of all node types sorted by node type
+func (db *DB) ListRollouts() ([]gears.Rollout, error) {
+	rollouts := make([]gears.Rollout, 0)
+	var r gears.Rollout
+	err := db.Iterate(rolloutPrefix+"/", "", &r, func(key string) error {
+		rollouts = append(rollouts, r)
+		r = gears.Rollout{} // don't reuse the slices
+		return nil
+	})
+	return rollouts, err
+}
+
+// RolloutTarget returns the software ID a node gets due to a rollout in the canary stage,
+// returns ErrNotFound if the node is not a canary
+func (db *DB) RolloutTarget(nodeType uint16, group, node byte) (uint16, error) {
+	r, err := db.GetRollout(nodeType)
+	if err != nil {
+		return 0, err
+	}
+	if r.State != gears.RolloutCanary || r.Group != group || !inNodes(r.Canaries, node) {
+		return 0, ErrNotFound
+	}
+	return r.SwId, nil
+}
+
+// RolloutConfirm records that a node reported running the given software, which confirms the
+// upgrade of a canary if it's the version being rolled out
+func (db *DB) RolloutConfirm(nodeType uint16, group, node byte, swId, swCheck uint16) error {
+	db.rolloutMutex.Lock()
+	defer db.rolloutMutex.Unlock()
+
+	r, err := db.GetRollout(nodeType)
+	if err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if r.State != gears.RolloutCanary || r.Group != group || !inNodes(r.Canaries, node) ||
+		inNodes(r.Confirmed, node) || r.SwId != swId || r.SwCheck != swCheck {
+		return nil
+	}
+	glog.Infof("Rollout of sw=%d: canary RFg%di%d confirmed", r.SwId, group, node)
+	r.Confirmed = append(r.Confirmed, node)
+	return db.putRollout(r)
+}
+
+// RolloutHeard records that a node sent data, which makes it a healthy canary if it has
+// confirmed its upgrade. The rollout is promoted once all canaries are healthy. It's called
+// for every message received, so the rollouts are only read if the node is a canary.
+func (db *DB) RolloutHeard(group, node byte) error {
+	db.rolloutMutex.Lock()
+	defer db.rolloutMutex.Unlock()
+
+	if db.rolloutCanaries == nil {
+		if err := db.loadCanaries(); err != nil {
+			return err
+		}
+	}
+	if !db.rolloutCanaries[[2]byte{group, node}] {
+		return nil
+	}
+	rollouts, err := db.ListRollouts()
+	if err != nil {
+		return err
+	}
+	for _, r := range rollouts {
+		if r.State != gears.RolloutCanary || r.Group != group ||
+			!inNodes(r.Confirmed, node) || inNodes(r.Healthy, node) {
+			continue
+		}
+		glog.Infof("Rollout of sw=%d: canary RFg%di%d healthy", r.SwId, group, node)
+		r.Healthy = append(r.Healthy, node)
+		if len(r.Healthy) == len(r.Canaries) {
+			if r, err = db.endRollout(r, true); err != nil {
+				return err
+			}
+		} else if err := db.putRollout(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EndRollout promotes the rollout in the canary stage for a node type to all nodes, or
+// aborts it, which puts the canaries back on the version of their node type
+func (db *DB) EndRollout(nodeType uint16, promote bool) (gears.Rollout, error) {
+	db.rolloutMutex.Lock()
+	defer db.rolloutMutex.Unlock()
+
+	r, err := db.GetRollout(nodeType)
+	if err != nil {
+		return r, err
+	}
+	if r.State != gears.RolloutCanary {
+		return r, ErrRolloutEnded
+	}
+	return db.endRollout(r, promote)
+}
+
+func (db *DB) endRollout(r gears.Rollout, promote bool) (gears.Rollout, error) {
+	r.State = gears.RolloutAborted
+	if promote {
+		if _, err := db.ActivateFirmware(r.SwId, 0, 0); err != nil {
+			return r, err
+		}
+		r.State = gears.RolloutPromoted
+	}
+	r.EndAt = time.Now().UnixNano() / 1000000
+	glog.Infof("Rollout of sw=%d for nodeType=%d %s", r.SwId, r.NodeType, r.State)
+	return r, db.putRollout(r)
+}
+
+// putRollout stores a rollout and drops the canaries, which get loaded again when needed,
+// the caller must hold the rolloutMutex
+func (db *DB) putRollout(r gears.Rollout) error {
+	db.rolloutCanaries = nil
+	return db.Put(genRolloutKey(r.NodeType), r)
+}
+
+// loadCanaries loads the canaries of the rollouts in the canary stage, the caller must hold
+// the rolloutMutex
+func (db *DB) loadCanaries() error {
+	rollouts, err := db.ListRollouts()
+	if err != nil {
+		return err
+	}
+	canaries := make(map[[2]byte]bool)
+	for _, r := range rollouts {
+		if r.State != gears.RolloutCanary {
+			continue
+		}
+		for _, node := range r.Canaries {
+			canaries[[2]byte{r.Group, node}] = true
+		}
+	}
+	db.rolloutCanaries = canaries
+	return nil
+}
+
+// RolloutProcessor returns a processor for received RF messages that tracks which canaries
+// are sending data
+func (db *DB) RolloutProcessor() func(chan gears.RFMessage) {
+	return func(in chan gears.RFMessage) {
+		go func() {
+			for m := range in {
+				err := db.RolloutHeard(m.Group, m.Node)
+				if err != nil {
+					glog.Errorf("Error writing database: %s", err.Error())
+				}
+			}
+		}()
+	}
+}
+
+func inNodes(nodes []byte, node byte) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+func genRolloutKey(nodeType uint16) string {
+	return fmt.Sprintf("%s/%05d", rolloutPrefix, nodeType)
+}
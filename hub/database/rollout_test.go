@@ -0,0 +1,112 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+package database
+
+// Omega: Alt+937
+
+import (
+	"fmt"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tve/widuino/gears"
+)
+
+//===== tests =====
+
+var _ = Describe("Database Rollout", func() {
+
+	var dir string
+	var db *DB
+	var fw gears.Firmware
+
+	BeforeEach(func() {
+		dir = fmt.Sprintf("/tmp/db-%d", os.Getpid())
+		var err error
+		db, err = Open(dir)
+		Ω(err).ShouldNot(HaveOccurred())
+		fw, err = db.PutFirmware(gears.Firmware{NodeType: 100, Crc: 0x1234}, []byte{1})
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		db.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("targets canaries only", func() {
+		_, err := db.StartRollout(fw.SwId, 2, nil)
+		Ω(err).Should(HaveOccurred())
+		r, err := db.StartRollout(fw.SwId, 2, []byte{3, 4})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(r.NodeType).Should(Equal(uint16(100)))
+		Ω(r.SwCheck).Should(Equal(uint16(0x1234)))
+
+		Ω(db.RolloutTarget(100, 2, 3)).Should(Equal(fw.SwId))
+		_, err = db.RolloutTarget(100, 2, 5)
+		Ω(err).Should(MatchError(ErrNotFound))
+		_, err = db.RolloutTarget(100, 1, 3)
+		Ω(err).Should(MatchError(ErrNotFound))
+		_, err = db.RolloutTarget(101, 2, 3)
+		Ω(err).Should(MatchError(ErrNotFound))
+	})
+
+	It("promotes once all canaries are healthy", func() {
+		_, err := db.StartRollout(fw.SwId, 2, []byte{3, 4})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(db.RolloutConfirm(100, 2, 3, fw.SwId, 0x9999)).Should(Succeed()) // wrong check
+		Ω(db.RolloutConfirm(100, 2, 3, fw.SwId, 0x1234)).Should(Succeed())
+		Ω(db.RolloutConfirm(100, 2, 4, fw.SwId, 0x1234)).Should(Succeed())
+		Ω(db.RolloutHeard(2, 3)).Should(Succeed())
+		Ω(db.RolloutHeard(2, 3)).Should(Succeed())
+		r, err := db.GetRollout(100)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(r.Confirmed).Should(Equal([]byte{3, 4}))
+		Ω(r.Healthy).Should(Equal([]byte{3}))
+		Ω(r.State).Should(Equal(gears.RolloutCanary))
+		_, err = db.ActiveFirmware(100, 0, 0)
+		Ω(err).Should(MatchError(ErrNotFound))
+
+		Ω(db.RolloutHeard(2, 4)).Should(Succeed())
+		r, err = db.GetRollout(100)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(r.State).Should(Equal(gears.RolloutPromoted))
+		Ω(r.EndAt).ShouldNot(BeZero())
+		Ω(db.ActiveFirmware(100, 0, 0)).Should(Equal(fw.SwId))
+		_, err = db.RolloutTarget(100, 2, 3)
+		Ω(err).Should(MatchError(ErrNotFound))
+	})
+
+	It("aborts rollouts", func() {
+		_, err := db.StartRollout(fw.SwId, 2, []byte{3})
+		Ω(err).ShouldNot(HaveOccurred())
+		r, err := db.EndRollout(100, false)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(r.State).Should(Equal(gears.RolloutAborted))
+		_, err = db.RolloutTarget(100, 2, 3)
+		Ω(err).Should(MatchError(ErrNotFound))
+		_, err = db.ActiveFirmware(100, 0, 0)
+		Ω(err).Should(MatchError(ErrNotFound))
+		_, err = db.EndRollout(100, true)
+		Ω(err).Should(HaveOccurred())
+
+		rollouts, err := db.ListRollouts()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rollouts).Should(HaveLen(1))
+	})
+
+	It("keeps track of the canaries", func() {
+		Ω(db.RolloutHeard(2, 3)).Should(Succeed())
+		Ω(db.rolloutCanaries).Should(BeEmpty())
+		_, err := db.StartRollout(fw.SwId, 2, []byte{3, 4})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(db.RolloutHeard(2, 5)).Should(Succeed())
+		Ω(db.rolloutCanaries).Should(Equal(map[[2]byte]bool{{2, 3}: true, {2, 4}: true}))
+
+		_, err = db.EndRollout(100, false)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(db.RolloutHeard(2, 3)).Should(Succeed())
+		Ω(db.rolloutCanaries).Should(BeEmpty())
+	})
+})
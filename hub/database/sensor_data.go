@@ -56,3 +56,39 @@ func (db *DB) SensorIterate(name string, start, end int64,
 		return err
 	})
 }
+
+// SensorLast returns the most recent value of a sensor, or ErrNotFound if it has none
+func (db *DB) SensorLast(name string) (gears.SensorDataValue, error) {
+	var m gears.SensorDataValue
+	_, err := db.Last(genSensorKey(name, 0), genSensorKey(name, math.MaxInt64), &m)
+	return m, err
+}
+
+var errDoneReading = fmt.Errorf("done reading")
+
+// SensorReadRaw returns the values of a sensor from start to end inclusive plus the last value
+// before start and the first value after end, which is what interpolation needs to produce
+// data points at the edges of the interval.
+func (db *DB) SensorReadRaw(name string, start, end int64) ([]gears.SensorDataValue, error) {
+	values := make([]gears.SensorDataValue, 0)
+
+	var before gears.SensorDataValue
+	_, err := db.Last(genSensorKey(name, 0), genSensorKey(name, start), &before)
+	if err == nil {
+		values = append(values, before)
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+
+	err = db.SensorIterate(name, start, 0, func(m gears.SensorDataValue) error {
+		values = append(values, m)
+		if m.At > end {
+			return errDoneReading
+		}
+		return nil
+	})
+	if err != nil && err != errDoneReading {
+		return nil, err
+	}
+	return values, nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+package database
+
+// Omega: Alt+937
+
+import (
+	"fmt"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tve/widuino/gears"
+)
+
+//===== tests =====
+
+var _ = Describe("Database SensorData", func() {
+
+	var dir string
+	var db *DB
+
+	BeforeEach(func() {
+		dir = fmt.Sprintf("/tmp/db-%d", os.Getpid())
+		var err error
+		db, err = Open(dir)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		for i := int64(1); i <= 10; i += 1 {
+			err := db.PutSensorValue("a/b", gears.SensorDataValue{At: i * 100, Value: float64(i)})
+			Ω(err).ShouldNot(HaveOccurred())
+			err = db.PutSensorValue("a/c", gears.SensorDataValue{At: i * 100, Value: -1})
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	})
+
+	AfterEach(func() {
+		db.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("iterates", func() {
+		cnt := 0
+		err := db.SensorIterate("a/b", 300, 700, func(m gears.SensorDataValue) error {
+			Ω(m.At).Should(Equal(int64(300 + 100*cnt)))
+			cnt += 1
+			return nil
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(cnt).Should(Equal(4))
+	})
+
+	It("reads raw values including one on each side", func() {
+		values, err := db.SensorReadRaw("a/b", 350, 650)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(values).Should(HaveLen(5))
+		Ω(values[0].At).Should(Equal(int64(300)))
+		Ω(values[4].At).Should(Equal(int64(700)))
+	})
+
+	It("reads raw values at the edges", func() {
+		values, err := db.SensorReadRaw("a/b", 100, 1000)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(values).Should(HaveLen(10))
+		values, err = db.SensorReadRaw("a/b", 2000, 3000)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(values).Should(HaveLen(1))
+		Ω(values[0].Value).Should(Equal(10.0))
+	})
+
+	It("finds the last value", func() {
+		Ω(db.PutSensorValue("a/b/c", gears.SensorDataValue{At: 5000, Value: 3})).Should(Succeed())
+		v, err := db.SensorLast("a/b")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(v).Should(Equal(gears.SensorDataValue{At: 1000, Value: 10}))
+		_, err = db.SensorLast("a/x")
+		Ω(err).Should(Equal(ErrNotFound))
+	})
+
+	It("lists the sensor info", func() {
+		out := gears.SensorOutput{Type: gears.OutputSwitch, Group: 5, Node: 3, Kind: 5, Index: 1}
+		Ω(db.PutSensorInfo("a/b", gears.SensorInfo{Unit: "F"})).Should(Succeed())
+		Ω(db.PutSensorInfo("a/c", gears.SensorInfo{Output: out})).Should(Succeed())
+		infos, err := db.ListSensorInfo()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(infos).Should(Equal(map[string]gears.SensorInfo{
+			"a/b": {Unit: "F"}, "a/c": {Output: out}}))
+	})
+
+	It("subscribes and unsubscribes", func() {
+		c := db.SensorSubscribe("a/b", 1000)
+		Ω((<-c).At).Should(Equal(int64(1000)))
+		Ω(db.PutSensorValue("a/b", gears.SensorDataValue{At: 1100, Value: 11})).Should(Succeed())
+		Ω((<-c).At).Should(Equal(int64(1100)))
+		db.SensorUnsubscribe(c)
+		Eventually(c).Should(BeClosed())
+	})
+})
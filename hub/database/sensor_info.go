@@ -52,6 +52,18 @@ func (db *DB) GetSensorInfo(name string) (gears.SensorInfo, error) {
 	return m, err
 }
 
+// ListSensorInfo returns the info of all sensors by name
+func (db *DB) ListSensorInfo() (map[string]gears.SensorInfo, error) {
+	infos := make(map[string]gears.SensorInfo)
+	var m gears.SensorInfo
+	err := db.Iterate(sensInfoPrefix+"/", "", &m, func(key string) error {
+		infos[key[len(sensInfoPrefix)+1:]] = m
+		m = gears.SensorInfo{}
+		return nil
+	})
+	return infos, err
+}
+
 func genSensorInfoKey(name string) string {
 	return fmt.Sprintf("%s/%s", sensInfoPrefix, name)
 }
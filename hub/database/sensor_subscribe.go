@@ -64,9 +64,9 @@ func (db *DB) removeSensorSubscriber(name string, c chan gears.SensorDataValue)
 				(*db.sensorSubscriberStart[name])[i+1:]...)
 		}
 	}
-	if len(*subs) != len(db.sensorSubscriberStart) {
+	if len(*subs) != len(*db.sensorSubscriberStart[name]) {
 		glog.Fatalf("sensorSubscriber array mismatch %d != %d",
-			len(*subs), len(db.sensorSubscriberStart))
+			len(*subs), len(*db.sensorSubscriberStart[name]))
 	}
 	return
 }
@@ -87,6 +87,9 @@ func (db *DB) SensorUnsubscribe(c chan gears.SensorDataValue) {
 func (db *DB) SensorPublish(name string, m gears.SensorDataValue) {
 	db.sensorSubscriberMutex.Lock()
 	defer db.sensorSubscriberMutex.Unlock()
+	if db.sensorSubscribers[name] == nil {
+		return
+	}
 	for i := range *db.sensorSubscribers[name] {
 		if m.At >= (*db.sensorSubscriberStart[name])[i] {
 			(*db.sensorSubscribers[name])[i] <- m
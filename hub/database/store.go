@@ -21,10 +21,30 @@ type DB struct {
 	rfSubscriberMutex sync.Mutex
 	rfSubscribers     []chan gears.RFMessage
 	rfSubscriberStart []int64
+	rfSubscriberMatch []gears.RFMatch
 	// each sensor can have a list of subscribers
 	sensorSubscriberMutex sync.Mutex
 	sensorSubscribers     map[string]*[]chan gears.SensorDataValue
 	sensorSubscriberStart map[string]*[]int64
+	// parameter changes can have a list of subscribers, each for a name prefix
+	paramSubscriberMutex  sync.Mutex
+	paramSubscribers      []chan gears.ParamChange
+	paramSubscriberPrefix []string
+	// node ID allocation for pairings must be atomic
+	pairingMutex sync.Mutex
+	// software ID allocation and firmware activation must be atomic
+	firmwareMutex sync.Mutex
+	// upgrade sessions can have a list of subscribers, each for a node or all nodes
+	upgradeSubscriberMutex sync.Mutex
+	upgradeSubscribers     []chan gears.UpgradeSession
+	upgradeSubscriberNode  [][2]byte // group, node
+	// rollout state changes must be atomic
+	rolloutMutex    sync.Mutex
+	rolloutCanaries map[[2]byte]bool // group, node of the canaries, nil until loaded
+	// node status transitions can have a list of subscribers, each for a node or all nodes
+	nodeStatusSubscriberMutex sync.Mutex
+	nodeStatusSubscribers     []chan gears.NodeStatus
+	nodeStatusSubscriberNode  [][2]byte // group, node
 }
 
 func Open(path string) (*DB, error) {
@@ -36,8 +56,14 @@ func Open(path string) (*DB, error) {
 	return &DB{
 			ldb, path,
 			sync.Mutex{}, make([]chan gears.RFMessage, 0), make([]int64, 0),
+			make([]gears.RFMatch, 0),
 			sync.Mutex{}, make(map[string]*[]chan gears.SensorDataValue),
-			make(map[string]*[]int64)},
+			make(map[string]*[]int64),
+			sync.Mutex{}, make([]chan gears.ParamChange, 0), make([]string, 0),
+			sync.Mutex{}, sync.Mutex{},
+			sync.Mutex{}, make([]chan gears.UpgradeSession, 0), make([][2]byte, 0),
+			sync.Mutex{}, nil,
+			sync.Mutex{}, make([]chan gears.NodeStatus, 0), make([][2]byte, 0)},
 		nil
 }
 
@@ -118,6 +144,29 @@ func (db *DB) Iterate(from, to string, value interface{}, fun func(key string) e
 	return nil
 }
 
+// Last finds the last key in a key range, start inclusive, end exclusive, and decodes its value
+// into the interface provided. Returns ErrNotFound if there is no key in the range.
+func (db *DB) Last(from, to string, value interface{}) (string, error) {
+	slice := &dbutil.Range{Start: []byte(from), Limit: []byte(to)}
+	if len(to) == 0 {
+		slice.Limit = append(slice.Start, 0xFF)
+	}
+
+	iter := db.ldb.NewIterator(slice, nil)
+	defer iter.Release()
+
+	if !iter.Last() {
+		return "", ErrNotFound
+	}
+	key := string(iter.Key())
+	d := codec.NewDecoderBytes(iter.Value(), &mh)
+	err := d.Decode(value)
+	if err != nil {
+		return "", fmt.Errorf("database.Last decoding for key %s: %s", key, err.Error())
+	}
+	return key, nil
+}
+
 /*
 func dbKeys(prefix string) (results []string) {
 	glog.V(3).Infoln("keys", prefix)
@@ -117,4 +117,20 @@ var _ = Describe("Database store", func() {
 		Ω(err).Should(MatchError("hello"))
 		Ω(sum).Should(Equal(3 + 4 + 5 + 6 + 7))
 	})
+	It("finds the last key in a range", func() {
+		for i := 0; i < 20; i += 1 {
+			k := fmt.Sprintf("series/%02d", i)
+			err := db.Put(k, i)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+
+		var v int
+		k, err := db.Last("series/03", "series/13", &v)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(k).Should(Equal("series/12"))
+		Ω(v).Should(Equal(12))
+
+		_, err = db.Last("series/", "series/00", &v)
+		Ω(err).Should(MatchError(ErrNotFound))
+	})
 })
@@ -0,0 +1,87 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+package database
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/tve/widuino/gears"
+)
+
+// ===== Upgrade sessions =====
+
+// Upgrade sessions are kept as an audit log of the over-the-air upgrades of each node, keyed
+// by node and start time
+
+const upgradePrefix = "upgrade"
+
+// PutUpgradeSession stores an upgrade session, replacing the previous state of the same
+// session, and forwards it to subscribers
+func (db *DB) PutUpgradeSession(s gears.UpgradeSession) error {
+	err := db.Put(genUpgradeKey(s.Group, s.Node, s.Start), s)
+	if err == nil {
+		db.UpgradePublish(s)
+	}
+	return err
+}
+
+// ListUpgradeSessions returns the upgrade sessions of a node, or of all nodes if node is
+// zero, sorted by node and start time
+func (db *DB) ListUpgradeSessions(group, node byte) ([]gears.UpgradeSession, error) {
+	prefix := upgradePrefix + "/"
+	if node != 0 {
+		prefix = fmt.Sprintf("%s/%03d/%02d/", upgradePrefix, group, node)
+	}
+	sessions := make([]gears.UpgradeSession, 0)
+	var s gears.UpgradeSession
+	err := db.Iterate(prefix, "", &s, func(key string) error {
+		sessions = append(sessions, s)
+		return nil
+	})
+	return sessions, err
+}
+
+func genUpgradeKey(group, node byte, start int64) string {
+	return fmt.Sprintf("%s/%03d/%02d/%013d", upgradePrefix, group, node, start)
+}
+
+// Subscribe to the upgrade sessions of a node, or of all nodes if node is zero, returns a
+// channel to read session updates from.
+func (db *DB) UpgradeSubscribe(group, node byte) chan gears.UpgradeSession {
+	db.upgradeSubscriberMutex.Lock()
+	defer db.upgradeSubscriberMutex.Unlock()
+	c := make(chan gears.UpgradeSession, 100)
+	db.upgradeSubscribers = append(db.upgradeSubscribers, c)
+	db.upgradeSubscriberNode = append(db.upgradeSubscriberNode, [2]byte{group, node})
+	return c
+}
+
+// Unsubscribe the given channel from upgrade sessions, this closes the channel.
+func (db *DB) UpgradeUnsubscribe(c chan gears.UpgradeSession) {
+	db.upgradeSubscriberMutex.Lock()
+	defer db.upgradeSubscriberMutex.Unlock()
+	for i := 0; i < len(db.upgradeSubscribers); i += 1 {
+		if db.upgradeSubscribers[i] != c {
+			continue
+		}
+		close(db.upgradeSubscribers[i])
+		db.upgradeSubscribers = append(db.upgradeSubscribers[0:i], db.upgradeSubscribers[i+1:]...)
+		db.upgradeSubscriberNode = append(db.upgradeSubscriberNode[0:i],
+			db.upgradeSubscriberNode[i+1:]...)
+		return
+	}
+}
+
+// Forward an upgrade session update to all subscribers for the node.
+func (db *DB) UpgradePublish(s gears.UpgradeSession) {
+	db.upgradeSubscriberMutex.Lock()
+	defer db.upgradeSubscriberMutex.Unlock()
+	for i, n := range db.upgradeSubscriberNode {
+		if n[1] == 0 || n == [2]byte{s.Group, s.Node} {
+			db.upgradeSubscribers[i] <- s
+		}
+	}
+	glog.V(2).Infof("Published: RFg%03di%02d upgrade to %d upgradeSubscribers",
+		s.Group, s.Node, len(db.upgradeSubscribers))
+}
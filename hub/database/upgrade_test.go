@@ -0,0 +1,68 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+package database
+
+// Omega: Alt+937
+
+import (
+	"fmt"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tve/widuino/gears"
+)
+
+//===== tests =====
+
+var _ = Describe("Database UpgradeSession", func() {
+
+	var dir string
+	var db *DB
+
+	BeforeEach(func() {
+		dir = fmt.Sprintf("/tmp/db-%d", os.Getpid())
+		var err error
+		db, err = Open(dir)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		db.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("stores and lists sessions", func() {
+		s := gears.UpgradeSession{Group: 2, Node: 3, SwId: 1000, Start: 100,
+			State: gears.UpgradeDownloading}
+		Ω(db.PutUpgradeSession(s)).Should(Succeed())
+		s.State = gears.UpgradeDownloaded
+		Ω(db.PutUpgradeSession(s)).Should(Succeed())
+		s.Start = 200
+		Ω(db.PutUpgradeSession(s)).Should(Succeed())
+		Ω(db.PutUpgradeSession(gears.UpgradeSession{Group: 2, Node: 4, Start: 50})).
+			Should(Succeed())
+
+		sessions, err := db.ListUpgradeSessions(2, 3)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(sessions).Should(HaveLen(2))
+		Ω(sessions[0].State).Should(Equal(gears.UpgradeDownloaded))
+		Ω(sessions[1].Start).Should(Equal(int64(200)))
+		sessions, err = db.ListUpgradeSessions(0, 0)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(sessions).Should(HaveLen(3))
+	})
+
+	It("publishes sessions to subscribers", func() {
+		all := db.UpgradeSubscribe(0, 0)
+		one := db.UpgradeSubscribe(2, 4)
+		Ω(db.PutUpgradeSession(gears.UpgradeSession{Group: 2, Node: 3})).Should(Succeed())
+		Ω(db.PutUpgradeSession(gears.UpgradeSession{Group: 2, Node: 4})).Should(Succeed())
+		Ω(all).Should(HaveLen(2))
+		Ω(one).Should(HaveLen(1))
+		Ω((<-one).Node).Should(Equal(byte(4)))
+		db.UpgradeUnsubscribe(all)
+		db.UpgradeUnsubscribe(one)
+		Ω(one).Should(BeClosed())
+	})
+})
@@ -0,0 +1,235 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+// Packet decoders - turn the payload of received RF messages into named sensor values that
+// get stored in the database. Each decoder handles one kind of message, i.e., one module as
+// defined in nodes/EEConf/EEConf.h. Decoded values are named <node>/<reading>, where the node
+// part is <location>/<sketch> if the node is in the node map, e.g. basement/heating/temp3,
+// and RFgGGGiNN otherwise, e.g. RFg212i03/temp3. The node map can also rename readings.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/tve/widuino/gears"
+	"github.com/tve/widuino/hub/database"
+)
+
+// Module IDs, see nodes/EEConf/EEConf.h
+const (
+	LOG_MODULE          = 2
+	OWTEMP_MODULE       = 4
+	OWRELAY_MODULE      = 5
+	WATERLEVEL_MODULE   = 7
+	GW_RSSI_MODULE      = 8
+	THERMOCOUPLE_MODULE = 9
+	SLOWSERVO_MODULE    = 10
+)
+
+// A Reading is one sensor value decoded from an RF message
+type Reading struct {
+	Name  string // name of the reading relative to the node, e.g. "temp0"
+	Info  gears.SensorInfo
+	Value float64
+}
+
+// A Decoder turns the payload of an RF message into readings
+type Decoder interface {
+	Decode(m gears.RFMessage) ([]Reading, error)
+}
+
+var decoders = make(map[byte]Decoder) // module kind -> decoder
+
+// RegisterDecoder registers the decoder for a kind of message, replacing any previous one
+func RegisterDecoder(kind byte, d Decoder) {
+	decoders[kind] = d
+}
+
+// Functions that get each decoded sensor value after it's stored, e.g., to publish it
+var sensorHooks []func(name string, info gears.SensorInfo, v gears.SensorDataValue)
+
+// RegisterSensorHook registers a function that gets each decoded sensor value, it must not
+// block and must be registered before the DecodeProcessor starts
+func RegisterSensorHook(f func(name string, info gears.SensorInfo, v gears.SensorDataValue)) {
+	sensorHooks = append(sensorHooks, f)
+}
+
+func init() {
+	RegisterDecoder(LOG_MODULE, logDecoder{})
+	RegisterDecoder(OWTEMP_MODULE, owTempDecoder{})
+	RegisterDecoder(OWRELAY_MODULE, owRelayDecoder{})
+	RegisterDecoder(WATERLEVEL_MODULE, waterLevelDecoder{})
+	RegisterDecoder(GW_RSSI_MODULE, gwRssiDecoder{})
+	RegisterDecoder(THERMOCOUPLE_MODULE, thermocoupleDecoder{})
+	RegisterDecoder(SLOWSERVO_MODULE, slowServoDecoder{})
+}
+
+// DecodeProcessor decodes received messages and stores the readings in the database
+func DecodeProcessor(in chan gears.RFMessage) {
+	go func() {
+		known := make(map[string]gears.SensorInfo) // sensor info already in the database
+		for m := range in {
+			d := decoders[m.Kind]
+			if d == nil {
+				continue
+			}
+			readings, err := d.Decode(m)
+			if err != nil {
+				glog.Warningf("Cannot decode %s: %s", m.RfTag(), err.Error())
+				continue
+			}
+			ni, err := db.GetNodeInfo(m.Group, m.Node)
+			if err == database.ErrNotFound {
+				ni = gears.NodeInfo{Group: m.Group, Node: m.Node}
+			} else if err != nil {
+				glog.Errorf("Error reading database: %s", err.Error())
+				continue
+			}
+			for _, r := range readings {
+				var name string
+				info := r.Info
+				name, info.Unit = ni.SensorName(r.Name, r.Info.Unit)
+				if i, ok := known[name]; !ok || i != info {
+					if err := db.PutSensorInfo(name, info); err != nil {
+						glog.Errorf("Error writing database: %s", err.Error())
+						continue
+					}
+					known[name] = info
+				}
+				v := gears.SensorDataValue{At: m.At, Value: r.Value}
+				if err := db.PutSensorValue(name, v); err != nil {
+					glog.Errorf("Error writing database: %s", err.Error())
+					continue
+				}
+				for _, f := range sensorHooks {
+					f(name, info, v)
+				}
+			}
+		}
+	}()
+}
+
+// ===== Decoders
+
+// Log messages are text, they're logged and don't produce readings
+type logDecoder struct{}
+
+func (logDecoder) Decode(m gears.RFMessage) ([]Reading, error) {
+	glog.Infof("LOG RFg%di%d: %s", m.Group, m.Node, strings.TrimSpace(string(m.Data)))
+	return nil, nil
+}
+
+// OwTemp messages have one signed byte per 1-wire temperature sensor in degrees F, rounded,
+// sensors without a valid reading are left out by the node
+type owTempDecoder struct{}
+
+func (owTempDecoder) Decode(m gears.RFMessage) ([]Reading, error) {
+	readings := make([]Reading, 0, len(m.Data))
+	for i, t := range m.Data {
+		readings = append(readings, Reading{fmt.Sprintf("temp%d", i),
+			gears.SensorInfo{Unit: "F"}, float64(int8(t))})
+	}
+	return readings, nil
+}
+
+// OwRelay messages have one byte per 1-wire relay with its state, 0 for off and 1 for on.
+// The relays can be switched by sending the node an OwRelay message with the relay's index
+// and the new state.
+type owRelayDecoder struct{}
+
+func (owRelayDecoder) Decode(m gears.RFMessage) ([]Reading, error) {
+	readings := make([]Reading, len(m.Data))
+	for i, v := range m.Data {
+		if v > 1 {
+			return nil, fmt.Errorf("OwRelay: relay %d state %d", i, v)
+		}
+		readings[i] = Reading{fmt.Sprintf("relay%d", i), gears.SensorInfo{
+			Output: gears.SensorOutput{Type: gears.OutputSwitch, Group: m.Group,
+				Node: m.Node, Kind: OWRELAY_MODULE, Index: byte(i)}}, float64(v)}
+	}
+	return readings, nil
+}
+
+// WaterLevel messages have two little-endian uint16 raw ADC readings of a 3.3V reference
+type waterLevelDecoder struct{}
+
+func (waterLevelDecoder) Decode(m gears.RFMessage) ([]Reading, error) {
+	if len(m.Data) != 4 {
+		return nil, fmt.Errorf("water level: %d bytes (!= 4)", len(m.Data))
+	}
+	readings := make([]Reading, 2)
+	for i := range readings {
+		raw := binary.LittleEndian.Uint16(m.Data[2*i:])
+		readings[i] = Reading{fmt.Sprintf("level%d", i+1),
+			gears.SensorInfo{Unit: "V"}, float64(raw) * 3.3 / 1024}
+	}
+	return readings, nil
+}
+
+// GW RSSI messages have the UDP gateway's RF and ethernet receive and send counters followed
+// by optional per-node RSSI measurements: first the RSSI the gateway measured for each node
+// (nodes 1..30), then the RSSI each node reported in its ACKs. Zero RSSI means no data.
+type gwRssiDecoder struct{}
+
+const gwRssiNodes = 30 // RF12_NUMID-2, excludes node 0 and the gateway itself
+
+func (gwRssiDecoder) Decode(m gears.RFMessage) ([]Reading, error) {
+	if len(m.Data) < 4 {
+		return nil, fmt.Errorf("GW RSSI: %d bytes (< 4)", len(m.Data))
+	}
+	readings := []Reading{
+		{"rf_rcv", gears.SensorInfo{Unit: "pkts"}, float64(m.Data[0])},
+		{"rf_snd", gears.SensorInfo{Unit: "pkts"}, float64(m.Data[1])},
+		{"eth_rcv", gears.SensorInfo{Unit: "pkts"}, float64(m.Data[2])},
+		{"eth_snd", gears.SensorInfo{Unit: "pkts"}, float64(m.Data[3])},
+	}
+	rssi := m.Data[4:]
+	for i, r := range rssi {
+		if r == 0 {
+			continue
+		}
+		name := fmt.Sprintf("rcv_rssi/i%02d", i+1)
+		if i >= gwRssiNodes {
+			name = fmt.Sprintf("ack_rssi/i%02d", i-gwRssiNodes+1)
+		}
+		readings = append(readings, Reading{name, gears.SensorInfo{Unit: "rssi"}, float64(r)})
+	}
+	return readings, nil
+}
+
+// Thermocouple messages have the temperature in degrees C followed by the thermocouple
+// voltage in mV, both little-endian int16
+type thermocoupleDecoder struct{}
+
+func (thermocoupleDecoder) Decode(m gears.RFMessage) ([]Reading, error) {
+	if len(m.Data) != 4 {
+		return nil, fmt.Errorf("thermocouple: %d bytes (!= 4)", len(m.Data))
+	}
+	temp := int16(binary.LittleEndian.Uint16(m.Data[0:]))
+	mVolt := int16(binary.LittleEndian.Uint16(m.Data[2:]))
+	return []Reading{
+		{"temp", gears.SensorInfo{Unit: "C"}, float64(temp)},
+		{"mvolt", gears.SensorInfo{Unit: "mV"}, float64(mVolt)},
+	}, nil
+}
+
+// SlowServo messages have one byte per servo with its position in degrees, 0..180. The servos
+// can be moved by sending the node a SlowServo message with the servo's index and the new
+// position.
+type slowServoDecoder struct{}
+
+func (slowServoDecoder) Decode(m gears.RFMessage) ([]Reading, error) {
+	readings := make([]Reading, len(m.Data))
+	for i, v := range m.Data {
+		if v > 180 {
+			return nil, fmt.Errorf("SlowServo: servo %d position %d", i, v)
+		}
+		readings[i] = Reading{fmt.Sprintf("servo%d", i), gears.SensorInfo{Unit: "deg",
+			Output: gears.SensorOutput{Type: gears.OutputPosition, Group: m.Group,
+				Node: m.Node, Kind: SLOWSERVO_MODULE, Index: byte(i)}}, float64(v)}
+	}
+	return readings, nil
+}
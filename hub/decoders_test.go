@@ -0,0 +1,157 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+package main
+
+// Omega: Alt+937
+
+import (
+	"fmt"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tve/widuino/gears"
+	"github.com/tve/widuino/hub/database"
+)
+
+//===== tests =====
+
+var _ = Describe("Decoders", func() {
+
+	decode := func(kind byte, data []byte) []Reading {
+		m := gears.RFMessage{Group: 212, Node: 3, Kind: kind, Data: data}
+		r, err := decoders[kind].Decode(m)
+		Ω(err).ShouldNot(HaveOccurred())
+		return r
+	}
+
+	It("decodes OwTemp", func() {
+		r := decode(OWTEMP_MODULE, []byte{70, 0, 0xFE})
+		Ω(r).Should(Equal([]Reading{
+			{"temp0", gears.SensorInfo{Unit: "F"}, 70},
+			{"temp1", gears.SensorInfo{Unit: "F"}, 0},
+			{"temp2", gears.SensorInfo{Unit: "F"}, -2},
+		}))
+	})
+
+	It("decodes water levels", func() {
+		r := decode(WATERLEVEL_MODULE, []byte{0x00, 0x02, 0x00, 0x01})
+		Ω(r).Should(HaveLen(2))
+		Ω(r[0].Name).Should(Equal("level1"))
+		Ω(r[0].Value).Should(BeNumerically("~", 1.65))
+		Ω(r[1].Value).Should(BeNumerically("~", 0.825))
+	})
+
+	It("decodes GW RSSI", func() {
+		data := make([]byte, 4+2*gwRssiNodes)
+		copy(data, []byte{10, 2, 12, 3})
+		data[4+2] = 55             // rcv RSSI of node 3
+		data[4+gwRssiNodes+4] = 66 // ack RSSI of node 5
+		r := decode(GW_RSSI_MODULE, data)
+		Ω(r).Should(HaveLen(6))
+		Ω(r[0]).Should(Equal(Reading{"rf_rcv", gears.SensorInfo{Unit: "pkts"}, 10}))
+		Ω(r[4]).Should(Equal(Reading{"rcv_rssi/i03", gears.SensorInfo{Unit: "rssi"}, 55}))
+		Ω(r[5]).Should(Equal(Reading{"ack_rssi/i05", gears.SensorInfo{Unit: "rssi"}, 66}))
+	})
+
+	It("decodes thermocouples", func() {
+		r := decode(THERMOCOUPLE_MODULE, []byte{0x2C, 0x01, 0xF6, 0xFF})
+		Ω(r).Should(Equal([]Reading{
+			{"temp", gears.SensorInfo{Unit: "C"}, 300},
+			{"mvolt", gears.SensorInfo{Unit: "mV"}, -10},
+		}))
+	})
+
+	It("decodes relays and servos as outputs", func() {
+		r := decode(OWRELAY_MODULE, []byte{0, 1})
+		Ω(r).Should(HaveLen(2))
+		Ω(r[1]).Should(Equal(Reading{"relay1", gears.SensorInfo{Output: gears.SensorOutput{
+			Type: gears.OutputSwitch, Group: 212, Node: 3, Kind: OWRELAY_MODULE, Index: 1}}, 1}))
+		r = decode(SLOWSERVO_MODULE, []byte{90})
+		Ω(r).Should(Equal([]Reading{{"servo0", gears.SensorInfo{Unit: "deg",
+			Output: gears.SensorOutput{Type: gears.OutputPosition, Group: 212, Node: 3,
+				Kind: SLOWSERVO_MODULE, Index: 0}}, 90}}))
+		_, err := decoders[OWRELAY_MODULE].Decode(gears.RFMessage{Data: []byte{2}})
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("rejects bad lengths", func() {
+		m := gears.RFMessage{Kind: WATERLEVEL_MODULE, Data: []byte{1, 2, 3}}
+		_, err := decoders[WATERLEVEL_MODULE].Decode(m)
+		Ω(err).Should(HaveOccurred())
+	})
+
+	Describe("DecodeProcessor", func() {
+		var dbDir string
+
+		BeforeEach(func() {
+			dbDir = fmt.Sprintf("/tmp/db-d-%d", os.Getpid())
+			var err error
+			db, err = database.Open(dbDir) // db is global defined in main.go
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			db.Close()
+			os.RemoveAll(dbDir)
+		})
+
+		It("stores sensor values", func() {
+			c := make(chan gears.RFMessage)
+			DecodeProcessor(c)
+			c <- gears.RFMessage{At: 1000, Group: 212, Node: 3, Kind: OWTEMP_MODULE,
+				Data: []byte{70, 71}}
+			c <- gears.RFMessage{At: 2000, Group: 212, Node: 3, Kind: OWTEMP_MODULE,
+				Data: []byte{72, 73}}
+			c <- gears.RFMessage{At: 3000, Group: 212, Node: 3, Kind: 99}
+			close(c)
+
+			values := func() []gears.SensorDataValue {
+				v, _ := db.SensorReadRaw("RFg212i03/temp1", 0, 5000)
+				return v
+			}
+			Eventually(values).Should(Equal([]gears.SensorDataValue{
+				{At: 1000, Value: 71}, {At: 2000, Value: 73}}))
+			info, err := db.GetSensorInfo("RFg212i03/temp1")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(info.Unit).Should(Equal("F"))
+		})
+
+		It("passes the values to the sensor hooks", func() {
+			hooked := make(chan string, 10)
+			RegisterSensorHook(func(name string, info gears.SensorInfo, v gears.SensorDataValue) {
+				hooked <- fmt.Sprintf("%s=%v%s@%d", name, v.Value, info.Unit, v.At)
+			})
+			defer func() { sensorHooks = nil }()
+			c := make(chan gears.RFMessage)
+			DecodeProcessor(c)
+			c <- gears.RFMessage{At: 1000, Group: 212, Node: 3, Kind: OWTEMP_MODULE,
+				Data: []byte{70}}
+			close(c)
+			Ω(<-hooked).Should(Equal("RFg212i03/temp0=70F@1000"))
+		})
+
+		It("names sensors using the node map", func() {
+			db.PutNodeInfo(gears.NodeInfo{Group: 212, Node: 3, Sketch: "heating",
+				Location: "basement", Sensors: map[string]gears.NodeSensor{
+					"temp1": {Name: "boiler_out", Unit: "degF"}}})
+			c := make(chan gears.RFMessage)
+			DecodeProcessor(c)
+			c <- gears.RFMessage{At: 1000, Group: 212, Node: 3, Kind: OWTEMP_MODULE,
+				Data: []byte{70, 71}}
+			close(c)
+
+			values := func(name string) []gears.SensorDataValue {
+				v, _ := db.SensorReadRaw(name, 0, 5000)
+				return v
+			}
+			Eventually(func() []gears.SensorDataValue {
+				return values("basement/heating/boiler_out")
+			}).Should(Equal([]gears.SensorDataValue{{At: 1000, Value: 71}}))
+			Ω(values("basement/heating/temp0")).Should(Equal(
+				[]gears.SensorDataValue{{At: 1000, Value: 70}}))
+			info, err := db.GetSensorInfo("basement/heating/boiler_out")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(info.Unit).Should(Equal("degF"))
+		})
+	})
+})
@@ -0,0 +1,284 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+// Grafana JSON datasource
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tve/widuino/gears"
+	"github.com/tve/widuino/hub/database"
+	"github.com/tve/widuino/interpol8"
+)
+
+// Grafana graphs the sensors through its JSON datasource pointed at http://<hub>:9380/grafana:
+//
+//	GET  /grafana/            connection test
+//	POST /grafana/search      names of the sensors that contain the target
+//	POST /grafana/query       time series of the targets
+//	POST /grafana/annotations upgrades and online/offline transitions of the nodes
+//
+// A target is a sensor name and produces three series, <name>:avg, <name>:min, and
+// <name>:max, a target with one of these suffixes produces just that series. The points are
+// the interpolated values of the sensor at Grafana's interval, or at a longer one so there
+// are no more points than Grafana asks for, and gaps in the data are null. The query of an
+// annotation is "upgrades", "status", or empty for both.
+
+const grafanaMaxPoints = 10000 // points per series if Grafana doesn't say
+
+// the series produced for each sensor
+var grafanaStats = []string{"avg", "min", "max"}
+
+type grafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+type grafanaQuery struct {
+	Range         grafanaRange    `json:"range"`
+	IntervalMs    int64           `json:"intervalMs"`
+	MaxDataPoints int64           `json:"maxDataPoints"`
+	Targets       []grafanaTarget `json:"targets"`
+}
+
+type grafanaTarget struct {
+	Target string `json:"target"`
+	Type   string `json:"type"` // timeserie or table
+	Hide   bool   `json:"hide"`
+}
+
+type grafanaSeries struct {
+	Target     string         `json:"target"`
+	Datapoints []grafanaPoint `json:"datapoints"`
+}
+
+// grafanaPoint is encoded as a [value, time] pair
+type grafanaPoint struct {
+	Value float64
+	At    int64 // milliseconds since the epoch
+}
+
+type grafanaSearch struct {
+	Target string `json:"target"`
+}
+
+type grafanaAnnotationQuery struct {
+	Range      grafanaRange    `json:"range"`
+	Annotation json.RawMessage `json:"annotation"` // returned with each annotation
+}
+
+type grafanaAnnotation struct {
+	Annotation json.RawMessage `json:"annotation"`
+	Time       int64           `json:"time"`
+	TimeEnd    int64           `json:"timeEnd,omitempty"`
+	Title      string          `json:"title"`
+	Tags       []string        `json:"tags"`
+	Text       string          `json:"text"`
+}
+
+func (p grafanaPoint) MarshalJSON() ([]byte, error) {
+	if math.IsNaN(p.Value) || math.IsInf(p.Value, 0) {
+		return []byte(fmt.Sprintf("[null,%d]", p.At)), nil
+	}
+	return json.Marshal([]interface{}{p.Value, p.At})
+}
+
+func grafanaRoutes() []httpRoute {
+	return []httpRoute{
+		{"/grafana/", map[string]httpFunc{"GET": grafanaTest}},
+		{"/grafana/search", map[string]httpFunc{"POST": grafanaSearchSensors}},
+		{"/grafana/query", map[string]httpFunc{"POST": grafanaQuerySensors}},
+		{"/grafana/annotations", map[string]httpFunc{"POST": grafanaAnnotations}},
+	}
+}
+
+// grafanaMs returns a time of a range in milliseconds since the epoch
+func grafanaMs(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / 1000000
+}
+
+func grafanaTest(r *http.Request, arg string) (interface{}, gears.Reply) {
+	if arg != "" {
+		return nil, gears.Reply{Code: gears.CodeClientError, Error: "unknown grafana request"}
+	}
+	return "ok", gears.Reply{Code: gears.CodeOK}
+}
+
+func grafanaSearchSensors(r *http.Request, arg string) (interface{}, gears.Reply) {
+	var q grafanaSearch
+	if rep := readJSON(r, &q); rep != nil {
+		return nil, *rep
+	}
+	infos, err := db.ListSensorInfo()
+	if err != nil {
+		return nil, gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+	}
+	names := make([]string, 0, len(infos))
+	for name := range infos {
+		if strings.Contains(name, q.Target) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, gears.Reply{Code: gears.CodeOK}
+}
+
+func grafanaQuerySensors(r *http.Request, arg string) (interface{}, gears.Reply) {
+	var q grafanaQuery
+	if rep := readJSON(r, &q); rep != nil {
+		return nil, *rep
+	}
+	from, to := grafanaMs(q.Range.From), grafanaMs(q.Range.To)
+	if from <= 0 || to < from {
+		return nil, gears.Reply{Code: gears.CodeClientError, Error: "bad time range"}
+	}
+
+	// align the points to the interval, making it longer if there would be too many points
+	step := q.IntervalMs
+	if step < 2 {
+		step = 2
+	}
+	maxPoints := q.MaxDataPoints
+	if maxPoints <= 0 {
+		maxPoints = grafanaMaxPoints
+	}
+	if min := (to-from)/maxPoints + 1; step < min {
+		step = min
+	}
+	start, end := from-from%step, to-to%step
+
+	series := make([]grafanaSeries, 0, 3*len(q.Targets))
+	for _, t := range q.Targets {
+		if t.Hide || t.Target == "" {
+			continue
+		}
+		if t.Type != "" && t.Type != "timeserie" {
+			return nil, gears.Reply{Code: gears.CodeClientError,
+				Error: "only timeserie targets are supported"}
+		}
+		name, stats := t.Target, grafanaStats
+		for _, stat := range grafanaStats {
+			if strings.HasSuffix(t.Target, ":"+stat) {
+				name, stats = strings.TrimSuffix(t.Target, ":"+stat), []string{stat}
+			}
+		}
+		// tell which of the targets is missing, Grafana shows the error
+		if _, err := db.GetSensorInfo(name); err == database.ErrNotFound {
+			return nil, gears.Reply{Code: gears.CodeClientError,
+				Error: "unknown sensor " + name}
+		} else if err != nil {
+			return nil, gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+		}
+		points, err := sensorPoints(name, start, end, step)
+		if err != nil {
+			return nil, gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+		}
+		for _, stat := range stats {
+			series = append(series, grafanaSeries{Target: name + ":" + stat,
+				Datapoints: grafanaPoints(points, stat)})
+		}
+	}
+	return series, gears.Reply{Code: gears.CodeOK}
+}
+
+// grafanaPoints returns one statistic of the interpolated points
+func grafanaPoints(points []interpol8.IntPoint, stat string) []grafanaPoint {
+	gp := make([]grafanaPoint, len(points))
+	for i, p := range points {
+		gp[i].At = int64(p.Asof)
+		switch stat {
+		case "avg":
+			gp[i].Value = p.Avg
+		case "min":
+			gp[i].Value = p.Min
+		case "max":
+			gp[i].Value = p.Max
+		}
+	}
+	return gp
+}
+
+func grafanaAnnotations(r *http.Request, arg string) (interface{}, gears.Reply) {
+	var q grafanaAnnotationQuery
+	if rep := readJSON(r, &q); rep != nil {
+		return nil, *rep
+	}
+	var a struct {
+		Query string `json:"query"`
+	}
+	json.Unmarshal(q.Annotation, &a) // the query is optional
+	query := strings.TrimSpace(a.Query)
+	if query != "" && query != "upgrades" && query != "status" {
+		return nil, gears.Reply{Code: gears.CodeClientError,
+			Error: "unknown annotation query " + query + ", use upgrades or status"}
+	}
+	from, to := grafanaMs(q.Range.From), grafanaMs(q.Range.To)
+	if to == 0 {
+		to = math.MaxInt64
+	}
+	anns := make([]grafanaAnnotation, 0)
+	ann := func(at, endAt int64, title, text string, tags ...string) {
+		anns = append(anns, grafanaAnnotation{Annotation: q.Annotation, Time: at,
+			TimeEnd: endAt, Title: title, Text: text, Tags: tags})
+	}
+
+	if query != "status" {
+		sessions, err := db.ListUpgradeSessions(0, 0)
+		if err != nil {
+			return nil, gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+		}
+		for _, s := range sessions {
+			if s.Start > to || (s.EndAt != 0 && s.EndAt < from) {
+				continue
+			}
+			ann(s.Start, s.EndAt, fmt.Sprintf("Upgrade of %s %s", grafanaNode(s.Group, s.Node),
+				s.State), fmt.Sprintf("software %d to %d, %d chunks, %d retries",
+				s.FromSwId, s.SwId, s.Chunks, s.Retries), "upgrade", s.State)
+		}
+	}
+	if query != "upgrades" {
+		// only the last transition of each node is kept
+		statuses, err := db.ListNodeStatus()
+		if err != nil {
+			return nil, gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+		}
+		for _, s := range statuses {
+			if s.Since < from || s.Since > to {
+				continue
+			}
+			state := "offline"
+			if s.Online {
+				state = "online"
+			}
+			ann(s.Since, 0, fmt.Sprintf("%s went %s", grafanaNode(s.Group, s.Node), state),
+				fmt.Sprintf("%d packets, last heard %s", s.Packets,
+					time.Unix(0, s.LastSeen*1000000).Format(time.RFC3339)), "status", state)
+		}
+	}
+	sort.Sort(annotationsByTime(anns))
+	return anns, gears.Reply{Code: gears.CodeOK}
+}
+
+// grafanaNode returns the label of a node
+func grafanaNode(group, node byte) string {
+	ni, err := db.GetNodeInfo(group, node)
+	if err != nil {
+		ni = gears.NodeInfo{Group: group, Node: node}
+	}
+	return ni.Label()
+}
+
+type annotationsByTime []grafanaAnnotation
+
+func (a annotationsByTime) Len() int           { return len(a) }
+func (a annotationsByTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a annotationsByTime) Less(i, j int) bool { return a[i].Time < a[j].Time }
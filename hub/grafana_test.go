@@ -0,0 +1,184 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+package main
+
+// Omega: Alt+937
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tve/widuino/gears"
+	"github.com/tve/widuino/hub/database"
+)
+
+// grafanaTime formats milliseconds since the epoch the way Grafana sends times
+func grafanaTime(ms int64) string {
+	return time.Unix(0, ms*1000000).UTC().Format(time.RFC3339Nano)
+}
+
+//===== tests =====
+
+var _ = Describe("Grafana datasource", func() {
+	var dbDir string
+	var srv *httptest.Server
+
+	// post posts a request and returns the status and the body
+	post := func(path, body string) (int, string) {
+		resp, err := http.Post(srv.URL+"/grafana/"+path, "application/json",
+			strings.NewReader(body))
+		Ω(err).ShouldNot(HaveOccurred())
+		defer resp.Body.Close()
+		buf, err := ioutil.ReadAll(resp.Body)
+		Ω(err).ShouldNot(HaveOccurred())
+		return resp.StatusCode, strings.TrimSpace(string(buf))
+	}
+
+	// query posts a query for the targets from start to end and returns the series
+	query := func(start, end, interval int64, targets ...string) []grafanaSeries {
+		tt := make([]string, len(targets))
+		for i, t := range targets {
+			tt[i] = `{"target":"` + t + `","refId":"A","type":"timeserie"}`
+		}
+		status, body := post("query", fmt.Sprintf(
+			`{"range":{"from":"%s","to":"%s"},"intervalMs":%d,"maxDataPoints":100,"targets":[%s]}`,
+			grafanaTime(start), grafanaTime(end), interval, strings.Join(tt, ",")))
+		Ω(status).Should(Equal(http.StatusOK), body)
+		var series []struct {
+			Target     string
+			Datapoints [][2]*float64
+		}
+		Ω(json.Unmarshal([]byte(body), &series)).Should(Succeed())
+		res := make([]grafanaSeries, len(series))
+		for i, s := range series {
+			res[i].Target = s.Target
+			for _, p := range s.Datapoints {
+				gp := grafanaPoint{At: int64(*p[1])}
+				if p[0] != nil {
+					gp.Value = *p[0]
+				}
+				res[i].Datapoints = append(res[i].Datapoints, gp)
+			}
+		}
+		return res
+	}
+
+	BeforeEach(func() {
+		dbDir = fmt.Sprintf("/tmp/db-grafana-%d", os.Getpid())
+		var err error
+		db, err = database.Open(dbDir) // db is global defined in main.go
+		Ω(err).ShouldNot(HaveOccurred())
+		srv = httptest.NewServer(newHTTPMux(""))
+
+		// gauge ramping up by 1 per 100ms
+		db.PutSensorInfo("basement/temp0", gears.SensorInfo{Unit: "F"})
+		db.PutSensorInfo("attic/temp0", gears.SensorInfo{Unit: "F"})
+		for i := int64(0); i <= 20; i += 1 {
+			db.PutSensorValue("basement/temp0",
+				gears.SensorDataValue{At: 1000 + i*100, Value: float64(i)})
+		}
+	})
+
+	AfterEach(func() {
+		srv.Close()
+		db.Close()
+		os.RemoveAll(dbDir)
+	})
+
+	It("answers the connection test", func() {
+		resp, err := http.Get(srv.URL + "/grafana/")
+		Ω(err).ShouldNot(HaveOccurred())
+		resp.Body.Close()
+		Ω(resp.StatusCode).Should(Equal(http.StatusOK))
+	})
+
+	It("searches sensors", func() {
+		status, body := post("search", `{"target":"temp"}`)
+		Ω(status).Should(Equal(http.StatusOK))
+		Ω(body).Should(Equal(`["attic/temp0","basement/temp0"]`))
+		_, body = post("search", `{"target":"attic"}`)
+		Ω(body).Should(Equal(`["attic/temp0"]`))
+	})
+
+	It("returns avg, min, and max aligned to the interval", func() {
+		series := query(1250, 1850, 200, "basement/temp0")
+		Ω(series).Should(HaveLen(3))
+		Ω(series[0].Target).Should(Equal("basement/temp0:avg"))
+		Ω(series[1].Target).Should(Equal("basement/temp0:min"))
+		Ω(series[2].Target).Should(Equal("basement/temp0:max"))
+		for _, s := range series {
+			Ω(s.Datapoints).Should(HaveLen(4))
+			for i, p := range s.Datapoints {
+				Ω(p.At).Should(Equal(int64(1200 + i*200)))
+			}
+		}
+		for i := range series[0].Datapoints {
+			Ω(series[0].Datapoints[i].Value).Should(BeNumerically("~", float64(3+2*i)))
+			Ω(series[1].Datapoints[i].Value).Should(BeNumerically("<", series[0].Datapoints[i].Value))
+			Ω(series[2].Datapoints[i].Value).Should(BeNumerically(">", series[0].Datapoints[i].Value))
+		}
+	})
+
+	It("selects a statistic and limits the points", func() {
+		series := query(1000, 3000, 10, "basement/temp0:max")
+		Ω(series).Should(HaveLen(1))
+		Ω(series[0].Target).Should(Equal("basement/temp0:max"))
+		Ω(len(series[0].Datapoints)).Should(BeNumerically("<=", 101))
+	})
+
+	It("returns nulls where there is no data", func() {
+		_, body := post("query", fmt.Sprintf(
+			`{"range":{"from":"%s","to":"%s"},"intervalMs":500,"targets":[{"target":"basement/temp0:avg"}]}`,
+			grafanaTime(5000), grafanaTime(6000)))
+		Ω(body).Should(ContainSubstring("[null,6000]"))
+	})
+
+	It("rejects bad queries", func() {
+		status, body := post("query", fmt.Sprintf(
+			`{"range":{"from":"%s","to":"%s"},"intervalMs":500,"targets":[{"target":"nothing"}]}`,
+			grafanaTime(5000), grafanaTime(6000)))
+		Ω(status).Should(Equal(http.StatusBadRequest))
+		Ω(body).Should(Equal(`{"error":"unknown sensor nothing"}`))
+		status, _ = post("query", `{"targets":[{"target":"basement/temp0"}]}`)
+		Ω(status).Should(Equal(http.StatusBadRequest))
+	})
+
+	It("annotates upgrades and status changes", func() {
+		db.PutNodeInfo(gears.NodeInfo{Group: 212, Node: 3, Sketch: "heating",
+			Location: "basement"})
+		db.PutUpgradeSession(gears.UpgradeSession{Group: 212, Node: 3, FromSwId: 1, SwId: 2,
+			State: gears.UpgradeConfirmed, Start: 2000, EndAt: 3000})
+		db.PutUpgradeSession(gears.UpgradeSession{Group: 212, Node: 3, State: gears.UpgradeFailed,
+			Start: 9000, EndAt: 9500})
+		db.PutNodeStatus(gears.NodeStatus{Group: 212, Node: 4, Since: 2500})
+
+		var anns []grafanaAnnotation
+		req := `{"range":{"from":"%s","to":"%s"},"annotation":{"name":"x","query":"%s"}}`
+		status, body := post("annotations", fmt.Sprintf(req, grafanaTime(1000),
+			grafanaTime(5000), ""))
+		Ω(status).Should(Equal(http.StatusOK))
+		Ω(json.Unmarshal([]byte(body), &anns)).Should(Succeed())
+		Ω(anns).Should(HaveLen(2))
+		Ω(anns[0].Time).Should(Equal(int64(2000)))
+		Ω(anns[0].TimeEnd).Should(Equal(int64(3000)))
+		Ω(anns[0].Title).Should(Equal("Upgrade of basement/heating confirmed"))
+		Ω(anns[0].Tags).Should(Equal([]string{"upgrade", "confirmed"}))
+		Ω(string(anns[0].Annotation)).Should(Equal(`{"name":"x","query":""}`))
+		Ω(anns[1].Title).Should(Equal("RFg212i04 went offline"))
+
+		_, body = post("annotations", fmt.Sprintf(req, grafanaTime(1000), grafanaTime(5000),
+			"status"))
+		Ω(json.Unmarshal([]byte(body), &anns)).Should(Succeed())
+		Ω(anns).Should(HaveLen(1))
+		status, _ = post("annotations", fmt.Sprintf(req, grafanaTime(1000), grafanaTime(5000),
+			"bogus"))
+		Ω(status).Should(Equal(http.StatusBadRequest))
+	})
+})
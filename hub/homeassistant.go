@@ -0,0 +1,220 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+// Home Assistant MQTT discovery
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/tve/widuino/gears"
+	"github.com/tve/widuino/hub/database"
+)
+
+// Home Assistant finds the hub's sensors through MQTT discovery: for each sensor in the
+// database the hub publishes a retained config message on
+// <Prefix>/<component>/widuino/<object id>/config with the sensor's name, unit, and state
+// topic, <Topic>/state/<sensor name>, where each new value of the sensor gets published.
+// Sensors that report the state of an output, i.e., OwRelay switches and SlowServo positions,
+// also get a command topic, <Topic>/set/<sensor name>, and the values published there are
+// sent to the node over RF. The sensors of a node make up one Home Assistant device.
+
+// Default topic prefixes
+const (
+	DefaultHAPrefix = "homeassistant"
+	DefaultHATopic  = "widuino"
+)
+
+type HomeAssistant struct {
+	Prefix  string // discovery prefix Home Assistant listens to
+	Topic   string // prefix of the state and command topics
+	bridge  *MQTTBridge
+	db      *database.DB
+	mutex   sync.Mutex
+	sensors map[string]*haSensor // announced sensors by name
+}
+
+type haSensor struct {
+	info   gears.SensorInfo
+	values chan gears.SensorDataValue // subscription to the sensor's values
+}
+
+// haConfig is the payload of discovery config messages
+type haConfig struct {
+	Name         string   `json:"name"`
+	UniqueId     string   `json:"unique_id"`
+	StateTopic   string   `json:"state_topic"`
+	CommandTopic string   `json:"command_topic,omitempty"`
+	Unit         string   `json:"unit_of_measurement,omitempty"`
+	DeviceClass  string   `json:"device_class,omitempty"`
+	StateClass   string   `json:"state_class,omitempty"`
+	PayloadOn    string   `json:"payload_on,omitempty"`
+	PayloadOff   string   `json:"payload_off,omitempty"`
+	Min          *float64 `json:"min,omitempty"`
+	Max          *float64 `json:"max,omitempty"`
+	Device       haDevice `json:"device"`
+}
+
+type haDevice struct {
+	Identifiers []string `json:"identifiers"`
+	Name        string   `json:"name"`
+}
+
+// Home Assistant's unit and device class for the units of the decoders and the node map
+var haUnits = map[string][2]string{
+	"F": {"°F", "temperature"}, "degF": {"°F", "temperature"},
+	"C": {"°C", "temperature"}, "degC": {"°C", "temperature"},
+	"V": {"V", "voltage"}, "mV": {"mV", "voltage"},
+	"deg": {"°", ""},
+}
+
+// range of SlowServo positions in degrees
+var haMinPosition, haMaxPosition = 0.0, 180.0
+
+var haIdRE = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+func newHomeAssistant(bridge *MQTTBridge, db *database.DB) *HomeAssistant {
+	return &HomeAssistant{Prefix: DefaultHAPrefix, Topic: DefaultHATopic, bridge: bridge,
+		db: db, sensors: make(map[string]*haSensor)}
+}
+
+// Start announces the sensors each time the bridge connects and handles the commands, it
+// must be called before the bridge starts
+func (ha *HomeAssistant) Start() {
+	ha.bridge.Subscribe(ha.Topic+"/set/#", ha.handleSet)
+	ha.bridge.OnConnect(ha.announceAll)
+}
+
+// Close stops publishing sensor values
+func (ha *HomeAssistant) Close() {
+	ha.mutex.Lock()
+	defer ha.mutex.Unlock()
+	for name, s := range ha.sensors {
+		ha.db.SensorUnsubscribe(s.values)
+		delete(ha.sensors, name)
+	}
+}
+
+// Seen announces the sensors that are new or whose info changed, it's a sensor hook
+func (ha *HomeAssistant) Seen(name string, info gears.SensorInfo, v gears.SensorDataValue) {
+	ha.mutex.Lock()
+	s := ha.sensors[name]
+	known := s != nil && s.info == info
+	ha.mutex.Unlock()
+	if !known {
+		ha.announce(name, info, v.At)
+	}
+}
+
+// announceAll announces all the sensors in the database, the broker may have lost them
+func (ha *HomeAssistant) announceAll() {
+	infos, err := ha.db.ListSensorInfo()
+	if err != nil {
+		glog.Errorf("Cannot list sensors: %s", err.Error())
+		return
+	}
+	for name, info := range infos {
+		ha.announce(name, info, 0)
+	}
+	glog.Infof("Announced %d sensors to Home Assistant", len(infos))
+}
+
+// announce publishes the config of a sensor and, if it's new, starts publishing its values
+// from the given time in milliseconds, or from its last value if zero
+func (ha *HomeAssistant) announce(name string, info gears.SensorInfo, at int64) {
+	ha.mutex.Lock()
+	defer ha.mutex.Unlock()
+	s := ha.sensors[name]
+	if s == nil {
+		if at == 0 {
+			at = time.Now().UnixNano() / 1000000
+			if v, err := ha.db.SensorLast(name); err == nil {
+				at = v.At
+			}
+		}
+		s = &haSensor{values: ha.db.SensorSubscribe(name, at)}
+		ha.sensors[name] = s
+		go ha.forward(name, s.values)
+	}
+	s.info = info
+	component, config := ha.config(name, info)
+	id := haIdRE.ReplaceAllString(name, "_")
+	ha.bridge.publish(ha.Prefix+"/"+component+"/widuino/"+id+"/config", true, config)
+}
+
+// forward publishes the values of a sensor until it gets unsubscribed
+func (ha *HomeAssistant) forward(name string, values chan gears.SensorDataValue) {
+	for v := range values {
+		ha.bridge.publish(ha.Topic+"/state/"+name, true, v.Value)
+	}
+}
+
+// config returns the Home Assistant component and the config for a sensor
+func (ha *HomeAssistant) config(name string, info gears.SensorInfo) (string, haConfig) {
+	label, reading := "", name
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		label, reading = name[:i], name[i+1:]
+	}
+	c := haConfig{Name: reading, UniqueId: "widuino_" + haIdRE.ReplaceAllString(name, "_"),
+		StateTopic: ha.Topic + "/state/" + name, Unit: info.Unit,
+		Device: haDevice{Identifiers: []string{"widuino_" + haIdRE.ReplaceAllString(label, "_")},
+			Name: label}}
+	if u, ok := haUnits[info.Unit]; ok {
+		c.Unit, c.DeviceClass = u[0], u[1]
+	}
+
+	switch info.Output.Type {
+	case gears.OutputSwitch:
+		c.CommandTopic = ha.Topic + "/set/" + name
+		c.PayloadOn, c.PayloadOff = "1", "0"
+		c.Unit, c.DeviceClass = "", ""
+		return "switch", c
+	case gears.OutputPosition:
+		c.CommandTopic = ha.Topic + "/set/" + name
+		c.Min, c.Max = &haMinPosition, &haMaxPosition
+		c.DeviceClass = ""
+		return "number", c
+	}
+	if !info.Rate {
+		c.StateClass = "measurement"
+	}
+	return "sensor", c
+}
+
+// handleSet sends the value published on the command topic of an output to its node
+func (ha *HomeAssistant) handleSet(topic string, payload []byte) {
+	name := strings.TrimPrefix(topic, ha.Topic+"/set/")
+	ha.mutex.Lock()
+	var out gears.SensorOutput
+	if s := ha.sensors[name]; s != nil {
+		out = s.info.Output
+	}
+	ha.mutex.Unlock()
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(string(payload)), 64)
+	switch {
+	case out.Type == "":
+		glog.Warningf("Home Assistant set %s: not an output", name)
+		return
+	case err != nil:
+		glog.Warningf("Home Assistant set %s: %s", name, err.Error())
+		return
+	case out.Type == gears.OutputSwitch && value != 0 && value != 1,
+		out.Type == gears.OutputPosition && (value < haMinPosition || value > haMaxPosition):
+		glog.Warningf("Home Assistant set %s: invalid value %s", name, string(payload))
+		return
+	}
+
+	m := gears.RFMessage{At: time.Now().UnixNano() / 1000000, Group: out.Group, Node: out.Node,
+		DoAck: true, Kind: out.Kind, Data: []byte{out.Index, byte(value)}}
+	glog.Infof("Home Assistant set %s to %v", name, value)
+	go func() {
+		if err := ha.bridge.Send(m); err != nil {
+			glog.Warningf("Cannot set %s: %s", name, err.Error())
+		}
+	}()
+}
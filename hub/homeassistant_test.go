@@ -0,0 +1,149 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+package main
+
+// Omega: Alt+937
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tve/widuino/gears"
+	"github.com/tve/widuino/hub/database"
+)
+
+//===== tests =====
+
+var _ = Describe("HomeAssistant", func() {
+	var dbDir string
+	var tb *testBroker
+	var b *MQTTBridge
+	var ha *HomeAssistant
+	var sent chan gears.RFMessage
+	relay := gears.SensorInfo{Output: gears.SensorOutput{Type: gears.OutputSwitch,
+		Group: 212, Node: 3, Kind: OWRELAY_MODULE, Index: 1}}
+	servo := gears.SensorInfo{Unit: "deg", Output: gears.SensorOutput{
+		Type: gears.OutputPosition, Group: 212, Node: 4, Kind: SLOWSERVO_MODULE}}
+
+	// published collects the messages published to the broker by topic until it has n
+	published := func(n int) map[string]string {
+		msgs := make(map[string]string)
+		timeout := time.After(time.Second)
+		for len(msgs) < n {
+			select {
+			case p := <-tb.Published:
+				Ω(p.Retain).Should(BeTrue())
+				msgs[p.TopicName] = string(p.Payload)
+			case <-timeout:
+				Fail(fmt.Sprintf("got only %d messages: %v", len(msgs), msgs))
+			}
+		}
+		return msgs
+	}
+
+	BeforeEach(func() {
+		dbDir = fmt.Sprintf("/tmp/db-ha-%d", os.Getpid())
+		var err error
+		db, err = database.Open(dbDir) // db is global defined in main.go
+		Ω(err).ShouldNot(HaveOccurred())
+		db.PutSensorInfo("basement/heating/temp0", gears.SensorInfo{Unit: "F"})
+		db.PutSensorValue("basement/heating/temp0", gears.SensorDataValue{At: 1000, Value: 70})
+		db.PutSensorInfo("basement/heating/relay1", relay)
+		db.PutSensorValue("basement/heating/relay1", gears.SensorDataValue{At: 1000, Value: 1})
+
+		tb, err = startTestBroker("127.0.0.1:0")
+		Ω(err).ShouldNot(HaveOccurred())
+		sent = make(chan gears.RFMessage, 10)
+		b = &MQTTBridge{Broker: "tcp://" + tb.Addr(), ClientId: "test",
+			Send: func(m gears.RFMessage) error { sent <- m; return nil }}
+		ha = newHomeAssistant(b, db)
+		ha.Start()
+		b.Start()
+	})
+
+	AfterEach(func() {
+		b.Close()
+		ha.Close()
+		tb.Close()
+		db.Close()
+		os.RemoveAll(dbDir)
+	})
+
+	It("announces the sensors in the database", func() {
+		msgs := published(4)
+		Ω(msgs).Should(HaveKey("homeassistant/sensor/widuino/basement_heating_temp0/config"))
+		var c haConfig
+		Ω(json.Unmarshal(
+			[]byte(msgs["homeassistant/sensor/widuino/basement_heating_temp0/config"]), &c)).
+			Should(Succeed())
+		Ω(c).Should(Equal(haConfig{Name: "temp0", UniqueId: "widuino_basement_heating_temp0",
+			StateTopic: "widuino/state/basement/heating/temp0", Unit: "°F",
+			DeviceClass: "temperature", StateClass: "measurement",
+			Device: haDevice{[]string{"widuino_basement_heating"}, "basement/heating"}}))
+		Ω(msgs["widuino/state/basement/heating/temp0"]).Should(Equal("70"))
+
+		Ω(json.Unmarshal(
+			[]byte(msgs["homeassistant/switch/widuino/basement_heating_relay1/config"]), &c)).
+			Should(Succeed())
+		Ω(c.CommandTopic).Should(Equal("widuino/set/basement/heating/relay1"))
+		Ω(c.PayloadOn).Should(Equal("1"))
+		Ω(msgs["widuino/state/basement/heating/relay1"]).Should(Equal("1"))
+	})
+
+	It("publishes new values", func() {
+		published(4)
+		db.PutSensorValue("basement/heating/temp0", gears.SensorDataValue{At: 2000, Value: 71.5})
+		Ω(published(1)).Should(Equal(map[string]string{
+			"widuino/state/basement/heating/temp0": "71.5"}))
+	})
+
+	It("announces new sensors", func() {
+		published(4)
+		db.PutSensorInfo("attic/vent/servo0", servo)
+		db.PutSensorValue("attic/vent/servo0", gears.SensorDataValue{At: 3000, Value: 90})
+		ha.Seen("attic/vent/servo0", servo, gears.SensorDataValue{At: 3000, Value: 90})
+		msgs := published(2)
+		Ω(msgs["widuino/state/attic/vent/servo0"]).Should(Equal("90"))
+		var c haConfig
+		Ω(json.Unmarshal([]byte(msgs["homeassistant/number/widuino/attic_vent_servo0/config"]),
+			&c)).Should(Succeed())
+		Ω(c.CommandTopic).Should(Equal("widuino/set/attic/vent/servo0"))
+		Ω(*c.Min).Should(Equal(0.0))
+		Ω(*c.Max).Should(Equal(180.0))
+		Ω(c.Unit).Should(Equal("°"))
+
+		// nothing changed, nothing to announce
+		ha.Seen("attic/vent/servo0", servo, gears.SensorDataValue{At: 4000, Value: 90})
+		Consistently(tb.Published).ShouldNot(Receive())
+	})
+
+	It("sends commands to the outputs", func() {
+		published(4)
+		ha.Seen("attic/vent/servo0", servo, gears.SensorDataValue{At: 3000, Value: 90})
+		published(1)
+		tb.Publish("widuino/set/basement/heating/relay1", 0, []byte("0"))
+		m := <-sent
+		Ω(m.Group).Should(Equal(byte(212)))
+		Ω(m.Node).Should(Equal(byte(3)))
+		Ω(m.Kind).Should(Equal(byte(OWRELAY_MODULE)))
+		Ω(m.Data).Should(Equal([]byte{1, 0}))
+		Ω(m.DoAck).Should(BeTrue())
+		tb.Publish("widuino/set/attic/vent/servo0", 0, []byte("45"))
+		m = <-sent
+		Ω(m.Node).Should(Equal(byte(4)))
+		Ω(m.Kind).Should(Equal(byte(SLOWSERVO_MODULE)))
+		Ω(m.Data).Should(Equal([]byte{0, 45}))
+	})
+
+	It("ignores invalid commands", func() {
+		published(4)
+		tb.Publish("widuino/set/basement/heating/relay1", 0, []byte("2"))
+		tb.Publish("widuino/set/basement/heating/relay1", 0, []byte("on"))
+		tb.Publish("widuino/set/basement/heating/temp0", 0, []byte("1"))
+		tb.Publish("widuino/set/basement/heating/nothing", 0, []byte("1"))
+		Consistently(sent).ShouldNot(Receive())
+	})
+})
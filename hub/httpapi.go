@@ -0,0 +1,377 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+// HTTP/JSON API
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/tve/widuino/gears"
+	"github.com/tve/widuino/hub/database"
+)
+
+// The HTTP API makes the requests of the libchan API available to shell scripts and web
+// pages. Request bodies and responses are the JSON encoding of the gears types, times are in
+// milliseconds since the epoch and negative times in queries are relative to now. Errors
+// come back as {"error": "..."} with a 4xx or 5xx status. The routes are:
+//
+//	GET    /sensors                               names and info of all sensors
+//	GET    /sensors/info/<name>                   info of a sensor
+//	GET    /sensors/raw/<name>?start=&end=        raw values, plus one on either side
+//	GET    /sensors/read/<name>?start=&end=&step= values interpolated every step, null if none
+//	GET    /rf?start=&end=                        received RF messages, at most httpMaxRF
+//	POST   /rf                                    send an RFMessage
+//	GET    /params?prefix=                        params whose name starts with prefix
+//	GET    /params/<name>                         value of a param
+//	PUT    /params/<name>                         set a param, the body is a ParamReply
+//	DELETE /params?prefix=                        delete params whose name starts with prefix
+//	GET    /nodes/status                          online/offline status of all nodes
+//	GET    /boot/status                           state of the boot config
+//
+// The routes that stream RF messages and sensor values are in httpstream.go, the Grafana
+// datasource is in grafana.go. Cross-origin requests are only allowed from the origin given to
+// ServeHTTP, so pages served from elsewhere can use the API, and the requests that change
+// something must have a JSON content type, which browsers don't send cross-origin without
+// asking first, so other pages can't forge them.
+
+const DefaultHTTPAddr = "localhost:9380"
+
+const httpMaxRF = 10000     // RF messages returned at most, page using the At of the last one
+const httpMaxBody = 1 << 16 // largest request body accepted
+
+// httpFunc handles the requests for a route, arg is the part of the path after the route's
+// prefix, it returns the value to send back on success, nil for no content, or an httpStream
+type httpFunc func(r *http.Request, arg string) (interface{}, gears.Reply)
+
+// httpRoute dispatches the requests for a path prefix by method
+type httpRoute struct {
+	prefix  string
+	methods map[string]httpFunc
+}
+
+// httpHandler serves a route, allowing cross-origin requests from origin unless it's empty
+type httpHandler struct {
+	httpRoute
+	origin string
+}
+
+type httpError struct {
+	Error string `json:"error"`
+}
+
+// httpValue is a sensor value that encodes as null where there is no data, i.e., where the
+// interpolated value is NaN, which JSON can't represent
+type httpValue gears.SensorDataValue
+
+// ServeHTTP accepts HTTP connections on the listener and serves the API, allowing
+// cross-origin requests from origin, which may be "*" for any
+func ServeHTTP(listener net.Listener, origin string) {
+	err := http.Serve(listener, newHTTPMux(origin))
+	glog.Infof("Done serving HTTP connections: %s", err.Error())
+}
+
+func newHTTPMux(origin string) *http.ServeMux {
+	mux := http.NewServeMux()
+	routes := []httpRoute{
+		{"/sensors", map[string]httpFunc{"GET": httpSensorList}},
+		{"/sensors/info/", map[string]httpFunc{"GET": httpSensorInfo}},
+		{"/sensors/raw/", map[string]httpFunc{"GET": httpSensorRaw}},
+		{"/sensors/read/", map[string]httpFunc{"GET": httpSensorRead}},
+		{"/sensors/actions/subscribe", map[string]httpFunc{"GET": httpSensorSubscribe}},
+		{"/rf", map[string]httpFunc{"GET": httpRFList, "POST": httpRFSend}},
+		{"/rf/actions/subscribe", map[string]httpFunc{"GET": httpRFSubscribe}},
+		{"/params", map[string]httpFunc{"GET": httpParamList, "DELETE": httpParamDel}},
+		{"/params/", map[string]httpFunc{"GET": httpParamGet, "PUT": httpParamPut}},
+		{"/nodes/status", map[string]httpFunc{"GET": httpNodeStatusList}},
+		{"/boot/status", map[string]httpFunc{"GET": httpBootStatus}},
+	}
+	routes = append(routes, grafanaRoutes()...)
+	for _, rt := range routes {
+		mux.Handle(rt.prefix, httpHandler{rt, origin})
+	}
+	return mux
+}
+
+func (rt httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	glog.V(1).Infof("HTTP %s %s", r.Method, r.URL)
+	methods := make([]string, 0, len(rt.methods)+1)
+	for m := range rt.methods {
+		methods = append(methods, m)
+	}
+	methods = append(methods, "OPTIONS")
+	sort.Strings(methods)
+	allow := strings.Join(methods, ", ")
+	if rt.origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", rt.origin)
+	}
+
+	f := rt.methods[r.Method]
+	switch {
+	case r.Method == "OPTIONS":
+		w.Header().Set("Allow", allow)
+		w.Header().Set("Access-Control-Allow-Methods", allow)
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case f == nil:
+		w.Header().Set("Allow", allow)
+		writeJSON(w, http.StatusMethodNotAllowed,
+			httpError{fmt.Sprintf("%s not allowed, use %s", r.Method, allow)})
+		return
+	case r.Method != "GET" && !httpIsJSON(r):
+		writeJSON(w, http.StatusUnsupportedMediaType,
+			httpError{"Content-Type must be application/json"})
+		return
+	}
+
+	v, rep := f(r, strings.TrimPrefix(r.URL.Path, rt.prefix))
+	s, stream := v.(httpStream)
+	switch {
+	case rep.Code != gears.CodeOK:
+		glog.Infof("HTTP %s %s: %s", r.Method, r.URL.Path, rep.Error)
+		writeJSON(w, httpStatus(rep), httpError{rep.Error})
+	case stream:
+		serveEvents(w, r, s)
+	case v == nil:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSON(w, http.StatusOK, v)
+	}
+}
+
+// httpStatus maps the code of a failed reply to an HTTP status
+func httpStatus(rep gears.Reply) int {
+	switch rep.Code {
+	case gears.CodeClientError:
+		if rep.Error == database.ErrNotFound.Error() {
+			return http.StatusNotFound
+		}
+		return http.StatusBadRequest
+	case gears.CodeAckTimeout:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		glog.Errorf("Cannot encode HTTP response: %s", err.Error())
+		status = http.StatusInternalServerError
+		buf, _ = json.Marshal(httpError{err.Error()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(buf, '\n'))
+}
+
+// httpIsJSON tells whether the body of a request is JSON according to its content type
+func httpIsJSON(r *http.Request) bool {
+	t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && t == "application/json"
+}
+
+// readJSON decodes the body of a request into v
+func readJSON(r *http.Request, v interface{}) *gears.Reply {
+	err := json.NewDecoder(io.LimitReader(r.Body, httpMaxBody)).Decode(v)
+	if err != nil {
+		return &gears.Reply{Code: gears.CodeClientError,
+			Error: "cannot parse body: " + err.Error()}
+	}
+	return nil
+}
+
+// httpTime parses a time query parameter, it returns def if the parameter is missing
+func httpTime(q url.Values, key string, def int64) (int64, *gears.Reply) {
+	s := q.Get(key)
+	if s == "" {
+		return def, nil
+	}
+	t, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, &gears.Reply{Code: gears.CodeClientError, Error: "bad " + key + ": " + s}
+	}
+	if t < 0 {
+		t += time.Now().UnixNano() / 1000000
+	}
+	return t, nil
+}
+
+// httpRange parses the start and end query parameters, start is required and end defaults
+// to now
+func httpRange(q url.Values) (start, end int64, rep *gears.Reply) {
+	if start, rep = httpTime(q, "start", 0); rep != nil {
+		return
+	}
+	if start <= 0 {
+		return 0, 0, &gears.Reply{Code: gears.CodeClientError, Error: "start is required"}
+	}
+	end, rep = httpTime(q, "end", time.Now().UnixNano()/1000000)
+	return
+}
+
+//===== Sensors
+
+func httpSensorList(r *http.Request, arg string) (interface{}, gears.Reply) {
+	infos, err := db.ListSensorInfo()
+	if err != nil {
+		return nil, gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+	}
+	return infos, gears.Reply{Code: gears.CodeOK}
+}
+
+func httpSensorInfo(r *http.Request, name string) (interface{}, gears.Reply) {
+	rep := HandleSensorInfoRequest(&gears.SensorInfoRequest{Name: name})
+	return rep.SI, rep
+}
+
+func httpSensorRaw(r *http.Request, name string) (interface{}, gears.Reply) {
+	start, end, rep := httpRange(r.URL.Query())
+	if rep != nil {
+		return nil, *rep
+	}
+	info := HandleSensorInfoRequest(&gears.SensorInfoRequest{Name: name})
+	if info.Code != gears.CodeOK {
+		return nil, info
+	}
+	values, err := db.SensorReadRaw(name, start, end)
+	if err != nil {
+		return nil, gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+	}
+	return values, gears.Reply{Code: gears.CodeOK}
+}
+
+// httpSensorRead is the HTTP version of HandleSensorReadRequest, it returns the values instead
+// of sending them on a channel
+func httpSensorRead(r *http.Request, name string) (interface{}, gears.Reply) {
+	q := r.URL.Query()
+	start, end, rep := httpRange(q)
+	if rep != nil {
+		return nil, *rep
+	}
+	step, err := strconv.ParseInt(q.Get("step"), 10, 64)
+	if err != nil {
+		return nil, gears.Reply{Code: gears.CodeClientError, Error: "bad step: " + q.Get("step")}
+	}
+	if step > 1 && end > start {
+		// let the range end on a step so clients can pass in now as the end
+		end -= (end - start) % step
+	}
+	if e := checkSensorRead(start, end, step); e != "" {
+		return nil, gears.Reply{Code: gears.CodeClientError, Error: e}
+	}
+	info := HandleSensorInfoRequest(&gears.SensorInfoRequest{Name: name})
+	if info.Code != gears.CodeOK {
+		return nil, info
+	}
+	values, err := sensorRead(name, start, end, step)
+	if err != nil {
+		return nil, gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+	}
+	hv := make([]httpValue, len(values))
+	for i, v := range values {
+		hv[i] = httpValue(v)
+	}
+	return hv, gears.Reply{Code: gears.CodeOK}
+}
+
+func (v httpValue) MarshalJSON() ([]byte, error) {
+	if math.IsNaN(v.Value) || math.IsInf(v.Value, 0) {
+		return []byte(fmt.Sprintf(`{"At":%d,"Value":null}`, v.At)), nil
+	}
+	return json.Marshal(gears.SensorDataValue(v))
+}
+
+//===== RF messages
+
+func httpRFList(r *http.Request, arg string) (interface{}, gears.Reply) {
+	start, end, rep := httpRange(r.URL.Query())
+	if rep != nil {
+		return nil, *rep
+	}
+	msgs := make([]gears.RFMessage, 0)
+	err := db.RFIterate(start, end, func(m gears.RFMessage) error {
+		msgs = append(msgs, m)
+		if len(msgs) >= httpMaxRF {
+			return io.EOF
+		}
+		return nil
+	})
+	if err != nil && err != io.EOF {
+		return nil, gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+	}
+	return msgs, gears.Reply{Code: gears.CodeOK}
+}
+
+// httpRFSend sends an RF message, it returns the mail status if the message is held for a
+// sleeping node
+func httpRFSend(r *http.Request, arg string) (interface{}, gears.Reply) {
+	var req gears.RFSendRequest
+	if rep := readJSON(r, &req); rep != nil {
+		return nil, *rep
+	}
+	if req.Node > 31 {
+		return nil, gears.Reply{Code: gears.CodeClientError,
+			Error: fmt.Sprintf("invalid node %d", req.Node)}
+	}
+	if req.At == 0 {
+		req.At = time.Now().UnixNano() / 1000000
+	}
+	rep := HandleRFSendRequest(&req)
+	if rep.MS != nil {
+		return rep.MS, rep
+	}
+	return nil, rep
+}
+
+//===== Params
+
+func httpParamList(r *http.Request, arg string) (interface{}, gears.Reply) {
+	rep := HandleParamListRequest(&gears.ParamListRequest{Prefix: r.URL.Query().Get("prefix")})
+	if rep.PL == nil {
+		return nil, rep
+	}
+	return rep.PL.Params, rep
+}
+
+func httpParamDel(r *http.Request, arg string) (interface{}, gears.Reply) {
+	prefix := r.URL.Query().Get("prefix")
+	return nil, HandleParamDelRequest(&gears.ParamDelRequest{Prefix: prefix})
+}
+
+func httpParamGet(r *http.Request, name string) (interface{}, gears.Reply) {
+	rep := HandleParamGetRequest(&gears.ParamGetRequest{Name: name})
+	return rep.PG, rep
+}
+
+func httpParamPut(r *http.Request, name string) (interface{}, gears.Reply) {
+	var p gears.ParamReply
+	if rep := readJSON(r, &p); rep != nil {
+		return nil, *rep
+	}
+	return nil, HandleParamPutRequest(&gears.ParamPutRequest{Name: name, Value: p.Value})
+}
+
+//===== Nodes and boot
+
+func httpNodeStatusList(r *http.Request, arg string) (interface{}, gears.Reply) {
+	rep := HandleNodeStatusListRequest(&gears.NodeStatusListRequest{})
+	return rep.NSL, rep
+}
+
+func httpBootStatus(r *http.Request, arg string) (interface{}, gears.Reply) {
+	rep := HandleBootStatusRequest(&gears.BootStatusRequest{})
+	return rep.BS, rep
+}
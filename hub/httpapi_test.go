@@ -0,0 +1,219 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+package main
+
+// Omega: Alt+937
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tve/widuino/gears"
+	"github.com/tve/widuino/hub/database"
+)
+
+//===== tests =====
+
+var _ = Describe("HTTP API", func() {
+	var dbDir string
+	var srv *httptest.Server
+
+	// do makes a request and returns the status and the body
+	do := func(method, path, body string) (int, string) {
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		Ω(err).ShouldNot(HaveOccurred())
+		if method != "GET" {
+			req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer resp.Body.Close()
+		buf, err := ioutil.ReadAll(resp.Body)
+		Ω(err).ShouldNot(HaveOccurred())
+		return resp.StatusCode, strings.TrimSpace(string(buf))
+	}
+
+	// get makes a GET request that must succeed and decodes the response into v
+	get := func(path string, v interface{}) {
+		status, body := do("GET", path, "")
+		Ω(status).Should(Equal(http.StatusOK), body)
+		Ω(json.Unmarshal([]byte(body), v)).Should(Succeed())
+	}
+
+	BeforeEach(func() {
+		dbDir = fmt.Sprintf("/tmp/db-http-%d", os.Getpid())
+		var err error
+		db, err = database.Open(dbDir) // db is global defined in main.go
+		Ω(err).ShouldNot(HaveOccurred())
+		srv = httptest.NewServer(newHTTPMux("http://dash.example.com"))
+	})
+
+	AfterEach(func() {
+		srv.Close()
+		db.Close()
+		os.RemoveAll(dbDir)
+	})
+
+	Describe("sensors", func() {
+		BeforeEach(func() {
+			db.PutSensorInfo("basement/heating/temp0", gears.SensorInfo{Unit: "F"})
+			for i := int64(0); i <= 20; i += 1 {
+				db.PutSensorValue("basement/heating/temp0",
+					gears.SensorDataValue{At: 1000 + i*100, Value: float64(i)})
+			}
+		})
+
+		It("lists sensors", func() {
+			var infos map[string]gears.SensorInfo
+			get("/sensors", &infos)
+			Ω(infos).Should(Equal(map[string]gears.SensorInfo{
+				"basement/heating/temp0": {Unit: "F"}}))
+			var info gears.SensorInfo
+			get("/sensors/info/basement/heating/temp0", &info)
+			Ω(info.Unit).Should(Equal("F"))
+			status, body := do("GET", "/sensors/info/basement/heating/nothing", "")
+			Ω(status).Should(Equal(http.StatusNotFound))
+			Ω(body).Should(Equal(`{"error":"key not found"}`))
+		})
+
+		It("reads raw values", func() {
+			var values []gears.SensorDataValue
+			get("/sensors/raw/basement/heating/temp0?start=1250&end=1400", &values)
+			Ω(values).Should(Equal([]gears.SensorDataValue{
+				{At: 1200, Value: 2}, {At: 1300, Value: 3}, {At: 1400, Value: 4},
+				{At: 1500, Value: 5}}))
+			status, _ := do("GET", "/sensors/raw/basement/heating/temp0?end=1400", "")
+			Ω(status).Should(Equal(http.StatusBadRequest))
+			status, _ = do("GET", "/sensors/raw/nothing?start=1000", "")
+			Ω(status).Should(Equal(http.StatusNotFound))
+		})
+
+		It("reads interpolated values", func() {
+			var values []gears.SensorDataValue
+			get("/sensors/read/basement/heating/temp0?start=1200&end=1850&step=200", &values)
+			Ω(values).Should(HaveLen(4))
+			Ω(values[3].At).Should(Equal(int64(1800)))
+			Ω(values[3].Value).Should(BeNumerically("~", 9))
+			status, body := do("GET", "/sensors/read/basement/heating/temp0?start=1200&step=1", "")
+			Ω(status).Should(Equal(http.StatusBadRequest))
+			Ω(body).Should(ContainSubstring("step"))
+		})
+
+		It("reads nulls where there is no data", func() {
+			status, body := do("GET",
+				"/sensors/read/basement/heating/temp0?start=5000&end=6000&step=500", "")
+			Ω(status).Should(Equal(http.StatusOK), body)
+			Ω(body).Should(HavePrefix(`[{"At":5000,"Value":null},`))
+			var values []struct {
+				At    int64
+				Value *float64
+			}
+			Ω(json.Unmarshal([]byte(body), &values)).Should(Succeed())
+			Ω(values).Should(HaveLen(3))
+			for _, v := range values {
+				Ω(v.Value).Should(BeNil())
+			}
+		})
+	})
+
+	It("lists RF messages", func() {
+		for i := int64(1); i <= 3; i++ {
+			db.PutRFMessage(gears.RFMessage{At: i * 1000, Group: 212, Node: 3, Kind: 4,
+				Data: []byte{byte(i)}})
+		}
+		var msgs []gears.RFMessage
+		get("/rf?start=2000", &msgs)
+		Ω(msgs).Should(HaveLen(2))
+		Ω(msgs[0].Data).Should(Equal([]byte{2}))
+	})
+
+	It("sends RF messages", func() {
+		xmitChan = make(chan XmitRequest, 1)
+		defer func() { xmitChan = nil }()
+		sent := make(chan gears.RFMessage, 1)
+		go func() {
+			x := <-xmitChan
+			sent <- x.Msg
+			x.Reply <- gears.AckTimeoutError
+		}()
+		status, body := do("POST", "/rf",
+			`{"Group":212,"Node":3,"DoAck":true,"Kind":7,"Data":"AQI="}`)
+		Ω(status).Should(Equal(http.StatusGatewayTimeout))
+		Ω(body).Should(Equal(`{"error":"ACK timeout"}`))
+		m := <-sent
+		Ω(m.Node).Should(Equal(byte(3)))
+		Ω(m.Data).Should(Equal([]byte{1, 2}))
+		Ω(m.DoAck).Should(BeTrue())
+		Ω(m.At).ShouldNot(BeZero())
+
+		status, _ = do("POST", "/rf", `{"Node":40}`)
+		Ω(status).Should(Equal(http.StatusBadRequest))
+		status, _ = do("POST", "/rf", `{"Node":`)
+		Ω(status).Should(Equal(http.StatusBadRequest))
+	})
+
+	It("manages params", func() {
+		status, _ := do("PUT", "/params/a/b", `{"Value":"42"}`)
+		Ω(status).Should(Equal(http.StatusNoContent))
+		do("PUT", "/params/a/c", `{"Value":"43"}`)
+		var p gears.ParamReply
+		get("/params/a/b", &p)
+		Ω(p.Value).Should(Equal("42"))
+		var params map[string]string
+		get("/params?prefix=a/", &params)
+		Ω(params).Should(Equal(map[string]string{"a/b": "42", "a/c": "43"}))
+
+		status, _ = do("DELETE", "/params", "")
+		Ω(status).Should(Equal(http.StatusBadRequest))
+		status, _ = do("DELETE", "/params?prefix=a/c", "")
+		Ω(status).Should(Equal(http.StatusNoContent))
+		status, _ = do("GET", "/params/a/c", "")
+		Ω(status).Should(Equal(http.StatusNotFound))
+	})
+
+	It("reports node and boot status", func() {
+		status, body := do("GET", "/boot/status", "")
+		Ω(status).Should(Equal(http.StatusInternalServerError))
+		Ω(body).Should(ContainSubstring("not running"))
+
+		liveness = newLivenessTracker(db)
+		defer func() { liveness = nil }()
+		var statuses []gears.NodeStatus
+		get("/nodes/status", &statuses)
+		Ω(statuses).Should(BeEmpty())
+	})
+
+	It("checks methods", func() {
+		status, _ := do("DELETE", "/sensors", "")
+		Ω(status).Should(Equal(http.StatusMethodNotAllowed))
+		req, _ := http.NewRequest("OPTIONS", srv.URL+"/params/x", nil)
+		resp, err := http.DefaultClient.Do(req)
+		Ω(err).ShouldNot(HaveOccurred())
+		resp.Body.Close()
+		Ω(resp.StatusCode).Should(Equal(http.StatusNoContent))
+		Ω(resp.Header.Get("Allow")).Should(Equal("GET, OPTIONS, PUT"))
+		Ω(resp.Header.Get("Access-Control-Allow-Origin")).Should(Equal("http://dash.example.com"))
+	})
+
+	It("requires JSON for changes", func() {
+		for _, ct := range []string{"", "text/plain", "application/x-www-form-urlencoded"} {
+			req, _ := http.NewRequest("PUT", srv.URL+"/params/a/b",
+				strings.NewReader(`{"Value":"42"}`))
+			if ct != "" {
+				req.Header.Set("Content-Type", ct)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			Ω(err).ShouldNot(HaveOccurred())
+			resp.Body.Close()
+			Ω(resp.StatusCode).Should(Equal(http.StatusUnsupportedMediaType))
+		}
+		_, err := db.GetParam("a/b")
+		Ω(err).Should(Equal(database.ErrNotFound))
+	})
+})
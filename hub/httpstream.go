@@ -0,0 +1,311 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+// HTTP streaming of RF messages and sensor values
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/tve/widuino/gears"
+	"github.com/tve/widuino/hub/database"
+)
+
+// The subscriptions of the database are streamed as server-sent events, which browsers
+// consume with an EventSource. Like the libchan subscriptions they start by replaying the
+// data stored since start and then switch to the live data:
+//
+//	GET /rf/actions/subscribe?start=&group=&node=&kind=   "rf" events with an RFMessage
+//	GET /sensors/actions/subscribe?start=&name=&prefix=   "sensor" events with a Name, At, Value
+//
+// Start defaults to now. The group, node, and kind filters take lists of numbers and ranges,
+// e.g. node=2,5-9, and may be repeated. Several sensors can be streamed at once by repeating
+// name or by giving a prefix, which selects the sensors known when subscribing. Events carry
+// their At as ID if they come in order, i.e., for RF messages and for a single sensor, so an
+// EventSource that reconnects resumes where it left off.
+
+const httpKeepalive = 30 * time.Second // interval of comments to detect dead connections
+
+// httpStream is returned by the routes that stream events instead of replying, stream stops
+// when done is closed or writing fails, and close ends the subscription
+type httpStream interface {
+	stream(ev *eventWriter, done <-chan struct{})
+	close()
+}
+
+// eventWriter writes server-sent events
+type eventWriter struct {
+	w http.ResponseWriter
+	f http.Flusher
+}
+
+// event writes an event of a kind with the JSON encoding of v as data, and with an ID
+// unless id is zero
+func (ev *eventWriter) event(kind string, id int64, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s := "event: " + kind + "\n"
+	if id != 0 {
+		s += fmt.Sprintf("id: %d\n", id)
+	}
+	return ev.write(s + "data: " + string(buf) + "\n\n")
+}
+
+func (ev *eventWriter) comment(text string) error {
+	return ev.write(": " + text + "\n\n")
+}
+
+func (ev *eventWriter) write(s string) error {
+	if _, err := ev.w.Write([]byte(s)); err != nil {
+		return err
+	}
+	ev.f.Flush()
+	return nil
+}
+
+// serveEvents streams the events of s until the client goes away
+func serveEvents(w http.ResponseWriter, r *http.Request, s httpStream) {
+	defer s.close()
+	f, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, httpError{"streaming is not supported"})
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	ev := &eventWriter{w: w, f: f}
+	if ev.comment("subscribed") == nil {
+		s.stream(ev, r.Context().Done())
+	}
+	glog.Infof("HTTP %s %s: done streaming", r.Method, r.URL.Path)
+}
+
+// httpStart parses the start of a subscription, an EventSource that reconnects asks to
+// resume after the ID of the last event it got
+func httpStart(r *http.Request, resume bool) (int64, *gears.Reply) {
+	if id := r.Header.Get("Last-Event-ID"); resume && id != "" {
+		if at, err := strconv.ParseInt(id, 10, 64); err == nil && at > 0 {
+			return at + 1, nil
+		}
+	}
+	start, rep := httpTime(r.URL.Query(), "start", time.Now().UnixNano()/1000000)
+	if rep == nil && start <= 0 {
+		rep = &gears.Reply{Code: gears.CodeClientError, Error: "bad start"}
+	}
+	return start, rep
+}
+
+// httpSet parses the repeated query parameter key into the set of numbers it lists
+func httpSet(r *http.Request, key string) ([]byte, *gears.Reply) {
+	var set []byte
+	for _, list := range r.URL.Query()[key] {
+		for _, item := range strings.Split(list, ",") {
+			lohi := strings.SplitN(item, "-", 2)
+			lo, err := strconv.ParseUint(lohi[0], 10, 8)
+			hi := lo
+			if err == nil && len(lohi) == 2 {
+				hi, err = strconv.ParseUint(lohi[1], 10, 8)
+			}
+			if err != nil || hi < lo {
+				return nil, &gears.Reply{Code: gears.CodeClientError,
+					Error: "bad " + key + ": " + item}
+			}
+			set = append(set, gears.RFRange(byte(lo), byte(hi))...)
+		}
+	}
+	return set, nil
+}
+
+//===== RF messages
+
+type rfStream chan gears.RFMessage
+
+func httpRFSubscribe(r *http.Request, arg string) (interface{}, gears.Reply) {
+	start, rep := httpStart(r, true)
+	var match gears.RFMatch
+	if rep == nil {
+		match.Groups, rep = httpSet(r, "group")
+	}
+	if rep == nil {
+		match.Nodes, rep = httpSet(r, "node")
+	}
+	if rep == nil {
+		match.Kinds, rep = httpSet(r, "kind")
+	}
+	if rep != nil {
+		return nil, *rep
+	}
+	c := db.RFSubscribe(start, match)
+	glog.Infof("Start HTTP RF subscriber %v at now%+dsecs match=%+v", c,
+		start/1000-time.Now().Unix(), match)
+	return rfStream(c), gears.Reply{Code: gears.CodeOK}
+}
+
+func (c rfStream) stream(ev *eventWriter, done <-chan struct{}) {
+	keepalive := time.NewTicker(httpKeepalive)
+	defer keepalive.Stop()
+	for {
+		var err error
+		select {
+		case m, ok := <-c:
+			if !ok {
+				return
+			}
+			err = ev.event("rf", m.At, m)
+		case <-keepalive.C:
+			err = ev.comment("keepalive")
+		case <-done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// close ends the subscription and drains its channel so the publisher doesn't block, a
+// subscription that is still catching up can only be ended once it's live
+func (c rfStream) close() {
+	db.RFUnsubscribe(c)
+	retry := time.NewTicker(100 * time.Millisecond)
+	defer retry.Stop()
+	for {
+		select {
+		case _, ok := <-c:
+			if !ok {
+				glog.Infof("Closed HTTP RF subscriber %v", c)
+				return
+			}
+		case <-retry.C:
+			db.RFUnsubscribe(c)
+		}
+	}
+}
+
+//===== Sensors
+
+// httpSensorValue is the data of sensor events
+type httpSensorValue struct {
+	Name  string
+	At    int64
+	Value float64
+}
+
+type sensorStream struct {
+	subs  map[string]chan gears.SensorDataValue // subscriptions by sensor name
+	order bool                                  // the values come in order
+	stop  chan struct{}                         // closed when the stream ends
+}
+
+func httpSensorSubscribe(r *http.Request, arg string) (interface{}, gears.Reply) {
+	q := r.URL.Query()
+	names := q["name"]
+	if prefix, ok := q["prefix"]; ok {
+		infos, err := db.ListSensorInfo()
+		if err != nil {
+			return nil, gears.Reply{Code: gears.CodeServerError, Error: err.Error()}
+		}
+		for name := range infos {
+			if strings.HasPrefix(name, prefix[0]) {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			return nil, gears.Reply{Code: gears.CodeClientError,
+				Error: database.ErrNotFound.Error()}
+		}
+	}
+	if len(names) == 0 {
+		return nil, gears.Reply{Code: gears.CodeClientError, Error: "name or prefix is required"}
+	}
+	for _, name := range names {
+		info := HandleSensorInfoRequest(&gears.SensorInfoRequest{Name: name})
+		if info.Code != gears.CodeOK {
+			return nil, info
+		}
+	}
+
+	s := sensorStream{subs: make(map[string]chan gears.SensorDataValue), order: len(names) == 1,
+		stop: make(chan struct{})}
+	start, rep := httpStart(r, s.order)
+	if rep != nil {
+		return nil, *rep
+	}
+	for _, name := range names {
+		if s.subs[name] == nil {
+			s.subs[name] = db.SensorSubscribe(name, start)
+		}
+	}
+	glog.Infof("Start HTTP sensor subscriber for %d sensors at now%+dsecs", len(s.subs),
+		start/1000-time.Now().Unix())
+	return s, gears.Reply{Code: gears.CodeOK}
+}
+
+func (s sensorStream) stream(ev *eventWriter, done <-chan struct{}) {
+	// merge the subscriptions into one channel
+	values := make(chan httpSensorValue)
+	for name, c := range s.subs {
+		go func(name string, c chan gears.SensorDataValue) {
+			for v := range c {
+				select {
+				case values <- httpSensorValue{Name: name, At: v.At, Value: v.Value}:
+				case <-s.stop:
+				}
+			}
+		}(name, c)
+	}
+
+	keepalive := time.NewTicker(httpKeepalive)
+	defer keepalive.Stop()
+	for {
+		var err error
+		select {
+		case v := <-values:
+			var id int64
+			if s.order {
+				id = v.At
+			}
+			err = ev.event("sensor", id, v)
+		case <-keepalive.C:
+			err = ev.comment("keepalive")
+		case <-done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s sensorStream) close() {
+	close(s.stop)
+	for _, c := range s.subs {
+		unsubscribeSensor(c)
+	}
+}
+
+// unsubscribeSensor ends a sensor subscription like rfStream.close
+func unsubscribeSensor(c chan gears.SensorDataValue) {
+	db.SensorUnsubscribe(c)
+	retry := time.NewTicker(100 * time.Millisecond)
+	defer retry.Stop()
+	for {
+		select {
+		case _, ok := <-c:
+			if !ok {
+				glog.Infof("Closed HTTP sensor subscriber %v", c)
+				return
+			}
+		case <-retry.C:
+			db.SensorUnsubscribe(c)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+package main
+
+// Omega: Alt+937
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tve/widuino/gears"
+	"github.com/tve/widuino/hub/database"
+)
+
+// sse is a server-sent event as received by the tests
+type sse struct {
+	Event, Id, Data string
+}
+
+// readEvents reads the events of a stream into a channel until the stream ends
+func readEvents(resp *http.Response) chan sse {
+	events := make(chan sse, 100)
+	go func() {
+		defer close(events)
+		r := bufio.NewReader(resp.Body)
+		var ev sse
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\n")
+			switch {
+			case line == "" && ev.Event != "":
+				events <- ev
+				ev = sse{}
+			case strings.HasPrefix(line, "event: "):
+				ev.Event = line[7:]
+			case strings.HasPrefix(line, "id: "):
+				ev.Id = line[4:]
+			case strings.HasPrefix(line, "data: "):
+				ev.Data = line[6:]
+			}
+		}
+	}()
+	return events
+}
+
+//===== tests =====
+
+var _ = Describe("HTTP streaming", func() {
+	var dbDir string
+	var srv *httptest.Server
+
+	// subscribe starts streaming the events of path
+	subscribe := func(path string, header ...string) (*http.Response, chan sse) {
+		req, err := http.NewRequest("GET", srv.URL+path, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(resp.StatusCode).Should(Equal(http.StatusOK))
+		Ω(resp.Header.Get("Content-Type")).Should(Equal("text/event-stream"))
+		return resp, readEvents(resp)
+	}
+
+	BeforeEach(func() {
+		dbDir = fmt.Sprintf("/tmp/db-sse-%d", os.Getpid())
+		var err error
+		db, err = database.Open(dbDir) // db is global defined in main.go
+		Ω(err).ShouldNot(HaveOccurred())
+		srv = httptest.NewServer(newHTTPMux(""))
+	})
+
+	AfterEach(func() {
+		srv.Close()
+		db.Close()
+		os.RemoveAll(dbDir)
+	})
+
+	It("streams RF messages", func() {
+		for i := int64(1); i <= 3; i++ {
+			db.PutRFMessage(gears.RFMessage{At: i * 1000, Group: 212, Node: byte(i), Kind: 4})
+		}
+		resp, events := subscribe("/rf/actions/subscribe?start=1500&node=2-3,9")
+		defer resp.Body.Close()
+		Eventually(events).Should(Receive(Equal(sse{"rf", "2000",
+			`{"At":2000,"Group":212,"Node":2,"DoAck":false,"Kind":4,"Data":null,"Rx":null}`})))
+		var ev sse
+		Eventually(events).Should(Receive(&ev))
+		Ω(ev.Id).Should(Equal("3000"))
+
+		// live messages, filtered
+		db.PutRFMessage(gears.RFMessage{At: 4000, Group: 212, Node: 4, Kind: 4})
+		db.PutRFMessage(gears.RFMessage{At: 5000, Group: 212, Node: 9, Kind: 4})
+		Eventually(events).Should(Receive(&ev))
+		Ω(ev.Id).Should(Equal("5000"))
+		Consistently(events).ShouldNot(Receive())
+	})
+
+	It("resumes RF streams", func() {
+		for i := int64(1); i <= 3; i++ {
+			db.PutRFMessage(gears.RFMessage{At: i * 1000, Group: 212, Node: 3, Kind: 4})
+		}
+		resp, events := subscribe("/rf/actions/subscribe?start=1", "Last-Event-ID", "2000")
+		defer resp.Body.Close()
+		var ev sse
+		Eventually(events).Should(Receive(&ev))
+		Ω(ev.Id).Should(Equal("3000"))
+	})
+
+	It("ends subscriptions when the client goes away", func() {
+		resp, events := subscribe("/rf/actions/subscribe?start=1")
+		db.PutRFMessage(gears.RFMessage{At: 1000, Group: 212, Node: 3, Kind: 4})
+		Eventually(events).Should(Receive())
+		resp.Body.Close()
+		// publishing must not block on the subscriber's full channel
+		done := make(chan bool)
+		go func() {
+			for i := int64(2); i < 300; i++ {
+				db.PutRFMessage(gears.RFMessage{At: i * 1000, Group: 212, Node: 3, Kind: 4})
+			}
+			done <- true
+		}()
+		Eventually(done, 5).Should(Receive())
+	})
+
+	It("rejects bad filters", func() {
+		resp, err := http.Get(srv.URL + "/rf/actions/subscribe?node=5-2")
+		Ω(err).ShouldNot(HaveOccurred())
+		resp.Body.Close()
+		Ω(resp.StatusCode).Should(Equal(http.StatusBadRequest))
+		resp, err = http.Get(srv.URL + "/rf/actions/subscribe?kind=300")
+		Ω(err).ShouldNot(HaveOccurred())
+		resp.Body.Close()
+		Ω(resp.StatusCode).Should(Equal(http.StatusBadRequest))
+	})
+
+	Describe("sensors", func() {
+		BeforeEach(func() {
+			for _, name := range []string{"basement/temp0", "basement/temp1", "attic/temp0"} {
+				db.PutSensorInfo(name, gears.SensorInfo{Unit: "F"})
+				db.PutSensorValue(name, gears.SensorDataValue{At: 1000, Value: 70})
+			}
+		})
+
+		It("streams a sensor", func() {
+			resp, events := subscribe("/sensors/actions/subscribe?name=attic/temp0&start=1000")
+			defer resp.Body.Close()
+			Eventually(events).Should(Receive(Equal(sse{"sensor", "1000",
+				`{"Name":"attic/temp0","At":1000,"Value":70}`})))
+			db.PutSensorValue("attic/temp0", gears.SensorDataValue{At: 2000, Value: 71})
+			db.PutSensorValue("basement/temp0", gears.SensorDataValue{At: 2000, Value: 72})
+			Eventually(events).Should(Receive(Equal(sse{"sensor", "2000",
+				`{"Name":"attic/temp0","At":2000,"Value":71}`})))
+			Consistently(events).ShouldNot(Receive())
+		})
+
+		It("streams sensors by prefix", func() {
+			resp, events := subscribe("/sensors/actions/subscribe?prefix=basement/&start=-1")
+			defer resp.Body.Close()
+			db.PutSensorValue("basement/temp1", gears.SensorDataValue{Value: 73})
+			db.PutSensorValue("attic/temp0", gears.SensorDataValue{Value: 74})
+			db.PutSensorValue("basement/temp0", gears.SensorDataValue{Value: 75})
+			// the sensors are streamed independently, so their values may come in any order
+			names := []string{}
+			for i := 0; i < 2; i++ {
+				var ev sse
+				Eventually(events).Should(Receive(&ev))
+				Ω(ev.Id).Should(BeEmpty())
+				names = append(names, strings.Split(ev.Data, `"`)[3])
+			}
+			Ω(names).Should(ConsistOf("basement/temp0", "basement/temp1"))
+			Consistently(events).ShouldNot(Receive())
+		})
+
+		It("rejects unknown sensors", func() {
+			for _, q := range []string{"name=nothing", "prefix=nothing", ""} {
+				resp, err := http.Get(srv.URL + "/sensors/actions/subscribe?" + q)
+				Ω(err).ShouldNot(HaveOccurred())
+				resp.Body.Close()
+				Ω(resp.StatusCode).ShouldNot(Equal(http.StatusOK))
+			}
+		})
+	})
+})
@@ -0,0 +1,310 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+package jeesim
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// UDP framing flags of the data packets, see hub/udpgw.go
+const (
+	flagBcastPush = iota
+	flagBcastReq
+	flagDataPush
+	flagDataReq
+	flagAckData
+	_ // boot request
+	flagAckBcast
+	_ // boot reply
+	_ // pairing
+	flagDebug
+	flagRxInfo = 0x80 // reception metadata follows the header
+)
+
+// Module IDs used by the payload generators, see nodes/EEConf/EEConf.h
+const (
+	KindLog        = 2
+	KindOwTemp     = 4
+	KindWaterLevel = 7
+	KindGwRssi     = 8
+)
+
+// ErrNoAck is returned when the hub doesn't ACK a packet sent with an ACK request
+var ErrNoAck = errors.New("no ACK from the hub")
+
+// A Packet is what the hub sent to a node of a simulated gateway
+type Packet struct {
+	Node byte
+	Kind byte
+	Data []byte
+	Ack  bool // the hub requested an ACK, which the gateway sent on behalf of the node
+}
+
+// Gateway is a simulated UDP/RF gateway with the nodes of its RF group behind it. It sends
+// the packets of its nodes to the hub, ACKs the hub's data_req packets on their behalf, and
+// can lose packets in both directions. If it has a GwId it adds the reception metadata to the
+// packets it hears from its nodes.
+type Gateway struct {
+	Group      byte
+	GwId       byte          // gateway ID reported in the reception metadata, 0 for none
+	Retries    int           // retransmissions of packets the hub doesn't ACK
+	AckTimeout time.Duration // time to wait for an ACK from the hub
+	Delivered  chan Packet   // packets from the hub to the nodes, dropped if the channel is full
+	hub        *net.UDPAddr
+	mutex      sync.Mutex
+	conn       *net.UDPConn
+	loss       float64                // probability that a packet gets lost, 0..1
+	acks       map[byte]chan struct{} // node -> ACK from the hub for a bcast_req
+	boot       map[byte]chan []byte   // node -> boot protocol replies
+	rssi       [2 * gwRssiNodes]byte  // RSSI received from and reported by each node
+	nodeRssi   map[byte]int           // node -> RSSI in dBm set by SetRssi
+	seq        byte                   // sequence number of the packets heard over RF
+	stats      [4]byte                // RF rcv, RF snd, ethernet rcv, ethernet snd
+}
+
+const gwRssiNodes = 30 // nodes 1..30, see the GW RSSI decoder in hub/decoders.go
+
+// NewGateway creates a gateway for an RF group that talks to the UDP gateway of the hub at
+// addr, it announces itself with a debug message
+func NewGateway(addr *net.UDPAddr, group byte) (*Gateway, error) {
+	g := &Gateway{Group: group, Retries: DefaultRetries, AckTimeout: DefaultTimeout,
+		Delivered: make(chan Packet, 100), hub: addr,
+		acks: make(map[byte]chan struct{}), boot: make(map[byte]chan []byte),
+		nodeRssi: make(map[byte]int)}
+	if err := g.Move(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Move switches the gateway to a new socket, which looks like a gateway whose IP address
+// changed to the hub, and announces the gateway from there
+func (g *Gateway) Move() error {
+	conn, err := net.DialUDP("udp4", nil, g.hub)
+	if err != nil {
+		return err
+	}
+	g.mutex.Lock()
+	old := g.conn
+	g.conn = conn
+	g.mutex.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	go g.receiver(conn)
+	return g.Log(fmt.Sprintf("gateway for group %d at %s", g.Group, conn.LocalAddr()))
+}
+
+// Close shuts the gateway down
+func (g *Gateway) Close() error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.conn.Close()
+}
+
+// Addr returns the gateway's current address
+func (g *Gateway) Addr() *net.UDPAddr {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Send sends a packet from a node to the hub as bcast_push or, if ack is set, as bcast_req,
+// in which case it retransmits until the hub ACKs it and returns ErrNoAck if it never does
+func (g *Gateway) Send(node, kind byte, data []byte, ack bool) error {
+	pkt := append([]byte{flagBcastPush, g.Group, node, kind}, data...)
+	if !ack {
+		return g.send(pkt, true)
+	}
+
+	pkt[0] = flagBcastReq
+	acked := make(chan struct{}, 1)
+	g.mutex.Lock()
+	g.acks[node] = acked
+	g.mutex.Unlock()
+	defer func() {
+		g.mutex.Lock()
+		delete(g.acks, node)
+		g.mutex.Unlock()
+	}()
+	for try := 0; try <= g.Retries; try++ {
+		if err := g.send(pkt, true); err != nil {
+			return err
+		}
+		select {
+		case <-acked:
+			return nil
+		case <-time.After(g.AckTimeout):
+		}
+	}
+	return ErrNoAck
+}
+
+// Log sends a debug message from the gateway itself
+func (g *Gateway) Log(text string) error {
+	return g.send(append([]byte{flagDebug, g.Group, 0}, text...), false)
+}
+
+// SendRssi sends the gateway's packet counters and the RSSI of its nodes, like
+// rf12-udp-gw it sends them as node 31 with the GW_RSSI_MODULE kind
+func (g *Gateway) SendRssi() error {
+	g.mutex.Lock()
+	pkt := append([]byte{flagBcastPush, g.Group, 31, KindGwRssi}, g.stats[:]...)
+	pkt = append(pkt, g.rssi[:]...)
+	g.mutex.Unlock()
+	return g.send(pkt, false)
+}
+
+// NewNode creates a JeeBoot node behind the gateway, it's preset to the gateway's group
+func (g *Gateway) NewNode(nodeType uint16, hwId [16]byte) *Node {
+	n := newNode(nil, nodeType, hwId)
+	n.Group = g.Group
+	n.link = &gatewayLink{g: g, n: n}
+	return n
+}
+
+// SetRssi sets the RSSI in dBm with which the gateway hears a node, 0 for a random one
+func (g *Gateway) SetRssi(node byte, rssi int) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.nodeRssi[node] = rssi
+}
+
+// send sends a packet to the hub, if rf is set the packet came from a node over RF
+func (g *Gateway) send(pkt []byte, rf bool) error {
+	g.mutex.Lock()
+	conn := g.conn
+	if rf {
+		g.stats[0]++
+		node := pkt[2]
+		rssi := byte(50 + rand.Intn(50))
+		if r := g.nodeRssi[node]; r != 0 {
+			rssi = byte(-r)
+		}
+		if node >= 1 && node <= gwRssiNodes {
+			g.rssi[node-1] = rssi
+		}
+		if g.GwId != 0 {
+			g.seq++
+			pkt = append([]byte{pkt[0] | flagRxInfo, pkt[1], node, g.GwId, rssi, 0, g.seq},
+				pkt[3:]...)
+		}
+	}
+	g.stats[3]++
+	g.mutex.Unlock()
+	if rf && g.lost() {
+		return nil
+	}
+	_, err := conn.Write(pkt)
+	return err
+}
+
+// SetLoss sets the probability that a packet gets lost, 0..1
+func (g *Gateway) SetLoss(loss float64) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.loss = loss
+}
+
+// lost decides whether a packet gets lost
+func (g *Gateway) lost() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.loss > 0 && rand.Float64() < g.loss
+}
+
+// receiver handles the packets the hub sends the gateway until the socket is closed
+func (g *Gateway) receiver(conn *net.UDPConn) {
+	buf := make([]byte, 1600)
+	for {
+		l, err := conn.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		if l < 3 || buf[1] != g.Group {
+			continue
+		}
+		pkt := append([]byte{}, buf[:l]...)
+		flags, node := pkt[0], pkt[2]
+		g.mutex.Lock()
+		g.stats[2]++
+		g.stats[1]++
+		g.mutex.Unlock()
+		if g.lost() {
+			continue
+		}
+
+		switch flags {
+		case flagBcastPush, flagDataPush, flagDataReq: // broadcasts to node 0 are bcast_push
+			p := Packet{Node: node, Ack: flags == flagDataReq}
+			if l > 3 {
+				p.Kind = pkt[3]
+				p.Data = pkt[4:]
+			}
+			if p.Ack {
+				g.send([]byte{flagAckData, g.Group, node}, true)
+			}
+			select {
+			case g.Delivered <- p:
+			default:
+			}
+		case flagAckBcast:
+			g.mutex.Lock()
+			if ch := g.acks[node]; ch != nil {
+				select {
+				case ch <- struct{}{}:
+				default:
+				}
+			}
+			g.mutex.Unlock()
+		case flagBootReply, flagPairing:
+			select {
+			case g.bootChan(node) <- pkt:
+			default:
+			}
+		}
+	}
+}
+
+// bootChan returns the channel for boot protocol replies to a node
+func (g *Gateway) bootChan(node byte) chan []byte {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	ch := g.boot[node]
+	if ch == nil {
+		ch = make(chan []byte, 10)
+		g.boot[node] = ch
+	}
+	return ch
+}
+
+// A gatewayLink carries the boot protocol packets of a node through a simulated gateway
+type gatewayLink struct {
+	g *Gateway
+	n *Node
+}
+
+func (l *gatewayLink) send(pkt []byte) error {
+	return l.g.send(pkt, true)
+}
+
+func (l *gatewayLink) recv(deadline time.Time) ([]byte, error) {
+	select {
+	case pkt := <-l.g.bootChan(l.n.Id):
+		return pkt, nil
+	case <-time.After(deadline.Sub(time.Now())):
+		return nil, errTimeout
+	}
+}
+
+func (l *gatewayLink) close() error {
+	return nil
+}
@@ -0,0 +1,276 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+// Simulated JeeBoot nodes and UDP/RF gateways
+//
+// A Node plays the part of a JeeBoot-enabled node: it sends the boot protocol requests to the
+// hub's UDP gateway using the gateway's framing (flags, group, node, payload) and goes through
+// the same pairing, upgrade, and download sequence a real node does at boot, reassembling and
+// checking the software image. A Node either plays its own UDP/RF gateway or sits behind a
+// simulated Gateway, which also carries the data packets of the nodes in its RF group.
+package jeesim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// UDP framing flags of the boot protocol packets
+const (
+	flagBootReq      = 5 // upgrade or download request (CTL + ACK)
+	flagBootReply    = 7 // upgrade or download reply
+	flagPairing      = 8 // pairing request and reply
+	bootDataMax      = 64
+	downloadReplyLen = 2 + bootDataMax
+	upgradeReplyLen  = 8
+	pairingReplyLen  = 20
+)
+
+type pairingRequest struct {
+	NodeType uint16
+	GroupId  uint8
+	NodeId   uint8
+	Check    uint16
+	HwId     [16]uint8
+}
+
+type pairingReply struct {
+	NodeType uint16
+	GroupId  uint8
+	NodeId   uint8
+	ShKey    [16]byte
+}
+
+type upgradeMsg struct { // upgrade request and reply have the same layout
+	NodeType uint16
+	SwId     uint16
+	SwSize   uint16
+	SwCheck  uint16
+}
+
+type downloadRequest struct {
+	SwId    uint16
+	SwIndex uint16
+}
+
+// Node is a simulated JeeBoot node, the exported fields reflect what the node has stored
+// in EEPROM and flash and may be preset before booting.
+type Node struct {
+	HwId     [16]byte // hardware ID, all zeroes to get one assigned when pairing
+	NodeType uint16   // node type sent in the pairing request
+	Group    byte     // RF group, 0 if not paired
+	Id       byte     // RF node ID, 0 if not paired
+	SwId     uint16   // ID of the software in flash, 0 if none
+	Image    []byte   // the software in flash
+	Timeout  time.Duration
+	Retries  int // retransmissions of a request before giving up
+	link     link
+}
+
+// Defaults for the retransmission of requests
+const (
+	DefaultTimeout = 200 * time.Millisecond
+	DefaultRetries = 3
+)
+
+// NewNode creates a node that talks to the UDP gateway of the hub at addr
+func NewNode(addr *net.UDPAddr, nodeType uint16, hwId [16]byte) (*Node, error) {
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	return newNode(&udpLink{conn: conn, buf: make([]byte, 1600)}, nodeType, hwId), nil
+}
+
+func newNode(l link, nodeType uint16, hwId [16]byte) *Node {
+	return &Node{HwId: hwId, NodeType: nodeType, Timeout: DefaultTimeout,
+		Retries: DefaultRetries, link: l}
+}
+
+// Close closes the connection to the hub
+func (n *Node) Close() error {
+	return n.link.close()
+}
+
+// Boot performs the boot sequence: pair, ask which software to run and download it if it's
+// not what's in flash, then "reboot" and ask again, which confirms the new software to the
+// hub. It returns whether new software was downloaded.
+func (n *Node) Boot() (bool, error) {
+	if err := n.Pair(); err != nil {
+		return false, err
+	}
+	changed, err := n.Upgrade()
+	if err != nil || !changed {
+		return changed, err
+	}
+	if _, err = n.Upgrade(); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// Pair sends a pairing request and adopts the node type, group and node ID in the reply,
+// as well as the hardware ID if one got assigned
+func (n *Node) Pair() error {
+	req := pairingRequest{NodeType: n.NodeType, GroupId: n.Group, NodeId: n.Id, HwId: n.HwId}
+	var repl pairingReply
+	if err := n.request(flagPairing, req, flagPairing, pairingReplyLen, &repl); err != nil {
+		return fmt.Errorf("pairing: %s", err.Error())
+	}
+	if repl.NodeId == 0 {
+		return fmt.Errorf("pairing: no node ID assigned")
+	}
+	n.NodeType = repl.NodeType
+	n.Group = repl.GroupId
+	n.Id = repl.NodeId
+	if repl.ShKey != [16]byte{} && n.HwId == [16]byte{} {
+		n.HwId = repl.ShKey
+	}
+	return nil
+}
+
+// Upgrade asks the hub which software to run and downloads it if it differs from what's in
+// flash, it returns whether new software was downloaded
+func (n *Node) Upgrade() (bool, error) {
+	req := upgradeMsg{NodeType: n.NodeType, SwId: n.SwId,
+		SwSize: uint16(len(n.Image) / 16), SwCheck: Crc16(n.Image)}
+	var repl upgradeMsg
+	if err := n.request(flagBootReq, req, flagBootReply, upgradeReplyLen, &repl); err != nil {
+		return false, fmt.Errorf("upgrade: %s", err.Error())
+	}
+	if repl == req {
+		return false, nil
+	}
+
+	size := int(repl.SwSize) * 16
+	image := make([]byte, 0, size)
+	for ix := 0; len(image) < size; ix++ {
+		data, err := n.Download(repl.SwId, uint16(ix))
+		if err != nil {
+			return false, err
+		}
+		if size-len(image) < len(data) {
+			data = data[:size-len(image)]
+		}
+		image = append(image, data...)
+	}
+	if crc := Crc16(image); crc != repl.SwCheck {
+		return false, fmt.Errorf("upgrade: sw %d has CRC 0x%04x, expected 0x%04x",
+			repl.SwId, crc, repl.SwCheck)
+	}
+	n.SwId = repl.SwId
+	n.Image = image
+	return true, nil
+}
+
+// Download fetches one de-whitened chunk of a software image
+func (n *Node) Download(swId, ix uint16) ([]byte, error) {
+	req := downloadRequest{SwId: swId, SwIndex: ix}
+	var repl struct {
+		SwIdXorIx uint16
+		Data      [bootDataMax]byte
+	}
+	if err := n.request(flagBootReq, req, flagBootReply, downloadReplyLen, &repl); err != nil {
+		return nil, fmt.Errorf("download %d: %s", ix, err.Error())
+	}
+	if repl.SwIdXorIx != swId^ix {
+		return nil, fmt.Errorf("download %d: reply is for 0x%04x", ix, repl.SwIdXorIx)
+	}
+	data := make([]byte, bootDataMax)
+	DeWhiten(repl.Data[:], data)
+	return data, nil
+}
+
+// request sends a boot request and waits for the reply with the given flags and length,
+// retransmitting the request if no reply arrives in time
+func (n *Node) request(flags byte, req interface{}, replFlags byte, replLen int,
+	repl interface{}) error {
+
+	buf := bytes.Buffer{}
+	buf.Write([]byte{flags, n.Group, n.Id})
+	binary.Write(&buf, binary.LittleEndian, req)
+
+	for try := 0; try <= n.Retries; try++ {
+		if err := n.link.send(buf.Bytes()); err != nil {
+			return err
+		}
+		deadline := time.Now().Add(n.Timeout)
+		for {
+			pkt, err := n.link.recv(deadline)
+			if err == errTimeout {
+				break
+			} else if err != nil {
+				return err
+			}
+			// skip whatever else the hub sends this way
+			if len(pkt) == replLen+3 && pkt[0] == replFlags {
+				return binary.Read(bytes.NewReader(pkt[3:]), binary.LittleEndian, repl)
+			}
+		}
+	}
+	return fmt.Errorf("no reply after %d tries", n.Retries+1)
+}
+
+// ===== Links to the hub
+
+// A link carries the boot protocol packets of a node to the hub and back
+type link interface {
+	send(pkt []byte) error
+	recv(deadline time.Time) ([]byte, error) // errTimeout if nothing arrives by the deadline
+	close() error
+}
+
+var errTimeout = errors.New("timeout")
+
+// A udpLink talks to the hub directly, i.e., the node plays its own UDP/RF gateway
+type udpLink struct {
+	conn *net.UDPConn
+	buf  []byte
+}
+
+func (l *udpLink) send(pkt []byte) error {
+	_, err := l.conn.Write(pkt)
+	return err
+}
+
+func (l *udpLink) recv(deadline time.Time) ([]byte, error) {
+	l.conn.SetReadDeadline(deadline)
+	n, err := l.conn.Read(l.buf)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return nil, errTimeout
+	} else if err != nil {
+		return nil, err
+	}
+	return l.buf[:n], nil
+}
+
+func (l *udpLink) close() error {
+	return l.conn.Close()
+}
+
+// ===== De-whitening and CRC-16, as done by JeeBoot
+
+// DeWhiten undoes the whitening of a downloaded chunk, which prevents runs of 0 or 1 bits
+func DeWhiten(inBuf, outBuf []byte) {
+	for i := range inBuf {
+		outBuf[i] = inBuf[i] ^ byte(211*i)
+	}
+}
+
+var crcTable = []uint16{
+	0x0000, 0xCC01, 0xD801, 0x1400, 0xF001, 0x3C00, 0x2800, 0xE401,
+	0xA001, 0x6C00, 0x7800, 0xB401, 0x5000, 0x9C01, 0x8801, 0x4400,
+}
+
+// Crc16 calculates the Arduino-style CRC-16 of a software image
+func Crc16(sw []byte) uint16 {
+	var crc uint16 = 0xFFFF
+	for _, b := range sw {
+		crc = crc>>4 ^ crcTable[crc&0x0F] ^ crcTable[b&0x0F]
+		crc = crc>>4 ^ crcTable[crc&0x0F] ^ crcTable[b>>4]
+	}
+	return crc
+}
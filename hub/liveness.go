@@ -0,0 +1,169 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+// Node liveness tracking
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/tve/widuino/gears"
+	"github.com/tve/widuino/hub/database"
+)
+
+// Default liveness parameters
+const (
+	DefaultOfflineFactor = 3.0       // expected intervals a node may miss before going offline
+	DefaultOfflineAfter  = time.Hour // silence before going offline if the interval is unknown
+)
+
+// Gaps between packets shorter than this are bursts, e.g. a node sending several packets per
+// report, and don't count towards the node's reporting interval
+const minInterval = 1000 // milliseconds
+
+// livenessTracker follows when each node was last heard and how often it reports, and decides
+// whether it's online: a node goes offline when it hasn't been heard for Factor times its
+// expected interval, or for After while the interval isn't known yet, and comes back online
+// with its next packet. The status of each node is saved in the database so it survives hub
+// restarts, and transitions are published to subscribers.
+type livenessTracker struct {
+	Factor  float64       // expected intervals a node may miss before going offline
+	After   time.Duration // silence before going offline if the interval is unknown
+	mutex   sync.Mutex
+	db      *database.DB                 // where to save the status, may be nil
+	nodes   map[uint16]*gears.NodeStatus // status by group<<8|node
+	started int64                        // when the tracker started, milliseconds since epoch
+}
+
+// newLivenessTracker creates a tracker that picks up the status saved in the database, nodes
+// that were online get their full allowance from now on as the hub may have been down a while
+func newLivenessTracker(db *database.DB) *livenessTracker {
+	t := &livenessTracker{Factor: DefaultOfflineFactor, After: DefaultOfflineAfter, db: db,
+		nodes: make(map[uint16]*gears.NodeStatus), started: time.Now().UnixNano() / 1000000}
+	if db == nil {
+		return t
+	}
+	statuses, err := db.ListNodeStatus()
+	if err != nil {
+		glog.Errorf("Cannot read node status: %s", err.Error())
+	}
+	for i := range statuses {
+		s := statuses[i]
+		t.nodes[nodeKey(s.Group, s.Node)] = &s
+	}
+	return t
+}
+
+// Processor tracks the nodes that RF messages come from
+func (t *livenessTracker) Processor(in chan gears.RFMessage) {
+	go func() {
+		for m := range in {
+			t.heard(m.Group, m.Node, m.At)
+		}
+	}()
+}
+
+// Run checks periodically which nodes have gone offline, it doesn't return
+func (t *livenessTracker) Run(every time.Duration) {
+	for now := range time.Tick(every) {
+		t.check(now.UnixNano() / 1000000)
+	}
+}
+
+// heard records a packet from a node at the given time in milliseconds since the epoch
+func (t *livenessTracker) heard(group, node byte, at int64) {
+	if node < 1 || node > 30 {
+		return // node 0 is the gateway itself and node 31 its RSSI report
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	s := t.nodes[nodeKey(group, node)]
+	if s == nil {
+		s = &gears.NodeStatus{Group: group, Node: node, FirstSeen: at}
+		t.nodes[nodeKey(group, node)] = s
+	}
+	// learn the interval from the gaps while the node is up and the hub is listening
+	if gap := at - s.LastSeen; s.Online && s.LastSeen >= t.started && gap >= minInterval {
+		if s.Interval == 0 {
+			s.Interval = gap
+		} else {
+			s.Interval += (gap - s.Interval) / 8
+		}
+	}
+	s.LastSeen = at
+	s.Packets++
+	if span := at - s.FirstSeen; span > 0 {
+		s.Rate = float64(s.Packets-1) * float64(time.Hour/time.Millisecond) / float64(span)
+	}
+	online := !s.Online
+	if online {
+		s.Online = true
+		s.Since = at
+		glog.Infof("RFg%03di%02d is online", group, node)
+	}
+	t.save(s, online)
+}
+
+// check marks the nodes that haven't been heard for too long at the given time offline
+func (t *livenessTracker) check(now int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, s := range t.nodes {
+		if !s.Online {
+			continue
+		}
+		limit := int64(t.After / time.Millisecond)
+		if s.Interval > 0 {
+			limit = int64(t.Factor * float64(s.Interval))
+		}
+		last := s.LastSeen
+		if last < t.started {
+			last = t.started
+		}
+		if now-last > limit {
+			s.Online = false
+			s.Since = now
+			glog.Infof("RFg%03di%02d is offline, last heard %s ago", s.Group, s.Node,
+				time.Duration(now-s.LastSeen)*time.Millisecond)
+			t.save(s, true)
+		}
+	}
+}
+
+// list returns the status of all nodes sorted by group and node
+func (t *livenessTracker) list() []gears.NodeStatus {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	statuses := make([]gears.NodeStatus, 0, len(t.nodes))
+	for _, s := range t.nodes {
+		statuses = append(statuses, *s)
+	}
+	sort.Sort(statusesByNode(statuses))
+	return statuses
+}
+
+type statusesByNode []gears.NodeStatus
+
+func (s statusesByNode) Len() int      { return len(s) }
+func (s statusesByNode) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s statusesByNode) Less(i, j int) bool {
+	return nodeKey(s[i].Group, s[i].Node) < nodeKey(s[j].Group, s[j].Node)
+}
+
+// save saves the status of a node and publishes it if the node went online or offline
+func (t *livenessTracker) save(s *gears.NodeStatus, transition bool) {
+	if t.db == nil {
+		return
+	}
+	if err := t.db.PutNodeStatus(*s); err != nil {
+		glog.Errorf("Cannot save status of RFg%03di%02d: %s", s.Group, s.Node, err.Error())
+	}
+	if transition {
+		t.db.NodeStatusPublish(*s)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+package main
+
+// Omega: Alt+937
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tve/widuino/gears"
+	"github.com/tve/widuino/hub/database"
+)
+
+//===== tests =====
+
+var _ = Describe("Liveness", func() {
+	var dir string
+	var pdb *database.DB
+	var t *livenessTracker
+	var now int64
+
+	BeforeEach(func() {
+		dir = fmt.Sprintf("/tmp/db-l-%d", os.Getpid())
+		var err error
+		pdb, err = database.Open(dir)
+		Ω(err).ShouldNot(HaveOccurred())
+		t = newLivenessTracker(pdb)
+		now = t.started
+	})
+
+	AfterEach(func() {
+		pdb.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("learns the reporting interval and rate", func() {
+		for i := int64(0); i < 5; i++ {
+			t.heard(5, 3, now+i*60000)
+			t.heard(5, 3, now+i*60000+10) // burst
+		}
+		s := t.list()
+		Ω(s).Should(HaveLen(1))
+		Ω(s[0].Online).Should(BeTrue())
+		Ω(s[0].Since).Should(Equal(now))
+		Ω(s[0].Packets).Should(Equal(10))
+		Ω(s[0].Interval).Should(BeNumerically("~", 60000, 10))
+		Ω(s[0].Rate).Should(BeNumerically("~", 9*60/4.0, 0.1))
+	})
+
+	It("ignores the gateways", func() {
+		t.heard(5, 0, now)
+		t.heard(5, 31, now)
+		Ω(t.list()).Should(BeEmpty())
+	})
+
+	It("marks silent nodes offline and back online", func() {
+		events := pdb.NodeStatusSubscribe(0, 0)
+		t.heard(5, 3, now)
+		t.heard(5, 3, now+60000)
+		t.heard(5, 4, now)
+		Ω((<-events).Node).Should(Equal(byte(3)))
+		Ω((<-events).Node).Should(Equal(byte(4)))
+
+		t.check(now + 60000 + 3*60000)
+		Ω(events).Should(BeEmpty())
+		t.check(now + 60000 + 3*60000 + 1)
+		s := <-events
+		Ω(s.Node).Should(Equal(byte(3)))
+		Ω(s.Online).Should(BeFalse())
+		Ω(s.Since).Should(Equal(now + 60000 + 3*60000 + 1))
+		Ω(events).Should(BeEmpty()) // node 4's interval is unknown
+
+		t.check(now + int64(time.Hour/time.Millisecond) + 1)
+		Ω((<-events).Node).Should(Equal(byte(4)))
+
+		t.heard(5, 3, now+2*int64(time.Hour/time.Millisecond))
+		s = <-events
+		Ω(s.Online).Should(BeTrue())
+		Ω(s.Interval).Should(Equal(int64(60000))) // the outage doesn't count
+		pdb.NodeStatusUnsubscribe(events)
+	})
+
+	It("keeps the status across restarts", func() {
+		t.heard(5, 3, now)
+		t.heard(5, 3, now+60000)
+		t.heard(5, 4, now+60000)
+
+		t = newLivenessTracker(pdb)
+		t.started = now + int64(time.Hour/time.Millisecond) // the hub was down for an hour
+		s := t.list()
+		Ω(s).Should(HaveLen(2))
+		Ω(s[0].Packets).Should(Equal(2))
+		Ω(s[0].Online).Should(BeTrue())
+		// the nodes get their full allowance after the restart
+		t.check(t.started + 3*60000)
+		Ω(t.list()[0].Online).Should(BeTrue())
+		t.check(t.started + 3*60000 + 1)
+		Ω(t.list()[0].Online).Should(BeFalse())
+		Ω(t.list()[1].Online).Should(BeTrue())
+	})
+})
+
+var _ = Describe("Liveness requests", func() {
+	var dir string
+
+	BeforeEach(func() {
+		dir = fmt.Sprintf("/tmp/db-lr-%d", os.Getpid())
+		var err error
+		db, err = database.Open(dir) // db is global defined in main.go
+		Ω(err).ShouldNot(HaveOccurred())
+		liveness = newLivenessTracker(db)
+	})
+
+	AfterEach(func() {
+		liveness = nil
+		db.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("lists the status of the nodes", func() {
+		liveness.heard(5, 3, liveness.started)
+		rep := HandleNodeStatusListRequest(&gears.NodeStatusListRequest{})
+		Ω(rep.Code).Should(Equal(gears.CodeOK))
+		Ω(rep.NSL).Should(HaveLen(1))
+		Ω(rep.NSL[0].Online).Should(BeTrue())
+	})
+})
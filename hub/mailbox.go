@@ -0,0 +1,178 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+// Mailboxes for sleeping nodes
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/tve/widuino/gears"
+)
+
+// Battery powered nodes sleep most of the time and only listen briefly after they transmit,
+// so messages to them can't be sent right away. The Mailbox holds them until the hub hears
+// from the node, the UDP gateway then sends them right after the ACK. A newer message of the
+// same kind replaces the one that's waiting, and messages that wait too long expire. Each
+// change of the state of a message is published to subscribers.
+
+const DefaultMailExpiry = time.Hour
+
+type mail struct {
+	gears.MailStatus
+	msg   gears.RFMessage
+	timer *time.Timer // fires when the message expires
+}
+
+type Mailbox struct {
+	boxes       map[uint16][]*mail // group<<8|node -> messages in the order they came
+	last        int64              // ID of the last message, keeps IDs unique
+	subscribers []chan gears.MailStatus
+	subNode     [][2]byte // group, node of each subscriber
+	sync.Mutex            // synchronize access to maps and subscribers
+}
+
+// put holds a message for a node for at most the expiry time and returns its status
+func (mb *Mailbox) put(m gears.RFMessage, expiry time.Duration) gears.MailStatus {
+	mb.Lock()
+	defer mb.Unlock()
+	if mb.boxes == nil {
+		mb.boxes = make(map[uint16][]*mail)
+	}
+	now := time.Now().UnixNano() / 1000000
+	mb.last++
+	if mb.last < now {
+		mb.last = now
+	}
+
+	key := nodeKey(m.Group, m.Node)
+	box := make([]*mail, 0, len(mb.boxes[key])+1)
+	for _, ml := range mb.boxes[key] {
+		if ml.Kind == m.Kind {
+			ml.timer.Stop()
+			mb.finish(ml, gears.MailReplaced, "")
+		} else {
+			box = append(box, ml)
+		}
+	}
+	ml := &mail{MailStatus: gears.MailStatus{Id: mb.last, Group: m.Group, Node: m.Node,
+		Kind: m.Kind, State: gears.MailQueued, QueuedAt: now,
+		Expires: now + int64(expiry/time.Millisecond)}, msg: m}
+	ml.timer = time.AfterFunc(expiry, func() { mb.expire(ml) })
+	mb.boxes[key] = append(box, ml)
+	glog.Infof("Mail %d for %s queued", ml.Id, m.RfTag())
+	mb.publish(ml.MailStatus)
+	return ml.MailStatus
+}
+
+// take removes the messages held for a node that woke up, the caller sends them and reports
+// the outcome using done
+func (mb *Mailbox) take(group, node byte) []*mail {
+	mb.Lock()
+	defer mb.Unlock()
+	key := nodeKey(group, node)
+	box := mb.boxes[key]
+	delete(mb.boxes, key)
+	for _, ml := range box {
+		ml.timer.Stop()
+	}
+	return box
+}
+
+// done reports the outcome of sending a message that got taken out of the mailbox
+func (mb *Mailbox) done(ml *mail, err error) {
+	mb.Lock()
+	defer mb.Unlock()
+	if err != nil {
+		glog.Warningf("Mail %d for %s failed: %s", ml.Id, ml.msg.RfTag(), err.Error())
+		mb.finish(ml, gears.MailFailed, err.Error())
+	} else {
+		mb.finish(ml, gears.MailDelivered, "")
+	}
+}
+
+// expire drops a message whose node didn't wake up in time
+func (mb *Mailbox) expire(ml *mail) {
+	mb.Lock()
+	defer mb.Unlock()
+	key := nodeKey(ml.Group, ml.Node)
+	box := mb.boxes[key]
+	for i := range box {
+		if box[i] == ml {
+			mb.boxes[key] = append(box[:i], box[i+1:]...)
+			if len(mb.boxes[key]) == 0 {
+				delete(mb.boxes, key)
+			}
+			glog.Infof("Mail %d for %s expired", ml.Id, ml.msg.RfTag())
+			mb.finish(ml, gears.MailExpired, "")
+			return
+		}
+	}
+	// the message got taken out of the mailbox while the timer fired
+}
+
+// finish sets the final state of a message and publishes it, assumes the lock is held
+func (mb *Mailbox) finish(ml *mail, state, err string) {
+	ml.State = state
+	ml.Error = err
+	ml.DoneAt = time.Now().UnixNano() / 1000000
+	mb.publish(ml.MailStatus)
+}
+
+// list returns the messages held for a node, or for all nodes if node is zero, sorted by
+// node and in the order they came
+func (mb *Mailbox) list(group, node byte) []gears.MailStatus {
+	mb.Lock()
+	defer mb.Unlock()
+	keys := []int{}
+	for key := range mb.boxes {
+		if node == 0 || key == nodeKey(group, node) {
+			keys = append(keys, int(key))
+		}
+	}
+	sort.Ints(keys)
+	statuses := make([]gears.MailStatus, 0)
+	for _, key := range keys {
+		for _, ml := range mb.boxes[uint16(key)] {
+			statuses = append(statuses, ml.MailStatus)
+		}
+	}
+	return statuses
+}
+
+// Subscribe to the state changes of the messages held for a node, or for all nodes if node
+// is zero, returns a channel to read the message status from.
+func (mb *Mailbox) subscribe(group, node byte) chan gears.MailStatus {
+	mb.Lock()
+	defer mb.Unlock()
+	c := make(chan gears.MailStatus, 100)
+	mb.subscribers = append(mb.subscribers, c)
+	mb.subNode = append(mb.subNode, [2]byte{group, node})
+	return c
+}
+
+// Unsubscribe the given channel from message state changes, this closes the channel.
+func (mb *Mailbox) unsubscribe(c chan gears.MailStatus) {
+	mb.Lock()
+	defer mb.Unlock()
+	for i := 0; i < len(mb.subscribers); i += 1 {
+		if mb.subscribers[i] != c {
+			continue
+		}
+		close(mb.subscribers[i])
+		mb.subscribers = append(mb.subscribers[0:i], mb.subscribers[i+1:]...)
+		mb.subNode = append(mb.subNode[0:i], mb.subNode[i+1:]...)
+		return
+	}
+}
+
+// Forward the state of a message to all subscribers for its node, assumes the lock is held
+func (mb *Mailbox) publish(s gears.MailStatus) {
+	for i, n := range mb.subNode {
+		if n[1] == 0 || n == [2]byte{s.Group, s.Node} {
+			mb.subscribers[i] <- s
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+package main
+
+// Omega: Alt+937
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tve/widuino/gears"
+)
+
+//===== tests =====
+
+var _ = Describe("Mailbox", func() {
+	var mb *Mailbox
+	var events chan gears.MailStatus
+
+	BeforeEach(func() {
+		mb = &Mailbox{}
+		events = mb.subscribe(0, 0)
+	})
+
+	AfterEach(func() {
+		mb.unsubscribe(events)
+	})
+
+	It("holds messages until the node wakes up", func() {
+		s1 := mb.put(gears.RFMessage{Group: 5, Node: 3, Kind: 7}, time.Hour)
+		s2 := mb.put(gears.RFMessage{Group: 5, Node: 3, Kind: 8}, time.Hour)
+		mb.put(gears.RFMessage{Group: 5, Node: 4, Kind: 7}, time.Hour)
+		Ω(s1.State).Should(Equal(gears.MailQueued))
+		Ω(s2.Id).Should(BeNumerically(">", s1.Id))
+		Ω(mb.list(5, 3)).Should(HaveLen(2))
+		Ω(mb.list(0, 0)).Should(HaveLen(3))
+		Ω(events).Should(HaveLen(3))
+
+		mail := mb.take(5, 3)
+		Ω(mail).Should(HaveLen(2))
+		Ω(mail[0].msg.Kind).Should(Equal(byte(7)))
+		Ω(mb.take(5, 3)).Should(BeEmpty())
+		Ω(mb.list(0, 0)).Should(HaveLen(1))
+
+		mb.done(mail[0], nil)
+		mb.done(mail[1], gears.AckTimeoutError)
+		for i := 0; i < 3; i++ {
+			<-events
+		}
+		s := <-events
+		Ω(s.Id).Should(Equal(s1.Id))
+		Ω(s.State).Should(Equal(gears.MailDelivered))
+		Ω(s.DoneAt).ShouldNot(BeZero())
+		s = <-events
+		Ω(s.State).Should(Equal(gears.MailFailed))
+		Ω(s.Error).Should(Equal(gears.AckTimeoutError.Error()))
+	})
+
+	It("replaces messages of the same kind", func() {
+		s1 := mb.put(gears.RFMessage{Group: 5, Node: 3, Kind: 7, Data: []byte{1}}, time.Hour)
+		mb.put(gears.RFMessage{Group: 5, Node: 3, Kind: 7, Data: []byte{2}}, time.Hour)
+		<-events
+		s := <-events
+		Ω(s.Id).Should(Equal(s1.Id))
+		Ω(s.State).Should(Equal(gears.MailReplaced))
+		mail := mb.take(5, 3)
+		Ω(mail).Should(HaveLen(1))
+		Ω(mail[0].msg.Data).Should(Equal([]byte{2}))
+	})
+
+	It("expires messages", func() {
+		s1 := mb.put(gears.RFMessage{Group: 5, Node: 3, Kind: 7}, 20*time.Millisecond)
+		Ω(s1.Expires - s1.QueuedAt).Should(Equal(int64(20)))
+		<-events
+		s := <-events
+		Ω(s.Id).Should(Equal(s1.Id))
+		Ω(s.State).Should(Equal(gears.MailExpired))
+		Ω(mb.list(0, 0)).Should(BeEmpty())
+	})
+})
@@ -10,11 +10,13 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"log"
 	"net"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/tve/widuino/gears"
@@ -24,15 +26,44 @@ import (
 const dbPath = "_data"
 
 var bootConfig = flag.String("bootConfig", "sketches.json", "config file for boot server")
+var convertConfig = flag.Bool("convertBootConfig", false, "print the boot config in the structured format and exit")
+var ackRetries = flag.Int("ackRetries", DefaultAckRetries, "retransmissions of unACKed RF messages")
+var ackTimeout = flag.Duration("ackTimeout", DefaultAckTimeout, "initial RF ACK timeout, doubles per retry")
+var dedupWindow = flag.Duration("dedupWindow", DefaultDedupWindow, "window for dropping copies of RF packets heard by several gateways")
+var offlineFactor = flag.Float64("offlineFactor", DefaultOfflineFactor, "reporting intervals a node may miss before it's deemed offline")
+var offlineAfter = flag.Duration("offlineAfter", DefaultOfflineAfter, "silence after which a node whose reporting interval is unknown is deemed offline")
+var mailExpiry = flag.Duration("mailExpiry", DefaultMailExpiry, "how long messages for sleeping nodes are held")
+var serialPort = flag.String("serial", "", "serial port of an RF12demo node to use as gateway alongside the UDP ones")
+var serialBaud = flag.Int("serialBaud", 57600, "baud rate of the serial gateway")
+var serialGroup = flag.Int("serialGroup", 0, "RF group of the serial gateway if it doesn't print its config")
+var mqttBroker = flag.String("mqtt", "", "URL of the MQTT broker to bridge RF messages and sensor values to, e.g. tcp://localhost:1883")
+var mqttId = flag.String("mqttId", "widuino-hub", "MQTT client ID")
+var mqttUser = flag.String("mqttUser", "", "MQTT username")
+var mqttPass = flag.String("mqttPass", "", "MQTT password")
+var mqttRFTopic = flag.String("mqttRfTopic", DefaultMQTTRFTopic, "prefix of the MQTT topics for RF messages")
+var mqttSensorTopic = flag.String("mqttSensorTopic", DefaultMQTTSensorTopic, "prefix of the MQTT topics for sensor values")
+var haPrefix = flag.String("haPrefix", DefaultHAPrefix, "Home Assistant MQTT discovery prefix, empty to not announce the sensors")
+var haTopic = flag.String("haTopic", DefaultHATopic, "prefix of the MQTT topics for the state and commands of Home Assistant entities")
+var httpAddr = flag.String("http", DefaultHTTPAddr, "address to serve the HTTP/JSON API on, empty to not serve it")
+var httpOrigin = flag.String("httpOrigin", "", "origin of the web pages allowed to use the HTTP API, e.g. http://dash.example.com, * for any, empty for none")
 
 // handle to (global) levelDB database
 var db *database.DB
 
+// JeeBoot server, handles the boot protocol for the UDP gateway
+var boot *booter
+
+// UDP gateway, talks to the UDP/RF gateway nodes
+var udpGw *UDPGateway
+
+// Node liveness tracker, knows which nodes are online
+var liveness *livenessTracker
+
 // received messages are broadcast to a set of receivers, each attached to a channel
 var recvProcessors []chan gears.RFMessage
 var processorsLock sync.Mutex // guard changes to recvProcessors array
 // to transmit a message anyone can push into the xmit channel
-var xmitChan chan gears.RFMessage
+var xmitChan chan XmitRequest
 
 func RegisterRecvProcessor(f func(chan gears.RFMessage)) {
 	if recvProcessors == nil {
@@ -45,11 +76,33 @@ func RegisterRecvProcessor(f func(chan gears.RFMessage)) {
 	go f(ch)
 }
 
+// sendRF sends an RF message the way the RF send requests of clients are sent
+func sendRF(m gears.RFMessage) error {
+	req := gears.RFSendRequest(m)
+	if r := HandleRFSendRequest(&req); r.Code != gears.CodeOK {
+		return errors.New(r.Error)
+	}
+	return nil
+}
+
+// sleepy tells whether a node sleeps according to its node info
+func sleepy(group, node byte) bool {
+	ni, err := db.GetNodeInfo(group, node)
+	return err == nil && ni.Sleepy
+}
+
 //===== Main
 
 func main() {
 	flag.Parse()
 
+	if *convertConfig {
+		if err := convertBootConfig(*bootConfig, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// open database
 	var err error
 	db, err = database.Open(dbPath)
@@ -57,9 +110,31 @@ func main() {
 		glog.Fatalf("Cannot open database %s: %s", dbPath, err.Error())
 	}
 
+	// bridge to MQTT, the sensor hooks have to be in place before the decoder starts
+	if *mqttBroker != "" {
+		bridge := &MQTTBridge{Broker: *mqttBroker, ClientId: *mqttId, User: *mqttUser,
+			Pass: *mqttPass, RFTopic: *mqttRFTopic, SensorTopic: *mqttSensorTopic, Send: sendRF}
+		if *haPrefix != "" {
+			ha := newHomeAssistant(bridge, db)
+			ha.Prefix, ha.Topic = *haPrefix, *haTopic
+			ha.Start()
+			RegisterSensorHook(ha.Seen)
+		}
+		bridge.Start()
+		RegisterRecvProcessor(bridge.Processor)
+		RegisterSensorHook(bridge.PublishSensor)
+	}
+
 	// register processors
 	RegisterRecvProcessor(LogProcessor)
 	RegisterRecvProcessor(db.NewProcessor())
+	RegisterRecvProcessor(DecodeProcessor)
+	RegisterRecvProcessor(db.RolloutProcessor())
+	liveness = newLivenessTracker(db)
+	liveness.Factor = *offlineFactor
+	liveness.After = *offlineAfter
+	RegisterRecvProcessor(liveness.Processor)
+	go liveness.Run(10 * time.Second)
 
 	// start receiver mux - forwards to all recvProcessors
 	recv := make(chan gears.RFMessage, 10)
@@ -72,7 +147,23 @@ func main() {
 	}()
 
 	// allocate xmit channel with buffering to allow for retransmit delays
-	xmitChan = make(chan gears.RFMessage, 100)
+	xmitChan = make(chan XmitRequest, 100)
+
+	// the booter and the gateway have to exist before the APIs, which use them, are served
+	boot = NewBooter(*bootConfig, db)
+	if boot == nil {
+		os.Exit(1)
+	}
+	udpGw = &UDPGateway{Port: 9999, Recv: recv, Xmit: xmitChan, Boot: boot,
+		AckRetries: *ackRetries, AckTimeout: *ackTimeout, DedupWindow: *dedupWindow,
+		Sleepy: sleepy, MailExpiry: *mailExpiry, groupMap: &GroupMap{}}
+	if *serialPort != "" {
+		sock, err := OpenSerial(*serialPort, *serialBaud, byte(*serialGroup))
+		if err != nil {
+			log.Fatal(err)
+		}
+		udpGw.AddTransport(serialNetwork, sock)
+	}
 
 	listener, err := net.Listen("tcp", "localhost:9323")
 	if err != nil {
@@ -81,11 +172,15 @@ func main() {
 	glog.Infof("Listening for libchan connections on port 9323")
 	go ServeChan(listener)
 
-	booter := NewBooter(*bootConfig)
-	if booter == nil {
-		os.Exit(1)
+	if *httpAddr != "" {
+		listener, err := net.Listen("tcp", *httpAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		glog.Infof("Listening for HTTP connections on %s", *httpAddr)
+		go ServeHTTP(listener, *httpOrigin)
 	}
-	udpGw := &UDPGateway{Port: 9999, Recv: recv, Xmit: xmitChan, Boot: booter}
+
 	udpGw.Run()
 
 }
@@ -0,0 +1,247 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+// MQTT bridge
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/golang/glog"
+	"github.com/tve/widuino/gears"
+)
+
+// The MQTT bridge publishes the RF messages the hub receives on <RFTopic>/<group>/<node>/rx and
+// the decoded sensor values on <SensorTopic>/<sensor name>, and sends the messages published
+// on <RFTopic>/<group>/<node>/tx over RF, node being null or 0 to broadcast. The RF messages
+// use the JSON payload of the standalone udp-gw, so the tools that consumed its topics keep
+// working while the hub owns the UDP socket. Messages published on tx with QoS 1 or 2 are sent
+// with an ACK request. The bridge keeps trying to connect to the broker and reconnects when
+// the connection drops.
+
+// Default topic prefixes
+const (
+	DefaultMQTTRFTopic     = "/rf"
+	DefaultMQTTSensorTopic = "/sensor"
+)
+
+// mqttRFMessage is the payload of RF messages, the data starts with the kind byte
+type mqttRFMessage struct {
+	AsOf   int64  `json:"_asof"`          // milliseconds since the epoch
+	Kind   string `json:"kind"`           // boot protocol packet kind, the hub handles those
+	Base64 string `json:"base64"`         // the data
+	Rssi   int    `json:"rssi,omitempty"` // in dBm, if the gateway reports it
+}
+
+// mqttSensorValue is the payload of sensor values
+type mqttSensorValue struct {
+	AsOf  int64   `json:"_asof"` // milliseconds since the epoch
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit,omitempty"`
+}
+
+type MQTTBridge struct {
+	Broker      string                        // URL of the broker, e.g. tcp://localhost:1883
+	ClientId    string                        // client ID to connect with
+	User, Pass  string                        // credentials, if the broker needs them
+	RFTopic     string                        // prefix of the RF message topics
+	SensorTopic string                        // prefix of the sensor value topics
+	Send        func(m gears.RFMessage) error // sends a message over RF
+	client      mqtt.Client
+	txTopicRE   *regexp.Regexp // matches the tx topics
+	mutex       sync.Mutex
+	subs        map[string]func(topic string, payload []byte) // handlers of other topics
+	onConnect   []func()                                      // called after each (re)connect
+}
+
+// Start connects to the broker in the background, messages published before the connection
+// is up are dropped
+func (b *MQTTBridge) Start() {
+	if b.RFTopic == "" {
+		b.RFTopic = DefaultMQTTRFTopic
+	}
+	if b.SensorTopic == "" {
+		b.SensorTopic = DefaultMQTTSensorTopic
+	}
+	b.txTopicRE = regexp.MustCompile(`^` + regexp.QuoteMeta(b.RFTopic) + `/(\d+)/(\d+|null)/tx$`)
+
+	opts := mqtt.NewClientOptions().AddBroker(b.Broker).SetClientID(b.ClientId).
+		SetUsername(b.User).SetPassword(b.Pass).
+		SetAutoReconnect(true).SetMaxReconnectInterval(time.Minute).
+		SetOnConnectHandler(b.connected).
+		SetConnectionLostHandler(func(c mqtt.Client, err error) {
+			glog.Warningf("Lost MQTT broker %s: %s", b.Broker, err.Error())
+		})
+	b.client = mqtt.NewClient(opts)
+	go b.connect()
+}
+
+// connect tries to connect to the broker until it succeeds, after that the client
+// reconnects by itself
+func (b *MQTTBridge) connect() {
+	wait := time.Second
+	for {
+		t := b.client.Connect()
+		if t.Wait() && t.Error() == nil {
+			return
+		}
+		glog.Warningf("Cannot connect to MQTT broker %s: %s", b.Broker, t.Error())
+		time.Sleep(wait)
+		if wait < time.Minute {
+			wait *= 2
+		}
+	}
+}
+
+// connected subscribes to the tx topics and the other topics each time the client
+// (re)connects
+func (b *MQTTBridge) connected(c mqtt.Client) {
+	glog.Infof("Connected to MQTT broker %s", b.Broker)
+	b.subscribe(b.RFTopic+"/+/+/tx", b.handleTx)
+	b.mutex.Lock()
+	subs := make(map[string]func(topic string, payload []byte), len(b.subs))
+	for topic, h := range b.subs {
+		subs[topic] = h
+	}
+	onConnect := b.onConnect
+	b.mutex.Unlock()
+	for topic, h := range subs {
+		b.subscribe(topic, handler(h))
+	}
+	for _, f := range onConnect {
+		f()
+	}
+}
+
+func (b *MQTTBridge) subscribe(topic string, h mqtt.MessageHandler) {
+	t := b.client.Subscribe(topic, 1, h)
+	if t.Wait() && t.Error() != nil {
+		glog.Errorf("Cannot subscribe to MQTT %s: %s", topic, t.Error())
+	}
+}
+
+func handler(h func(topic string, payload []byte)) mqtt.MessageHandler {
+	return func(c mqtt.Client, msg mqtt.Message) { h(msg.Topic(), msg.Payload()) }
+}
+
+// Subscribe calls h with the messages published on topic, which may have wildcards, it
+// must be called before Start
+func (b *MQTTBridge) Subscribe(topic string, h func(topic string, payload []byte)) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.subs == nil {
+		b.subs = make(map[string]func(topic string, payload []byte))
+	}
+	b.subs[topic] = h
+}
+
+// OnConnect calls f each time the bridge connects to the broker, e.g. to publish messages
+// the broker may have lost, it must be called before Start
+func (b *MQTTBridge) OnConnect(f func()) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.onConnect = append(b.onConnect, f)
+}
+
+// Close disconnects from the broker
+func (b *MQTTBridge) Close() {
+	b.client.Disconnect(250)
+}
+
+// Processor publishes the received RF messages
+func (b *MQTTBridge) Processor(in chan gears.RFMessage) {
+	go func() {
+		for m := range in {
+			b.PublishRF(m)
+		}
+	}()
+}
+
+// PublishRF publishes a received RF message
+func (b *MQTTBridge) PublishRF(m gears.RFMessage) {
+	p := mqttRFMessage{AsOf: m.At,
+		Base64: base64.StdEncoding.EncodeToString(append([]byte{m.Kind}, m.Data...))}
+	if m.Rx != nil {
+		p.Rssi = m.Rx.Rssi
+	}
+	b.publish(fmt.Sprintf("%s/%d/%d/rx", b.RFTopic, m.Group, m.Node), false, p)
+}
+
+// PublishSensor publishes a decoded sensor value
+func (b *MQTTBridge) PublishSensor(name string, info gears.SensorInfo, v gears.SensorDataValue) {
+	b.publish(b.SensorTopic+"/"+name, false,
+		mqttSensorValue{AsOf: v.At, Value: v.Value, Unit: info.Unit})
+}
+
+// publish publishes the payload encoded in JSON, retained messages are kept by the broker
+// for the clients that subscribe later
+func (b *MQTTBridge) publish(topic string, retain bool, payload interface{}) {
+	buf, err := json.Marshal(payload)
+	if err != nil {
+		glog.Errorf("Cannot encode MQTT payload for %s: %s", topic, err.Error())
+		return
+	}
+	// don't wait for the broker, the publishing mustn't hold up the processing of messages
+	if t := b.client.Publish(topic, 0, retain, buf); t.Error() != nil {
+		glog.V(1).Infof("MQTT PUB %s dropped: %s", topic, t.Error())
+		return
+	}
+	glog.V(2).Infof("MQTT PUB %s len=%d", topic, len(buf))
+}
+
+// handleTx sends a message published on a tx topic over RF
+func (b *MQTTBridge) handleTx(c mqtt.Client, msg mqtt.Message) {
+	m, err := b.parseTx(msg.Topic(), msg.Payload())
+	if err != nil {
+		glog.Warningf("MQTT RCV %s: %s", msg.Topic(), err.Error())
+		return
+	}
+	m.DoAck = msg.Qos() > 0
+	glog.Infof("MQTT RCV %s len=%d", msg.Topic(), len(m.Data)+1)
+	// sending waits for the ACK, don't hold up the other messages meanwhile
+	go func() {
+		if err := b.Send(m); err != nil {
+			glog.Warningf("Cannot send %s from MQTT: %s", m.RfTag(), err.Error())
+		}
+	}()
+}
+
+// parseTx turns the topic and payload of a tx message into an RF message
+func (b *MQTTBridge) parseTx(topic string, payload []byte) (gears.RFMessage, error) {
+	var m gears.RFMessage
+	tt := b.txTopicRE.FindStringSubmatch(topic)
+	if tt == nil {
+		return m, fmt.Errorf("not a tx topic")
+	}
+	group, err := strconv.Atoi(tt[1])
+	if err != nil || group > 255 {
+		return m, fmt.Errorf("invalid group %s", tt[1])
+	}
+	node := 0 // broadcast
+	if tt[2] != "null" {
+		node, err = strconv.Atoi(tt[2])
+	}
+	if err != nil || node > 31 {
+		return m, fmt.Errorf("invalid node %s", tt[2])
+	}
+	var p mqttRFMessage
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return m, fmt.Errorf("cannot parse payload: %s", err.Error())
+	}
+	data, err := base64.StdEncoding.DecodeString(p.Base64)
+	if err != nil {
+		return m, fmt.Errorf("cannot decode base64: %s", err.Error())
+	}
+	if len(data) == 0 {
+		return m, fmt.Errorf("no kind byte")
+	}
+	m = gears.RFMessage{Group: byte(group), Node: byte(node), Kind: data[0], Data: data[1:],
+		At: time.Now().UnixNano() / 1000000}
+	return m, nil
+}
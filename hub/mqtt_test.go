@@ -0,0 +1,248 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+package main
+
+// Omega: Alt+937
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tve/widuino/gears"
+)
+
+// testBroker is a local stand-in for an MQTT broker, it accepts all clients, forwards the
+// messages published to it to the matching subscribers, and hands them to the test
+type testBroker struct {
+	Published chan *packets.PublishPacket // all messages published by clients
+	listener  net.Listener
+	mutex     sync.Mutex
+	subs      map[net.Conn][]string // topic filters by client
+}
+
+func startTestBroker(addr string) (*testBroker, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	tb := &testBroker{Published: make(chan *packets.PublishPacket, 10), listener: l,
+		subs: make(map[net.Conn][]string)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go tb.serve(conn)
+		}
+	}()
+	return tb, nil
+}
+
+func (tb *testBroker) Addr() string { return tb.listener.Addr().String() }
+
+func (tb *testBroker) serve(conn net.Conn) {
+	defer func() {
+		tb.mutex.Lock()
+		delete(tb.subs, conn)
+		tb.mutex.Unlock()
+		conn.Close()
+	}()
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		var reply packets.ControlPacket
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			tb.mutex.Lock()
+			tb.subs[conn] = []string{}
+			tb.mutex.Unlock()
+			reply = packets.NewControlPacket(packets.Connack)
+		case *packets.SubscribePacket:
+			tb.mutex.Lock()
+			tb.subs[conn] = append(tb.subs[conn], p.Topics...)
+			tb.mutex.Unlock()
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID = p.MessageID
+			ack.ReturnCodes = p.Qoss
+			reply = ack
+		case *packets.PublishPacket:
+			if p.Qos > 0 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				reply = ack
+			}
+			tb.Published <- p
+		case *packets.PingreqPacket:
+			reply = packets.NewControlPacket(packets.Pingresp)
+		case *packets.DisconnectPacket:
+			return
+		}
+		if reply != nil {
+			tb.mutex.Lock()
+			err = reply.Write(conn)
+			tb.mutex.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Subscribed returns the topic filters all clients subscribed to
+func (tb *testBroker) Subscribed() []string {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	topics := []string{}
+	for _, t := range tb.subs {
+		topics = append(topics, t...)
+	}
+	return topics
+}
+
+// Publish sends a message to the clients that subscribed to its topic
+func (tb *testBroker) Publish(topic string, qos byte, payload []byte) {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	for conn, filters := range tb.subs {
+		for _, f := range filters {
+			if topicMatches(f, topic) {
+				p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+				p.TopicName, p.Qos, p.MessageID, p.Payload = topic, qos, 1, payload
+				p.Write(conn)
+				break
+			}
+		}
+	}
+}
+
+// Close stops the broker and drops all clients
+func (tb *testBroker) Close() {
+	tb.listener.Close()
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	for conn := range tb.subs {
+		conn.Close()
+	}
+}
+
+// topicMatches tells whether a topic matches a filter with + and # wildcards
+func topicMatches(filter, topic string) bool {
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i := range f {
+		if f[i] == "#" {
+			return true
+		}
+		if i >= len(t) || (f[i] != "+" && f[i] != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+//===== tests =====
+
+var _ = Describe("MQTTBridge", func() {
+	var tb *testBroker
+	var b *MQTTBridge
+	var sent chan gears.RFMessage
+
+	BeforeEach(func() {
+		var err error
+		tb, err = startTestBroker("127.0.0.1:0")
+		Ω(err).ShouldNot(HaveOccurred())
+		sent = make(chan gears.RFMessage, 10)
+		b = &MQTTBridge{Broker: "tcp://" + tb.Addr(), ClientId: "test",
+			Send: func(m gears.RFMessage) error { sent <- m; return nil }}
+		b.Start()
+		Eventually(tb.Subscribed).Should(Equal([]string{"/rf/+/+/tx"}))
+	})
+
+	AfterEach(func() {
+		b.Close()
+		tb.Close()
+	})
+
+	It("publishes RF messages", func() {
+		in := make(chan gears.RFMessage)
+		b.Processor(in)
+		in <- gears.RFMessage{At: 1000, Group: 212, Node: 3, Kind: 4, Data: []byte{70, 71},
+			Rx: &gears.RxInfo{Rssi: -68}}
+		close(in)
+		p := <-tb.Published
+		Ω(p.TopicName).Should(Equal("/rf/212/3/rx"))
+		var m mqttRFMessage
+		Ω(json.Unmarshal(p.Payload, &m)).Should(Succeed())
+		Ω(m).Should(Equal(mqttRFMessage{AsOf: 1000, Rssi: -68,
+			Base64: base64.StdEncoding.EncodeToString([]byte{4, 70, 71})}))
+	})
+
+	It("publishes sensor values", func() {
+		b.PublishSensor("basement/heating/temp0", gears.SensorInfo{Unit: "F"},
+			gears.SensorDataValue{At: 2000, Value: 70})
+		p := <-tb.Published
+		Ω(p.TopicName).Should(Equal("/sensor/basement/heating/temp0"))
+		Ω(string(p.Payload)).Should(Equal(`{"_asof":2000,"value":70,"unit":"F"}`))
+	})
+
+	It("sends tx messages over RF", func() {
+		payload := []byte(`{"base64":"` + base64.StdEncoding.EncodeToString([]byte{7, 1, 2}) + `"}`)
+		tb.Publish("/rf/212/3/tx", 1, payload)
+		m := <-sent
+		Ω(m.Group).Should(Equal(byte(212)))
+		Ω(m.Node).Should(Equal(byte(3)))
+		Ω(m.Kind).Should(Equal(byte(7)))
+		Ω(m.Data).Should(Equal([]byte{1, 2}))
+		Ω(m.DoAck).Should(BeTrue())
+		tb.Publish("/rf/212/0/tx", 0, payload)
+		m = <-sent
+		Ω(m.Node).Should(Equal(byte(0)))
+		Ω(m.DoAck).Should(BeFalse())
+		tb.Publish("/rf/212/null/tx", 0, payload)
+		m = <-sent
+		Ω(m.Group).Should(Equal(byte(212)))
+		Ω(m.Node).Should(Equal(byte(0)))
+	})
+
+	It("drops bad tx messages", func() {
+		tb.Publish("/rf/212/3/tx", 0, []byte(`{"base64":`))
+		tb.Publish("/rf/212/3/tx", 0, []byte(`{"base64":""}`))
+		tb.Publish("/rf/212/40/tx", 0, []byte(`{"base64":"Bw=="}`))
+		tb.Publish("/rf/300/3/tx", 0, []byte(`{"base64":"Bw=="}`))
+		tb.Publish("/rf/212/4/tx", 0, []byte(`{"base64":"Bw=="}`))
+		Ω((<-sent).Node).Should(Equal(byte(4)))
+		Consistently(sent).ShouldNot(Receive())
+	})
+
+	It("reconnects to the broker", func() {
+		addr := tb.Addr()
+		tb.Close()
+		time.Sleep(10 * time.Millisecond)
+		var err error
+		tb, err = startTestBroker(addr)
+		Ω(err).ShouldNot(HaveOccurred())
+		Eventually(tb.Subscribed, 5*time.Second).Should(Equal([]string{"/rf/+/+/tx"}))
+		b.PublishSensor("x", gears.SensorInfo{}, gears.SensorDataValue{At: 1, Value: 2})
+		Ω((<-tb.Published).TopicName).Should(Equal("/sensor/x"))
+	})
+
+	It("uses the configured topics", func() {
+		b.Close()
+		b = &MQTTBridge{Broker: "tcp://" + tb.Addr(), ClientId: "test2", RFTopic: "home/rf",
+			SensorTopic: "home/sensor", Send: func(m gears.RFMessage) error { sent <- m; return nil }}
+		b.Start()
+		Eventually(tb.Subscribed).Should(Equal([]string{"home/rf/+/+/tx"}))
+		tb.Publish("home/rf/5/2/tx", 0, []byte(`{"base64":"Bw=="}`))
+		Ω((<-sent).Group).Should(Equal(byte(5)))
+		b.PublishRF(gears.RFMessage{Group: 5, Node: 2})
+		Ω((<-tb.Published).TopicName).Should(Equal("home/rf/5/2/rx"))
+	})
+})
@@ -0,0 +1,55 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var baudRates = map[int]uint32{
+	9600: syscall.B9600, 19200: syscall.B19200, 38400: syscall.B38400,
+	57600: syscall.B57600, 115200: syscall.B115200,
+}
+
+const cbaud = 0x100f // mask of the baud rate bits in Cflag, missing from syscall
+
+// openSerialPort opens a serial port in raw mode at the given baud rate
+func openSerialPort(device string, baud int) (*os.File, error) {
+	speed, ok := baudRates[baud]
+	if !ok {
+		return nil, fmt.Errorf("unsupported baud rate %d", baud)
+	}
+	f, err := os.OpenFile(device, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+	var t syscall.Termios
+	if err := ioctl(f, syscall.TCGETS, unsafe.Pointer(&t)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB | cbaud
+	t.Cflag |= syscall.CS8 | syscall.CREAD | syscall.CLOCAL | speed
+	t.Ispeed, t.Ospeed = speed, speed
+	t.Cc[syscall.VMIN], t.Cc[syscall.VTIME] = 1, 0
+	if err := ioctl(f, syscall.TCSETS, unsafe.Pointer(&t)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+package main
+
+// Omega: Alt+937
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tve/widuino/gears"
+	"github.com/tve/widuino/hub/jeesim"
+)
+
+// openPty opens a pseudo-terminal and returns its master side and the name of the slave
+func openPty() (*os.File, string, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	var unlock int32
+	if err := ioctl(master, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		master.Close()
+		return nil, "", err
+	}
+	var n uint32
+	if err := ioctl(master, syscall.TIOCGPTN, unsafe.Pointer(&n)); err != nil {
+		master.Close()
+		return nil, "", err
+	}
+	return master, fmt.Sprintf("/dev/pts/%d", n), nil
+}
+
+//===== tests =====
+
+var _ = Describe("UDPGw with a serial gateway", func() {
+	var u *UDPGateway
+	var node *os.File // plays the part of the RF12demo node
+	var name string
+	var cmds *bufio.Reader
+
+	BeforeEach(func() {
+		var err error
+		node, name, err = openPty()
+		Ω(err).ShouldNot(HaveOccurred())
+		cmds = bufio.NewReader(node)
+		serial, err := OpenSerial(name, 57600, 212)
+		Ω(err).ShouldNot(HaveOccurred())
+		sock, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+		Ω(err).ShouldNot(HaveOccurred())
+		u = &UDPGateway{
+			Recv: make(chan gears.RFMessage, 10), Xmit: make(chan XmitRequest, 10),
+			AckRetries: 2, AckTimeout: 20 * time.Millisecond, sock: sock,
+		}
+		u.AddTransport(serialNetwork, serial)
+		go u.Run()
+		m := <-u.Recv // the hello
+		Ω(m.Kind).Should(Equal(byte(2)))
+		Ω(m.Group).Should(Equal(byte(212)))
+	})
+
+	AfterEach(func() {
+		close(u.Xmit)
+		u.transports[serialNetwork].Close()
+		u.sock.Close()
+		node.Close()
+	})
+
+	It("receives packets", func() {
+		fmt.Fprint(node, "OK 3 4 70 71 (-68)\r\n")
+		m := <-u.Recv
+		Ω(m.Group).Should(Equal(byte(212)))
+		Ω(m.Node).Should(Equal(byte(3)))
+		Ω(m.Kind).Should(Equal(byte(4)))
+		Ω(m.Data).Should(Equal([]byte{70, 71}))
+		Ω(m.Rx).Should(Equal(&gears.RxInfo{Gateway: name, Rssi: -68, Seq: 1}))
+	})
+
+	It("leaves the ACKs to the node", func() {
+		fmt.Fprint(node, "OK 35 4 70\r\n")
+		Ω((<-u.Recv).Node).Should(Equal(byte(3)))
+		reply := make(chan error, 1)
+		u.Xmit <- XmitRequest{gears.RFMessage{Group: 212, Node: 3, Kind: 7}, reply}
+		Ω(<-reply).Should(BeNil())
+		Ω(cmds.ReadString('\n')).Should(Equal("7,3s\n"))
+	})
+
+	It("sends data_req packets and gets the ACK", func() {
+		reply := make(chan error, 1)
+		u.Xmit <- XmitRequest{gears.RFMessage{Group: 212, Node: 3, DoAck: true, Kind: 7,
+			Data: []byte{1, 2}}, reply}
+		Ω(cmds.ReadString('\n')).Should(Equal("7,1,2,3a\n"))
+		fmt.Fprint(node, "OK 131\r\n")
+		Ω(<-reply).Should(BeNil())
+	})
+
+	It("follows the group in the node's config", func() {
+		fmt.Fprint(node, "\r\n[RF12demo.12] _ i1 g5 @ 868 MHz c1 q1\r\n")
+		m := <-u.Recv
+		Ω(m.Group).Should(Equal(byte(5)))
+		Ω(string(m.Data)).Should(ContainSubstring("g5 @ 868 MHz"))
+		fmt.Fprint(node, "OK 2 9\r\n")
+		Ω((<-u.Recv).Group).Should(Equal(byte(5)))
+		reply := make(chan error, 1)
+		u.Xmit <- XmitRequest{gears.RFMessage{Group: 5, Node: 2, Kind: 7}, reply}
+		Ω(<-reply).Should(BeNil())
+		Ω(cmds.ReadString('\n')).Should(Equal("7,2s\n"))
+	})
+
+	It("runs alongside UDP gateways", func() {
+		gw, err := jeesim.NewGateway(u.sock.(*net.UDPConn).LocalAddr().(*net.UDPAddr), 212)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer gw.Close()
+		Ω((<-u.Recv).Kind).Should(Equal(byte(2))) // the gateway's hello
+		Ω(gw.Send(4, jeesim.KindOwTemp, []byte{70}, false)).Should(Succeed())
+		Ω((<-u.Recv).Node).Should(Equal(byte(4)))
+		fmt.Fprint(node, "OK 3 4 70\r\n")
+		Ω((<-u.Recv).Node).Should(Equal(byte(3)))
+
+		// each node is sent to through the gateway that heard it
+		reply := make(chan error, 1)
+		u.Xmit <- XmitRequest{gears.RFMessage{Group: 212, Node: 3, Kind: 7}, reply}
+		Ω(<-reply).Should(BeNil())
+		Ω(cmds.ReadString('\n')).Should(Equal("7,3s\n"))
+		u.Xmit <- XmitRequest{gears.RFMessage{Group: 212, Node: 4, Kind: 7}, reply}
+		Ω(<-reply).Should(BeNil())
+		Ω(<-gw.Delivered).Should(Equal(jeesim.Packet{Node: 4, Kind: 7, Data: []byte{}}))
+	})
+})
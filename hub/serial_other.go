@@ -0,0 +1,16 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// openSerialPort is only implemented for Linux
+func openSerialPort(device string, baud int) (*os.File, error) {
+	return nil, fmt.Errorf("serial ports are only supported on Linux")
+}
@@ -0,0 +1,223 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+// Serial port transport for the UDP gateway
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// SerialTransport talks to a JeeLink, or any RF node running RF12demo or an RFM69 sketch with
+// the same text interface, on a serial port. It turns the lines the node prints for the
+// packets it receives, e.g. "OK 35 4 70 71 (-68)", into packets in the UDP framing and the
+// packets the hub sends into the node's send commands, e.g. "4,70,3a". RF12demo ACKs packets
+// by itself and can't send JeeBoot replies, so ACKs from the hub are dropped and nodes can't
+// boot through it.
+type SerialTransport struct {
+	port   io.ReadWriteCloser
+	lines  *bufio.Reader
+	addr   serialAddr
+	mutex  sync.Mutex
+	group  byte // RF group the node listens to
+	seq    byte // sequence number of the received packets
+	hello  bool // the hello packet that makes the hub learn the group is still due
+	closed bool
+}
+
+const serialNetwork = "serial"
+
+// serialAddr is the address of the gateway on a serial port, i.e., the name of the port
+type serialAddr string
+
+func (a serialAddr) Network() string { return serialNetwork }
+func (a serialAddr) String() string  { return string(a) }
+
+// RF12 header bits
+const (
+	rf12HdrCtl  = 0x80
+	rf12HdrDst  = 0x40
+	rf12HdrAck  = 0x20
+	rf12HdrMask = 0x1F
+)
+
+// the node's config line, e.g. "[RF12demo.12] _ i31* g212 @ 868 MHz c1 q1"
+var serialConfigRe = regexp.MustCompile(`\bg(\d+) @ \d+ MHz`)
+
+// OpenSerial opens a serial port at the given baud rate, group is the RF group the node
+// listens to, it gets updated when the node prints its config
+func OpenSerial(device string, baud int, group byte) (*SerialTransport, error) {
+	port, err := openSerialPort(device, baud)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s: %s", device, err.Error())
+	}
+	glog.Infof("Talking to RF group %d on %s at %d baud", group, device, baud)
+	return NewSerialTransport(port, device, group), nil
+}
+
+// NewSerialTransport creates a transport for a node connected to port, name is the name of
+// the port
+func NewSerialTransport(port io.ReadWriteCloser, name string, group byte) *SerialTransport {
+	return &SerialTransport{port: port, lines: bufio.NewReader(port), addr: serialAddr(name),
+		group: group, hello: group != 0}
+}
+
+// ReadFrom reads lines from the node until it prints one about a packet and returns the
+// packet, it returns net.ErrClosed once the port is closed or fails
+func (s *SerialTransport) ReadFrom(pkt []byte) (int, net.Addr, error) {
+	s.mutex.Lock()
+	hello, group := s.hello, s.group
+	s.hello = false
+	s.mutex.Unlock()
+	if hello {
+		p := debugPacket(group, "serial gateway on "+string(s.addr))
+		return copy(pkt, p), s.addr, nil
+	}
+
+	for {
+		line, err := s.lines.ReadString('\n')
+		if err != nil {
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if !closed {
+				glog.Errorf("Serial port %s failed: %s", s.addr, err.Error())
+			}
+			return 0, s.addr, net.ErrClosed
+		}
+		line = strings.TrimSpace(line)
+		glog.V(2).Infof("Serial %s: %s", s.addr, line)
+		if p := s.parseLine(line); p != nil {
+			return copy(pkt, p), s.addr, nil
+		}
+	}
+}
+
+// parseLine turns a line printed by the node into a packet, returns nil if the line isn't
+// about a packet
+func (s *SerialTransport) parseLine(line string) []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if m := serialConfigRe.FindStringSubmatch(line); m != nil {
+		if g, err := strconv.Atoi(m[1]); err == nil && g < 256 {
+			s.group = byte(g)
+			return debugPacket(s.group, line)
+		}
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "OK" {
+		return nil
+	}
+	fields = fields[1:]
+
+	group := s.group
+	if g := fields[0]; g[0] == 'G' { // the node listens to all groups
+		v, err := strconv.ParseUint(g[1:], 10, 8)
+		if err != nil {
+			return nil
+		}
+		group = byte(v)
+		fields = fields[1:]
+		if len(fields) == 0 {
+			return nil
+		}
+	}
+	rssi := 0
+	if r := fields[len(fields)-1]; r[0] == '(' && r[len(r)-1] == ')' { // RFM69 signal strength
+		v, err := strconv.Atoi(r[1 : len(r)-1])
+		if err != nil || v > 0 || v < -255 {
+			return nil
+		}
+		rssi = v
+		fields = fields[:len(fields)-1]
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	data := make([]byte, len(fields))
+	for i, f := range fields {
+		v, err := strconv.ParseUint(f, 10, 8)
+		if err != nil {
+			return nil
+		}
+		data[i] = byte(v)
+	}
+
+	hdr := data[0]
+	var flags byte
+	switch {
+	case hdr&rf12HdrCtl != 0 && hdr&rf12HdrAck != 0 && hdr&rf12HdrDst != 0:
+		flags = RF_Pairing
+	case hdr&rf12HdrCtl != 0 && hdr&rf12HdrAck != 0:
+		flags = RF_BootReq
+	case hdr&rf12HdrCtl != 0:
+		flags = RF_AckData
+	case hdr&rf12HdrAck != 0:
+		flags = RF_BcastReq
+	default:
+		flags = RF_BcastPush
+	}
+	s.seq++
+	pkt := []byte{flags | RF_RxInfo, group, hdr & rf12HdrMask, 0, byte(-rssi), 0, s.seq}
+	return append(pkt, data[1:]...)
+}
+
+// debugPacket makes a packet with text for the log, as the UDP/RF gateway nodes send
+func debugPacket(group byte, text string) []byte {
+	if len(text) > maxPayload {
+		text = text[:maxPayload]
+	}
+	return append([]byte{RF_Debug, group, 0}, text...)
+}
+
+// WriteTo sends a packet through the node, addr is ignored as there is only one node
+func (s *SerialTransport) WriteTo(pkt []byte, addr net.Addr) (int, error) {
+	if len(pkt) < 3 {
+		return 0, fmt.Errorf("packet too short")
+	}
+	flags, group, node := pkt[0], pkt[1], pkt[2]
+	var cmd byte
+	switch flags {
+	case RF_BcastPush, RF_DataPush:
+		cmd = 's'
+	case RF_DataReq:
+		cmd = 'a'
+	case RF_AckBcast:
+		return len(pkt), nil // the node ACKed the packet already
+	default:
+		return 0, fmt.Errorf("serial gateway cannot send packets with flags %d", flags)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if group != s.group {
+		return 0, fmt.Errorf("serial gateway is on RF group %d, not %d", s.group, group)
+	}
+	buf := bytes.Buffer{}
+	for _, b := range pkt[3:] {
+		fmt.Fprintf(&buf, "%d,", b)
+	}
+	fmt.Fprintf(&buf, "%d%c\n", node, cmd)
+	if _, err := s.port.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(pkt), nil
+}
+
+// Close closes the serial port
+func (s *SerialTransport) Close() error {
+	s.mutex.Lock()
+	s.closed = true
+	s.mutex.Unlock()
+	return s.port.Close()
+}
@@ -0,0 +1,103 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+package main
+
+// Omega: Alt+937
+
+import (
+	"bytes"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakePort plays the part of the serial port, it reads what the node prints from in and
+// collects what the hub writes in out
+type fakePort struct {
+	in  *strings.Reader
+	out bytes.Buffer
+}
+
+func (p *fakePort) Read(b []byte) (int, error)  { return p.in.Read(b) }
+func (p *fakePort) Write(b []byte) (int, error) { return p.out.Write(b) }
+func (p *fakePort) Close() error                { return nil }
+
+//===== tests =====
+
+var _ = Describe("SerialTransport", func() {
+	var port *fakePort
+	var s *SerialTransport
+
+	BeforeEach(func() {
+		port = &fakePort{in: strings.NewReader("")}
+		s = NewSerialTransport(port, "/dev/ttyUSB0", 212)
+	})
+
+	It("parses received packets", func() {
+		Ω(s.parseLine("OK 3 4 70 71")).Should(Equal(
+			[]byte{RF_BcastPush | RF_RxInfo, 212, 3, 0, 0, 0, 1, 4, 70, 71}))
+		Ω(s.parseLine("OK 35 4 70 (-68)")).Should(Equal(
+			[]byte{RF_BcastReq | RF_RxInfo, 212, 3, 0, 68, 0, 2, 4, 70}))
+		Ω(s.parseLine("OK G5 2 9")).Should(Equal(
+			[]byte{RF_BcastPush | RF_RxInfo, 5, 2, 0, 0, 0, 3, 9}))
+	})
+
+	It("parses control packets", func() {
+		Ω(s.parseLine("OK 131")[0]).Should(Equal(byte(RF_AckData | RF_RxInfo)))
+		Ω(s.parseLine("OK 163 1 2")[0]).Should(Equal(byte(RF_BootReq | RF_RxInfo)))
+		Ω(s.parseLine("OK 227 1 2")[0]).Should(Equal(byte(RF_Pairing | RF_RxInfo)))
+	})
+
+	It("ignores other lines", func() {
+		Ω(s.parseLine("")).Should(BeNil())
+		Ω(s.parseLine(" ? 3 4 70")).Should(BeNil())
+		Ω(s.parseLine("OK 3 x")).Should(BeNil())
+		Ω(s.parseLine("OK 3 300")).Should(BeNil())
+		Ω(s.parseLine("OK (-68)")).Should(BeNil())
+		Ω(s.parseLine("OK G5")).Should(BeNil())
+		Ω(s.parseLine("OK G5 (-68)")).Should(BeNil())
+		Ω(s.parseLine("-> ack")).Should(BeNil())
+	})
+
+	It("learns the group from the config", func() {
+		p := s.parseLine("[RF12demo.12] _ i1 g5 @ 868 MHz c1 q1")
+		Ω(p[:3]).Should(Equal([]byte{RF_Debug, 5, 0}))
+		Ω(string(p[3:])).Should(ContainSubstring("g5 @ 868 MHz"))
+		Ω(s.parseLine("OK 3 4")[1]).Should(Equal(byte(5)))
+	})
+
+	It("reads packets and skips the rest", func() {
+		port.in = strings.NewReader("\r\n[RF12demo.12] i1 g6 @ 868 MHz\r\nhello\r\nOK 3 4 70\r\n")
+		s = NewSerialTransport(port, "/dev/ttyUSB0", 0)
+		pkt := make([]byte, 100)
+		n, addr, err := s.ReadFrom(pkt)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(addr.String()).Should(Equal("/dev/ttyUSB0"))
+		Ω(pkt[:3]).Should(Equal([]byte{RF_Debug, 6, 0}))
+		n, _, err = s.ReadFrom(pkt)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pkt[:n]).Should(Equal([]byte{RF_BcastPush | RF_RxInfo, 6, 3, 0, 0, 0, 1, 4, 70}))
+		_, _, err = s.ReadFrom(pkt)
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("sends packets", func() {
+		_, err := s.WriteTo([]byte{RF_DataPush, 212, 3, 7, 1, 2}, s.addr)
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = s.WriteTo([]byte{RF_DataReq, 212, 4}, s.addr)
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = s.WriteTo([]byte{RF_BcastPush, 212, 0, 9}, s.addr)
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = s.WriteTo([]byte{RF_AckBcast, 212, 3}, s.addr)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(port.out.String()).Should(Equal("7,1,2,3s\n4a\n9,0s\n"))
+	})
+
+	It("refuses what it can't send", func() {
+		_, err := s.WriteTo([]byte{RF_DataPush, 5, 3, 7}, s.addr)
+		Ω(err).Should(HaveOccurred())
+		_, err = s.WriteTo([]byte{RF_BootReply, 212, 3, 1}, s.addr)
+		Ω(err).Should(HaveOccurred())
+		Ω(port.out.Len()).Should(Equal(0))
+	})
+})
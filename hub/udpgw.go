@@ -16,7 +16,10 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"net"
+	"sort"
 	"sync"
 	"time"
 
@@ -38,34 +41,114 @@ const (
 	RF_Debug
 )
 
-// UDP Gateway communicates with UDP/RF gateway nodes via UDP
+// Flag in the message type code: the header is followed by the reception metadata, which is
+// the gateway's ID, the RSSI in -dBm, the LNA gain, and the gateway's sequence number
+const (
+	RF_RxInfo  = 0x80
+	rxInfoLen  = 4
+	maxPayload = 66
+)
+
+// Default ACK handling parameters
+const (
+	DefaultAckRetries = 3
+	DefaultAckTimeout = 250 * time.Millisecond
+)
+
+// Request to transmit a message, if Reply is non-nil the outcome is reported on it: nil if
+// the message was sent (and ACKed if DoAck is set), gears.AckTimeoutError if no ACK
+// arrived after all retries, or some other error if the message could not be sent at all
+type XmitRequest struct {
+	Msg   gears.RFMessage
+	Reply chan error // should be buffered, at most one value is sent
+}
+
+// Transport carries packets in the UDP framing (flags, group, node, payload) between the hub
+// and the gateways, each gateway having its own address. A *net.UDPConn is the transport for
+// UDP/RF gateway nodes.
+type Transport interface {
+	ReadFrom(pkt []byte) (int, net.Addr, error)
+	WriteTo(pkt []byte, addr net.Addr) (int, error)
+	Close() error
+}
+
+// UDP Gateway communicates with UDP/RF gateway nodes via UDP and, alongside, with other
+// gateways such as a JeeLink on a serial port using a SerialTransport
 // Registers as "UDP-Gateway"
 type UDPGateway struct {
-	Port     int                  // UDP port number
-	Recv     chan gears.RFMessage // channel for received messages
-	Xmit     chan gears.RFMessage // channel to transmit messages
-	Boot     Booter               // where to call to get boot data
-	sock     *net.UDPConn
-	groupMap *GroupMap // map between groups and GW IP addresses
+	Port        int                         // UDP port number
+	Recv        chan gears.RFMessage        // channel for received messages
+	Xmit        chan XmitRequest            // channel to transmit messages
+	Boot        Booter                      // where to call to get boot data
+	AckRetries  int                         // number of retransmissions if no ACK is received
+	AckTimeout  time.Duration               // time to wait for first ACK, doubles at each retry
+	DedupWindow time.Duration               // window for copies heard by several GWs, <0 to disable
+	Sleepy      func(group, node byte) bool // tells whether a node sleeps, may be nil
+	MailExpiry  time.Duration               // how long messages for sleeping nodes are held
+	sock        Transport                   // how packets reach the UDP GWs, opened by Run if nil
+	transports  map[string]Transport        // other transports by the network of their GWs
+	groupMap    *GroupMap                   // map between groups and GW IP addresses
+	acks        *AckTable                   // sends awaiting an ACK
+	dups        *DupFilter                  // copies of packets heard by several GWs
+	mailbox     Mailbox                     // messages held for sleeping nodes
 }
 
 func (u *UDPGateway) Run() {
 	if u.groupMap == nil {
-		u.groupMap = &GroupMap{group: make(map[byte]*net.UDPAddr)}
+		u.groupMap = &GroupMap{}
+	}
+	if u.acks == nil {
+		u.acks = &AckTable{}
+	}
+	if u.AckTimeout == 0 {
+		u.AckTimeout = DefaultAckTimeout
+	}
+	if u.DedupWindow == 0 {
+		u.DedupWindow = DefaultDedupWindow
+	}
+	if u.dups == nil {
+		u.dups = &DupFilter{Window: u.DedupWindow}
+	}
+	if u.sock == nil {
+		u.Listen(u.Port)
 	}
-	u.Listen(u.Port)
 	go u.Transmitter()
 	//go u.Booter()
-	u.Receiver()
+	for _, sock := range u.transports {
+		go u.Receiver(sock)
+	}
+	u.Receiver(u.sock)
+}
+
+// AddTransport adds a transport for the GWs whose addresses are on the network, e.g. a
+// SerialTransport for the "serial" network, it must be called before Run
+func (u *UDPGateway) AddTransport(network string, sock Transport) {
+	if u.transports == nil {
+		u.transports = make(map[string]Transport)
+	}
+	u.transports[network] = sock
+}
+
+// transport returns the transport that reaches the GW at addr
+func (u *UDPGateway) transport(addr net.Addr) Transport {
+	if sock, ok := u.transports[addr.Network()]; ok {
+		return sock
+	}
+	return u.sock
 }
 
 // send a packet (here the flags are 0..7)
-func (u *UDPGateway) sendPacket(group, node, flags byte, data []byte) {
-	// find UDP gateway's address
-	addr := u.groupMap.mapGroupToAddr(group)
-	if addr == nil {
+func (u *UDPGateway) sendPacket(group, node, flags byte, data []byte) error {
+	// find UDP gateway's address, broadcasts go out through all the group's gateways
+	var addrs []net.Addr
+	if node == 0 {
+		addrs = u.groupMap.mapGroupToAddrs(group)
+	} else if addr := u.groupMap.mapNodeToAddr(group, node); addr != nil {
+		addrs = []net.Addr{addr}
+	}
+	if len(addrs) == 0 {
 		glog.Warningf("No GW known for RF group %d", group)
-		return
+		return fmt.Errorf("no GW known for RF group %d", group)
 	}
 	// puts the UDP packet together
 	buf := make([]byte, len(data)+3)
@@ -77,18 +160,75 @@ func (u *UDPGateway) sendPacket(group, node, flags byte, data []byte) {
 	glog.Infof("UDP Send RFg%03di%02d len=%d", group, node, len(buf))
 	glog.V(2).Infof("  Send: %+v", buf)
 	glog.V(4).Infof("  Pkt=%#v", buf)
-	u.sock.WriteToUDP(buf, addr)
+	for _, addr := range addrs {
+		if _, err := u.transport(addr).WriteTo(buf, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Gateways returns the UDP/RF gateways and how well they hear each node
+func (u *UDPGateway) Gateways() []gears.GatewayInfo {
+	if u.groupMap == nil {
+		return []gears.GatewayInfo{}
+	}
+	return u.groupMap.gateways()
 }
 
-// Get packets to xmit, encode them, and ship them out
+// Get packets to xmit, encode them, and ship them out. Messages that request an ACK are
+// handed to the ACK table, which retransmits them until the ACK arrives.
 func (u *UDPGateway) Transmitter() {
-	for m := range u.Xmit {
-		var flags byte = 0x3 // data_req
-		if m.Node == 0 {
-			flags = 0x0 // bcast_push
+	for x := range u.Xmit {
+		if x.Msg.DoAck && x.Msg.Node != 0 {
+			u.acks.enqueue(u, x)
+			continue
+		}
+		var flags byte = RF_DataPush
+		if x.Msg.Node == 0 {
+			flags = RF_BcastPush
 		}
-		data := append([]byte{m.Kind}, m.Data...)
-		u.sendPacket(m.Group, m.Node, flags, data)
+		err := u.sendPacket(x.Msg.Group, x.Msg.Node, flags, msgPayload(x.Msg))
+		x.reply(err)
+	}
+}
+
+// Post holds a message for a sleeping node in its mailbox, returns false if the node doesn't
+// sleep, in which case the message should be sent right away
+func (u *UDPGateway) Post(m gears.RFMessage) (gears.MailStatus, bool) {
+	if u.Sleepy == nil || m.Node == 0 || !u.Sleepy(m.Group, m.Node) {
+		return gears.MailStatus{}, false
+	}
+	expiry := u.MailExpiry
+	if expiry == 0 {
+		expiry = DefaultMailExpiry
+	}
+	return u.mailbox.put(m, expiry), true
+}
+
+// deliverMail sends the messages held for a node that just woke up
+func (u *UDPGateway) deliverMail(group, node byte) {
+	for _, ml := range u.mailbox.take(group, node) {
+		done := make(chan error, 1)
+		x := XmitRequest{Msg: ml.msg, Reply: done}
+		if x.Msg.DoAck {
+			u.acks.enqueue(u, x)
+		} else {
+			x.reply(u.sendPacket(group, node, RF_DataPush, msgPayload(x.Msg)))
+		}
+		go func(ml *mail) { u.mailbox.done(ml, <-done) }(ml)
+	}
+}
+
+// payload of an RF packet, which starts with the kind (module) byte
+func msgPayload(m gears.RFMessage) []byte {
+	return append([]byte{m.Kind}, m.Data...)
+}
+
+// report the outcome of a transmit request
+func (x XmitRequest) reply(err error) {
+	if x.Reply != nil {
+		x.Reply <- err
 	}
 }
 
@@ -100,7 +240,7 @@ func min(a, b int) int {
 	}
 }
 
-func (u *UDPGateway) handlePairingRequest(pktSrc *net.UDPAddr, groupId, nodeId byte, data []byte) {
+func (u *UDPGateway) handlePairingRequest(pktSrc net.Addr, groupId, nodeId byte, data []byte) {
 	pktLen := len(data)
 	glog.Infof("UDP Recv boot pairing src=%v len=%d", pktSrc, pktLen)
 	if pktLen != PairingRequestLen+3 {
@@ -124,7 +264,7 @@ func (u *UDPGateway) handlePairingRequest(pktSrc *net.UDPAddr, groupId, nodeId b
 	}
 }
 
-func (u *UDPGateway) handleUpgradeRequest(pktSrc *net.UDPAddr, groupId, nodeId byte, data []byte) {
+func (u *UDPGateway) handleUpgradeRequest(pktSrc net.Addr, groupId, nodeId byte, data []byte) {
 	pktLen := len(data)
 	glog.Infof("UDP Recv boot upgrade src=%v len=%d", pktSrc, pktLen)
 	ur := UpgradeRequest{}
@@ -135,7 +275,7 @@ func (u *UDPGateway) handleUpgradeRequest(pktSrc *net.UDPAddr, groupId, nodeId b
 	}
 	glog.Infof("  UpgradeRequest: nodeType:%d RF%di%d Sw: [id=%d size=%d check=0x%04x]",
 		ur.NodeType, groupId, nodeId, ur.SwId, ur.SwSize, ur.SwCheck)
-	reply := u.Boot.Upgrade(ur)
+	reply := u.Boot.Upgrade(groupId, nodeId, ur)
 	if reply != nil {
 		buf := bytes.Buffer{}
 		_ = binary.Write(&buf, binary.LittleEndian, reply)
@@ -143,7 +283,7 @@ func (u *UDPGateway) handleUpgradeRequest(pktSrc *net.UDPAddr, groupId, nodeId b
 	}
 }
 
-func (u *UDPGateway) handleDownloadRequest(pktSrc *net.UDPAddr, groupId, nodeId byte, data []byte) {
+func (u *UDPGateway) handleDownloadRequest(pktSrc net.Addr, groupId, nodeId byte, data []byte) {
 	pktLen := len(data)
 	glog.Infof("UDP Recv boot download src=%v len=%d", pktSrc, pktLen)
 	dr := DownloadRequest{}
@@ -154,7 +294,7 @@ func (u *UDPGateway) handleDownloadRequest(pktSrc *net.UDPAddr, groupId, nodeId
 	}
 	glog.Infof("  DownloadRequest: RF%di%d Sw: [id=%d ix=%d off=%d]",
 		groupId, nodeId, dr.SwId, dr.SwIndex, dr.SwIndex*BOOT_DATA_MAX)
-	reply := u.Boot.Download(dr)
+	reply := u.Boot.Download(groupId, nodeId, dr)
 	if reply != nil {
 		buf := bytes.Buffer{}
 		_ = binary.Write(&buf, binary.LittleEndian, reply)
@@ -162,14 +302,16 @@ func (u *UDPGateway) handleDownloadRequest(pktSrc *net.UDPAddr, groupId, nodeId
 	}
 }
 
-// Receive UDP packets, decode them, and output them
+// Receive UDP packets from a transport, decode them, and output them
 // The packet format is (by byte): flags, group, node_id, kind, data...
-func (u *UDPGateway) Receiver() {
+func (u *UDPGateway) Receiver(sock Transport) {
 	for {
 		glog.V(2).Infoln("******************************")
 		pkt := make([]byte, 1600)
-		pktLen, pktSrc, err := u.sock.ReadFromUDP(pkt)
-		if err != nil {
+		pktLen, pktSrc, err := sock.ReadFrom(pkt)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
 			glog.Warning("UDP error: " + err.Error())
 			continue
 		}
@@ -177,12 +319,25 @@ func (u *UDPGateway) Receiver() {
 			glog.Infof("UDP: got too short a packet (%d) from %v", pktLen, pktSrc)
 			continue
 		}
-		if pktLen > 66+3 {
+		data := pkt[0:pktLen]
+
+		// Take out the reception metadata, if the gateway sent any
+		rx := &gears.RxInfo{Gateway: pktSrc.String()}
+		if data[0]&RF_RxInfo != 0 {
+			if pktLen < 3+rxInfoLen {
+				glog.Infof("UDP: got too short a packet (%d) from %v", pktLen, pktSrc)
+				continue
+			}
+			rx.GwId, rx.Rssi, rx.Lna, rx.Seq = data[3], -int(data[4]), data[5], data[6]
+			data = append([]byte{data[0] &^ RF_RxInfo, data[1], data[2]}, data[3+rxInfoLen:]...)
+			pktLen = len(data)
+		}
+
+		if pktLen > maxPayload+3 {
 			glog.Infof("UDP: got too long a packet (%d) from %v", pktLen, pktSrc)
 			continue
 		}
 		// got a reasonable packet
-		data := pkt[0:pktLen]
 		flags := data[0]
 		groupId := data[1]
 		nodeId := data[2]
@@ -190,6 +345,19 @@ func (u *UDPGateway) Receiver() {
 		// Record the groupId -> addr mapping
 		_ = u.groupMap.saveGroupToAddr(groupId, pktSrc)
 
+		// Drop the copies of node packets that other gateways heard too, the gateway's own
+		// packets (node 31) are never copies
+		retry := false
+		if (flags <= RF_BcastReq || flags == RF_BootReq || flags == RF_Pairing) && nodeId != 31 {
+			var dup bool
+			dup, retry = u.dups.check(data, pktSrc)
+			u.groupMap.heard(groupId, nodeId, pktSrc, !dup, rx.Rssi)
+			if dup && !retry {
+				glog.V(2).Infof("UDP Recv duplicate RFg%03di%02d from %v", groupId, nodeId, pktSrc)
+				continue
+			}
+		}
+
 		switch flags {
 		// CTL + ACK + DST -> boot protocol pairing request
 		// I.e: a node sends us its HW ID and we reply with groupId/nodeId/nodeType
@@ -209,6 +377,11 @@ func (u *UDPGateway) Receiver() {
 					pktLen, PairingRequestLen+3)
 			}
 
+		// ACK from a node for a data_req we sent it
+		case 4:
+			glog.Infof("UDP Recv ACK RFg%03di%02d", groupId, nodeId)
+			u.acks.ack(u, groupId, nodeId)
+
 		// Special packet to log from UDP GW itself
 		case 9:
 			glog.Infof("UDP-GW %d: %s", groupId, string(data[3:]))
@@ -218,18 +391,30 @@ func (u *UDPGateway) Receiver() {
 				At:    time.Now().UnixNano() / 1000000,
 				Kind:  2, // LOG module
 				Data:  append([]byte("GW "), data[3:]...),
+				Rx:    rx,
 			}
 			u.Recv <- m
 		// Standard data packet, produce a Message
 		case 0, 1:
+			// A retransmission was already processed, it just needs the ACK again
+			if retry {
+				glog.Infof("UDP Recv retransmission RFg%03di%02d", groupId, nodeId)
+				if flags&1 != 0 {
+					u.sendPacket(groupId, nodeId, 0x6, []byte{})
+				}
+				u.deliverMail(groupId, nodeId)
+				continue
+			}
 			m := gears.RFMessage{
 				Group: groupId,
 				Node:  nodeId,
 				At:    time.Now().UnixNano() / 1000000,
+				Rx:    rx,
 			}
-			if nodeId == 31 && len(m.Data)&1 == 0 {
+			if nodeId == 31 && len(data[3:])&1 == 0 {
 				// hack to handle the fact that the early versions of the UDP GW node
-				// don't use a _kind_ byte in the messages
+				// don't use a _kind_ byte in the messages, their 4 counters and 2x30
+				// RSSIs make for an even length, with the kind byte the length is odd
 				m.Kind = 8 // GW_RSSI_MODULE
 				m.Data = data[3:]
 			} else if pktLen > 3 {
@@ -244,13 +429,15 @@ func (u *UDPGateway) Receiver() {
 			if flags&1 != 0 {
 				u.sendPacket(groupId, nodeId, 0x6, []byte{})
 			}
+			// The node listens briefly after transmitting, send what's held for it
+			u.deliverMail(groupId, nodeId)
 			// Now process what we got
 			u.Recv <- m
 		}
 	}
 }
 
-// Open a UDP port
+// Open a UDP port for the gateways to talk to
 func (u *UDPGateway) Listen(port int) {
 	udpAddr := net.UDPAddr{Port: port}
 	sock, err := net.ListenUDP("udp4", &udpAddr)
@@ -265,34 +452,331 @@ func (u *UDPGateway) Listen(port int) {
 
 // When a JeeUDP gw comes up it sends us some hello-world packets so we can learn about
 // the RF network group id that it handles. We keep track of that here so we can send
-// packets in the reverse direction.
+// packets in the reverse direction. Several gateways may serve the same group: packets to a
+// node go out through the gateway that heard the node best, i.e., the one that received the
+// node's last packet with the strongest signal or, if the gateways don't report the RSSI, the
+// one the first copy of the packet arrived through. Broadcasts go out through all of them.
+
+// Gateways that haven't been heard from for this long are forgotten
+const gwExpiry = 10 * time.Minute
+
+type gwRoute struct {
+	addr      net.Addr
+	lastHeard time.Time
+	nodes     map[byte]*gears.NodeReception // node -> how well the gateway hears it
+}
+
+type nodeRoute struct {
+	addr net.Addr // gateway that heard the node's last packet best
+	rssi int      // the RSSI it heard it with, 0 if unknown
+}
+
+// a gateway that isn't heard from goes away, except for one on a serial port: it's attached
+// to the hub and just doesn't have anything to say
+func (r *gwRoute) expired() bool {
+	return r.addr.Network() != serialNetwork && time.Since(r.lastHeard) > gwExpiry
+}
 
 type GroupMap struct {
-	group      map[byte]*net.UDPAddr // group id -> UDP address
-	sync.Mutex                       // synchronize access to map
+	group      map[byte][]*gwRoute   // group id -> gateways, most recently heard first
+	node       map[uint16]*nodeRoute // group<<8|node -> gateway that heard the node best
+	sync.Mutex                       // synchronize access to maps
 }
 
-// lookup group_id -> UDP addr, returns nil if we don't have a mapping
-func (gm *GroupMap) mapGroupToAddr(groupId byte) *net.UDPAddr {
+// lookup group_id -> UDP addr of the most recently heard gateway, returns nil if we don't
+// have a mapping
+func (gm *GroupMap) mapGroupToAddr(groupId byte) net.Addr {
 	gm.Lock()
 	defer gm.Unlock()
-	if gm.group == nil {
-		gm.group = make(map[byte]*net.UDPAddr)
+	if routes := gm.routes(groupId); len(routes) > 0 {
+		return routes[0].addr
+	}
+	return nil
+}
+
+// lookup group_id -> UDP addrs of all the gateways of the group
+func (gm *GroupMap) mapGroupToAddrs(groupId byte) []net.Addr {
+	gm.Lock()
+	defer gm.Unlock()
+	addrs := []net.Addr{}
+	for _, r := range gm.routes(groupId) {
+		addrs = append(addrs, r.addr)
+	}
+	return addrs
+}
+
+// lookup group_id/node_id -> UDP addr of the gateway that heard the node best, falls back
+// to the most recently heard gateway of the group
+func (gm *GroupMap) mapNodeToAddr(groupId, nodeId byte) net.Addr {
+	gm.Lock()
+	defer gm.Unlock()
+	routes := gm.routes(groupId)
+	if nr := gm.node[ackKey(groupId, nodeId)]; nr != nil {
+		for _, r := range routes {
+			if r.addr == nr.addr {
+				return nr.addr
+			}
+		}
+	}
+	if len(routes) > 0 {
+		return routes[0].addr
 	}
-	return gm.group[groupId]
+	return nil
 }
 
-// save group_id -> UDP addr mapping, return true if this is new groupId
-func (gm *GroupMap) saveGroupToAddr(groupId byte, addr *net.UDPAddr) bool {
+// save group_id -> UDP addr mapping, return true if this is a new gateway for the groupId
+func (gm *GroupMap) saveGroupToAddr(groupId byte, addr net.Addr) bool {
 	gm.Lock()
 	defer gm.Unlock()
 	if gm.group == nil {
-		gm.group = make(map[byte]*net.UDPAddr)
+		gm.group = make(map[byte][]*gwRoute)
 	}
-	newGroup := gm.group[groupId] == nil
-	if newGroup || !gm.group[groupId].IP.Equal(addr.IP) || gm.group[groupId].Port != addr.Port {
-		glog.Infof("RF group %d now reachable via %s:%d", groupId, addr.IP, addr.Port)
+	routes := gm.routes(groupId)
+	r := gm.route(groupId, addr)
+	newGw := r == nil
+	if newGw {
+		glog.Infof("RF group %d now reachable via %s", groupId, addr)
+		r = &gwRoute{addr: addr, nodes: make(map[byte]*gears.NodeReception)}
+		routes = append(routes, r)
+	}
+	r.lastHeard = time.Now()
+	// keep the most recently heard gateway first
+	for i := len(routes) - 1; i > 0; i-- {
+		if routes[i] == r {
+			routes[i], routes[i-1] = routes[i-1], routes[i]
+		}
+	}
+	gm.group[groupId] = routes
+	return newGw
+}
+
+// record that a gateway heard a node with some RSSI (0 if unknown), first tells whether it's
+// the first copy of the packet that arrived
+func (gm *GroupMap) heard(groupId, nodeId byte, addr net.Addr, first bool, rssi int) {
+	gm.Lock()
+	defer gm.Unlock()
+	r := gm.route(groupId, addr)
+	if r == nil {
+		return
+	}
+	rcv := r.nodes[nodeId]
+	if rcv == nil {
+		rcv = &gears.NodeReception{Node: nodeId}
+		r.nodes[nodeId] = rcv
+	}
+	rcv.Heard++
+	rcv.Rssi = rssi
+	rcv.LastAt = time.Now().UnixNano() / 1000000
+	if gm.node == nil {
+		gm.node = make(map[uint16]*nodeRoute)
+	}
+	key := ackKey(groupId, nodeId)
+	if first {
+		rcv.First++
+		gm.node[key] = &nodeRoute{r.addr, rssi}
+	} else if nr := gm.node[key]; nr != nil && rssi != 0 && nr.rssi != 0 && rssi > nr.rssi {
+		gm.node[key] = &nodeRoute{r.addr, rssi} // a later copy with a stronger signal
+	}
+}
+
+// gateways returns all the gateways and how well they hear each node
+func (gm *GroupMap) gateways() []gears.GatewayInfo {
+	gm.Lock()
+	defer gm.Unlock()
+	groups := make([]int, 0, len(gm.group))
+	for g := range gm.group {
+		groups = append(groups, int(g))
+	}
+	sort.Ints(groups)
+	gws := []gears.GatewayInfo{}
+	for _, g := range groups {
+		for _, r := range gm.routes(byte(g)) {
+			gw := gears.GatewayInfo{Group: byte(g), Addr: r.addr.String(),
+				LastAt: r.lastHeard.UnixNano() / 1000000, Nodes: []gears.NodeReception{}}
+			for n := 1; n < 32; n++ {
+				if rcv := r.nodes[byte(n)]; rcv != nil {
+					gw.Nodes = append(gw.Nodes, *rcv)
+				}
+			}
+			gws = append(gws, gw)
+		}
+	}
+	return gws
+}
+
+// routes returns the gateways of a group after forgetting the expired ones, assumes the lock
+// is held
+func (gm *GroupMap) routes(groupId byte) []*gwRoute {
+	routes := gm.group[groupId]
+	for len(routes) > 0 && routes[len(routes)-1].expired() {
+		r := routes[len(routes)-1]
+		glog.Infof("RF group %d no longer reachable via %s", groupId, r.addr)
+		routes = routes[:len(routes)-1]
+	}
+	if len(routes) > 0 {
+		gm.group[groupId] = routes
+	} else {
+		delete(gm.group, groupId)
+	}
+	return routes
+}
+
+// route returns the gateway with an address in a group, nil if there is none, assumes the
+// lock is held
+func (gm *GroupMap) route(groupId byte, addr net.Addr) *gwRoute {
+	for _, r := range gm.group[groupId] {
+		if r.addr.Network() == addr.Network() && r.addr.String() == addr.String() {
+			return r
+		}
+	}
+	return nil
+}
+
+//===== Duplicate packet filter
+
+// When several gateways hear a node they all forward its packets, DupFilter recognizes the
+// copies so only the first one gets processed. A copy that arrives through the same gateway as
+// the first one is a retransmission by the node: it didn't get our reply.
+
+const DefaultDedupWindow = 500 * time.Millisecond
+
+type dupEntry struct {
+	at  time.Time
+	src string // gateway the first copy arrived through
+}
+
+type DupFilter struct {
+	Window     time.Duration       // copies arriving within the window are duplicates
+	seen       map[string]dupEntry // packet without the flags -> its first copy
+	purged     time.Time           // when expired entries were last removed
+	sync.Mutex                     // synchronize access to map
+}
+
+// check a packet, dup tells whether it's a copy of one that arrived within the window and
+// retry whether the copy came through the same gateway as the first one
+func (df *DupFilter) check(pkt []byte, src net.Addr) (dup, retry bool) {
+	if df.Window <= 0 {
+		return false, false
+	}
+	df.Lock()
+	defer df.Unlock()
+	now := time.Now()
+	if df.seen == nil {
+		df.seen = make(map[string]dupEntry)
+	}
+	if now.Sub(df.purged) > df.Window {
+		for k, e := range df.seen {
+			if now.Sub(e.at) > df.Window {
+				delete(df.seen, k)
+			}
+		}
+		df.purged = now
+	}
+	key := string(pkt[1:])
+	if e, ok := df.seen[key]; ok && now.Sub(e.at) <= df.Window {
+		return true, e.src == src.String()
+	}
+	df.seen[key] = dupEntry{now, src.String()}
+	return false, false
+}
+
+//===== Table of outstanding sends awaiting an ACK
+
+// Nodes don't tell us which packet they're acknowledging, so we only ever have one send
+// outstanding per node and queue any others until that one is ACKed or times out.
+
+type pendingXmit struct {
+	req   XmitRequest
+	tries int         // number of transmissions so far
+	timer *time.Timer // fires when it's time to retransmit
+}
+
+type AckTable struct {
+	pending    map[uint16]*pendingXmit  // group<<8|node -> outstanding send
+	queued     map[uint16][]XmitRequest // group<<8|node -> sends waiting their turn
+	sync.Mutex                          // synchronize access to maps
+}
+
+func ackKey(group, node byte) uint16 {
+	return uint16(group)<<8 | uint16(node)
+}
+
+// enqueue a send that requests an ACK, it goes out right away unless another send to the
+// same node is still awaiting its ACK
+func (at *AckTable) enqueue(u *UDPGateway, x XmitRequest) {
+	at.Lock()
+	defer at.Unlock()
+	if at.pending == nil {
+		at.pending = make(map[uint16]*pendingXmit)
+		at.queued = make(map[uint16][]XmitRequest)
+	}
+	key := ackKey(x.Msg.Group, x.Msg.Node)
+	if at.pending[key] != nil {
+		at.queued[key] = append(at.queued[key], x)
+		return
+	}
+	at.start(u, key, x)
+}
+
+// start a send, assumes the lock is held
+func (at *AckTable) start(u *UDPGateway, key uint16, x XmitRequest) {
+	p := &pendingXmit{req: x}
+	at.pending[key] = p
+	at.transmit(u, key, p)
+}
+
+// (re)transmit an outstanding send and arm the retransmit timer, assumes the lock is held
+func (at *AckTable) transmit(u *UDPGateway, key uint16, p *pendingXmit) {
+	m := p.req.Msg
+	err := u.sendPacket(m.Group, m.Node, RF_DataReq, msgPayload(m))
+	if err != nil {
+		at.finish(u, key, err)
+		return
+	}
+	timeout := u.AckTimeout << uint(p.tries)
+	p.tries += 1
+	p.timer = time.AfterFunc(timeout, func() { at.timeout(u, key, p) })
+}
+
+// the retransmit timer for an outstanding send fired
+func (at *AckTable) timeout(u *UDPGateway, key uint16, p *pendingXmit) {
+	at.Lock()
+	defer at.Unlock()
+	if at.pending[key] != p {
+		return // ACK raced with the timer
+	}
+	if p.tries > u.AckRetries {
+		glog.Warningf("No ACK from %s after %d tries", p.req.Msg.RfTag(), p.tries)
+		at.finish(u, key, gears.AckTimeoutError)
+		return
+	}
+	glog.Infof("Retransmitting to %s (try %d)", p.req.Msg.RfTag(), p.tries+1)
+	at.transmit(u, key, p)
+}
+
+// an ACK arrived from a node, complete its outstanding send
+func (at *AckTable) ack(u *UDPGateway, group, node byte) {
+	at.Lock()
+	defer at.Unlock()
+	key := ackKey(group, node)
+	p := at.pending[key]
+	if p == nil {
+		glog.Infof("Unexpected ACK from RFg%03di%02d", group, node)
+		return
+	}
+	p.timer.Stop()
+	at.finish(u, key, nil)
+}
+
+// complete the outstanding send for a node, report its outcome, and start the next queued
+// one, if any; assumes the lock is held
+func (at *AckTable) finish(u *UDPGateway, key uint16, err error) {
+	at.pending[key].req.reply(err)
+	delete(at.pending, key)
+	if q := at.queued[key]; len(q) > 0 {
+		at.queued[key] = q[1:]
+		at.start(u, key, q[0])
+	} else {
+		delete(at.queued, key)
 	}
-	gm.group[groupId] = addr
-	return newGroup
 }
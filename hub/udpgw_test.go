@@ -4,9 +4,16 @@ package main
 // Omega: Alt+937
 
 import (
+	"fmt"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"net"
+	"os"
+	"time"
+
+	"github.com/tve/widuino/gears"
+	"github.com/tve/widuino/hub/database"
+	"github.com/tve/widuino/hub/jeesim"
 )
 
 //===== tests =====
@@ -52,22 +59,490 @@ var _ = Describe("UDPGw GroupMap", func() {
 			_ = gm.saveGroupToAddr(2, addr2)
 			res := gm.mapGroupToAddr(1)
 			Ω(res).Should(Equal(addr))
-			Ω(res.Port).Should(Equal(101))
+			Ω(res.(*net.UDPAddr).Port).Should(Equal(101))
 			res = gm.mapGroupToAddr(2)
 			Ω(res).Should(Equal(addr2))
-			Ω(res.Port).Should(Equal(55))
+			Ω(res.(*net.UDPAddr).Port).Should(Equal(55))
 		})
 		It("retrieves updated groups", func() {
 			_ = gm.saveGroupToAddr(1, addr)
 			res := gm.mapGroupToAddr(1)
 			Ω(res).Should(Equal(addr))
-			Ω(res.Port).Should(Equal(101))
+			Ω(res.(*net.UDPAddr).Port).Should(Equal(101))
 			// now update
 			_ = gm.saveGroupToAddr(1, addr2)
 			res = gm.mapGroupToAddr(1)
 			Ω(res).Should(Equal(addr2))
-			Ω(res.Port).Should(Equal(55))
+			Ω(res.(*net.UDPAddr).Port).Should(Equal(55))
+		})
+		It("keeps all gateways of a group", func() {
+			_ = gm.saveGroupToAddr(1, addr)
+			res := gm.saveGroupToAddr(1, addr2)
+			Ω(res).Should(Equal(true))
+			Ω(gm.mapGroupToAddrs(1)).Should(Equal([]net.Addr{addr2, addr}))
+			Ω(gm.mapGroupToAddrs(2)).Should(BeEmpty())
+		})
+		It("forgets gateways that aren't heard", func() {
+			_ = gm.saveGroupToAddr(1, addr)
+			_ = gm.saveGroupToAddr(1, addr2)
+			gm.group[1][1].lastHeard = time.Now().Add(-gwExpiry - time.Second)
+			Ω(gm.mapGroupToAddrs(1)).Should(Equal([]net.Addr{addr2}))
+		})
+	})
+
+	Describe("mapNodeToAddr", func() {
+		BeforeEach(func() {
+			_ = gm.saveGroupToAddr(1, addr)
+			_ = gm.saveGroupToAddr(1, addr2)
+		})
+		It("routes to the gateway that heard the node first", func() {
+			gm.heard(1, 3, addr, true, 0)
+			gm.heard(1, 3, addr2, false, 0)
+			Ω(gm.mapNodeToAddr(1, 3)).Should(Equal(addr))
+			gm.heard(1, 3, addr2, true, 0)
+			Ω(gm.mapNodeToAddr(1, 3)).Should(Equal(addr2))
 		})
+		It("routes to the gateway that heard the node with the strongest signal", func() {
+			gm.heard(1, 3, addr, true, -90)
+			gm.heard(1, 3, addr2, false, -60)
+			Ω(gm.mapNodeToAddr(1, 3)).Should(Equal(addr2))
+			gm.heard(1, 3, addr, true, -50)
+			gm.heard(1, 3, addr2, false, -70)
+			Ω(gm.mapNodeToAddr(1, 3)).Should(Equal(addr))
+			gm.heard(1, 3, addr2, true, 0)
+			gm.heard(1, 3, addr, false, -50)
+			Ω(gm.mapNodeToAddr(1, 3)).Should(Equal(addr2))
+		})
+		It("falls back to the most recently heard gateway", func() {
+			Ω(gm.mapNodeToAddr(1, 4)).Should(Equal(addr2))
+			gm.heard(1, 4, addr, true, 0)
+			gm.group[1][1].lastHeard = time.Now().Add(-gwExpiry - time.Second)
+			Ω(gm.mapNodeToAddr(1, 4)).Should(Equal(addr2))
+			Ω(gm.mapNodeToAddr(2, 4)).Should(BeNil())
+		})
+		It("keeps reception metadata", func() {
+			gm.heard(1, 3, addr, true, 0)
+			gm.heard(1, 3, addr2, false, 0)
+			gm.heard(1, 3, addr2, true, 0)
+			gws := gm.gateways()
+			Ω(gws).Should(HaveLen(2))
+			Ω(gws[0].Addr).Should(Equal(addr2.String()))
+			Ω(gws[0].Nodes).Should(HaveLen(1))
+			Ω(gws[0].Nodes[0].Heard).Should(Equal(2))
+			Ω(gws[0].Nodes[0].First).Should(Equal(1))
+			Ω(gws[1].Nodes[0].Heard).Should(Equal(1))
+			Ω(gws[1].Nodes[0].First).Should(Equal(1))
+		})
+	})
+
+})
+
+var _ = Describe("UDPGw DupFilter", func() {
+	var df *DupFilter
+	var addr, addr2 *net.UDPAddr
+	pkt := []byte{RF_BcastPush, 5, 3, 4, 70}
+
+	BeforeEach(func() {
+		df = &DupFilter{Window: 50 * time.Millisecond}
+		addr = &net.UDPAddr{IP: net.IP{1, 2, 3, 4}, Port: 101}
+		addr2 = &net.UDPAddr{IP: net.IP{1, 2, 3, 5}, Port: 101}
+	})
+
+	It("recognizes copies from other gateways", func() {
+		Ω(df.check(pkt, addr)).Should(BeFalse())
+		dup, retry := df.check(pkt, addr2)
+		Ω(dup).Should(BeTrue())
+		Ω(retry).Should(BeFalse())
+	})
+	It("recognizes retransmissions", func() {
+		df.check(pkt, addr)
+		dup, retry := df.check([]byte{RF_BcastReq, 5, 3, 4, 70}, addr)
+		Ω(dup).Should(BeTrue())
+		Ω(retry).Should(BeTrue())
+	})
+	It("lets different packets through", func() {
+		df.check(pkt, addr)
+		Ω(df.check([]byte{RF_BcastPush, 5, 3, 4, 71}, addr2)).Should(BeFalse())
+		Ω(df.check([]byte{RF_BcastPush, 5, 4, 4, 70}, addr2)).Should(BeFalse())
+	})
+	It("forgets packets after the window", func() {
+		df.check(pkt, addr)
+		time.Sleep(60 * time.Millisecond)
+		Ω(df.check(pkt, addr2)).Should(BeFalse())
+		Ω(df.seen).Should(HaveLen(1))
+	})
+	It("can be disabled", func() {
+		df.Window = -1
+		df.check(pkt, addr)
+		Ω(df.check(pkt, addr2)).Should(BeFalse())
+	})
+})
+
+var _ = Describe("UDPGw AckTable", func() {
+	var u *UDPGateway
+	var gw *net.UDPConn // plays the part of the UDP/RF gateway node
+
+	BeforeEach(func() {
+		var err error
+		gw, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+		Ω(err).ShouldNot(HaveOccurred())
+		sock, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+		Ω(err).ShouldNot(HaveOccurred())
+		u = &UDPGateway{
+			Xmit: make(chan XmitRequest, 10), AckRetries: 2, AckTimeout: 20 * time.Millisecond,
+			sock: sock, groupMap: &GroupMap{}, acks: &AckTable{},
+		}
+		u.groupMap.saveGroupToAddr(5, gw.LocalAddr().(*net.UDPAddr))
+		go u.Transmitter()
+	})
+
+	AfterEach(func() {
+		close(u.Xmit)
+		u.sock.Close()
+		gw.Close()
+	})
+
+	// read the packets the gateway receives within the given time
+	gwRecv := func(d time.Duration) [][]byte {
+		pkts := [][]byte{}
+		gw.SetReadDeadline(time.Now().Add(d))
+		for {
+			buf := make([]byte, 100)
+			n, err := gw.Read(buf)
+			if err != nil {
+				return pkts
+			}
+			pkts = append(pkts, buf[:n])
+		}
+	}
+
+	It("sends without ACK", func() {
+		reply := make(chan error, 1)
+		u.Xmit <- XmitRequest{gears.RFMessage{Group: 5, Node: 3, Kind: 7, Data: []byte{1}}, reply}
+		Ω(<-reply).Should(BeNil())
+		pkts := gwRecv(100 * time.Millisecond)
+		Ω(pkts).Should(Equal([][]byte{{RF_DataPush, 5, 3, 7, 1}}))
+	})
+
+	It("completes a send when the ACK arrives", func() {
+		reply := make(chan error, 1)
+		u.Xmit <- XmitRequest{gears.RFMessage{Group: 5, Node: 3, DoAck: true, Kind: 7}, reply}
+		Ω(gwRecv(10 * time.Millisecond)).Should(Equal([][]byte{{RF_DataReq, 5, 3, 7}}))
+		u.acks.ack(u, 5, 3)
+		Ω(<-reply).Should(BeNil())
+		Ω(gwRecv(100 * time.Millisecond)).Should(BeEmpty())
+	})
+
+	It("retransmits and times out", func() {
+		reply := make(chan error, 1)
+		u.Xmit <- XmitRequest{gears.RFMessage{Group: 5, Node: 3, DoAck: true, Kind: 7}, reply}
+		Eventually(reply).Should(Receive(Equal(gears.AckTimeoutError)))
+		Ω(gwRecv(10 * time.Millisecond)).Should(HaveLen(1 + 2))
+	})
+
+	It("queues a second send to the same node", func() {
+		reply1 := make(chan error, 1)
+		reply2 := make(chan error, 1)
+		u.Xmit <- XmitRequest{gears.RFMessage{Group: 5, Node: 3, DoAck: true, Kind: 1}, reply1}
+		u.Xmit <- XmitRequest{gears.RFMessage{Group: 5, Node: 3, DoAck: true, Kind: 2}, reply2}
+		Ω(gwRecv(10 * time.Millisecond)).Should(Equal([][]byte{{RF_DataReq, 5, 3, 1}}))
+		u.acks.ack(u, 5, 3)
+		Ω(<-reply1).Should(BeNil())
+		Ω(gwRecv(10 * time.Millisecond)).Should(Equal([][]byte{{RF_DataReq, 5, 3, 2}}))
+		u.acks.ack(u, 5, 3)
+		Ω(<-reply2).Should(BeNil())
+	})
+
+	It("fails without a known gateway", func() {
+		reply := make(chan error, 1)
+		u.Xmit <- XmitRequest{gears.RFMessage{Group: 6, Node: 3, DoAck: true}, reply}
+		Ω(<-reply).Should(HaveOccurred())
+	})
+})
+
+var _ = Describe("UDPGw boot protocol", func() {
+	var u *UDPGateway
+	var node *jeesim.Node
+
+	// start a gateway on localhost with a booter using the pairing database and connect a
+	// simulated node to it
+	start := func(pdb *database.DB, hwId [16]byte) {
+		sock, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+		Ω(err).ShouldNot(HaveOccurred())
+		u = &UDPGateway{
+			Recv: make(chan gears.RFMessage, 10), Xmit: make(chan XmitRequest, 10),
+			Boot: NewBooter("test_config1.json", pdb), sock: sock,
+		}
+		go u.Run()
+		node, err = jeesim.NewNode(sock.LocalAddr().(*net.UDPAddr), 101, hwId)
+		Ω(err).ShouldNot(HaveOccurred())
+	}
+
+	AfterEach(func() {
+		node.Close()
+		close(u.Xmit)
+		u.sock.Close()
+	})
+
+	It("boots a node from the boot config", func() {
+		start(nil, [16]byte{1, 2, 3, 4})
+		changed, err := node.Boot()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(changed).Should(BeTrue())
+		Ω(node.Group).Should(Equal(byte(252)))
+		Ω(node.Id).Should(Equal(byte(3)))
+		Ω(node.SwId).Should(Equal(uint16(101)))
+		sw, err := u.Boot.(*booter).findSoftware(101)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(node.Image).Should(Equal([]byte(sw)))
+
+		// booting again doesn't download anything
+		changed, err = node.Boot()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(changed).Should(BeFalse())
+	})
+
+	It("pairs a new node and tracks its upgrade", func() {
+		dbDir := fmt.Sprintf("/tmp/db-sim-%d", os.Getpid())
+		pdb, err := database.Open(dbDir)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(dbDir)
+		defer pdb.Close()
+		start(pdb, [16]byte{})
+
+		changed, err := node.Boot()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(changed).Should(BeTrue())
+		Ω(node.HwId).ShouldNot(Equal([16]byte{}))
+		Ω(node.Id).Should(Equal(byte(1)))
+		Ω(node.NodeType).Should(Equal(uint16(100)))
+		Ω(node.Image).Should(HaveLen(5024))
+
+		sessions, err := pdb.ListUpgradeSessions(node.Group, node.Id)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(sessions).Should(HaveLen(1))
+		Ω(sessions[0].State).Should(Equal(gears.UpgradeConfirmed))
+		Ω(sessions[0].Served).Should(Equal(sessions[0].Chunks))
+	})
+})
+
+var _ = Describe("UDPGw with simulated gateways", func() {
+	var u *UDPGateway
+	var gw *jeesim.Gateway
+
+	BeforeEach(func() {
+		sock, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+		Ω(err).ShouldNot(HaveOccurred())
+		u = &UDPGateway{
+			Recv: make(chan gears.RFMessage, 10), Xmit: make(chan XmitRequest, 10),
+			Boot: NewBooter("test_config1.json", nil), AckRetries: 2,
+			AckTimeout: 20 * time.Millisecond, sock: sock,
+		}
+		go u.Run()
+		gw, err = jeesim.NewGateway(sock.LocalAddr().(*net.UDPAddr), 252)
+		Ω(err).ShouldNot(HaveOccurred())
+		gw.AckTimeout = 20 * time.Millisecond
+		Ω((<-u.Recv).Kind).Should(Equal(byte(2))) // the gateway's hello
+	})
+
+	AfterEach(func() {
+		gw.Close()
+		close(u.Xmit)
+		u.sock.Close()
+	})
+
+	It("receives packets and ACKs them", func() {
+		Ω(gw.Send(3, jeesim.KindOwTemp, []byte{70, 71}, true)).Should(Succeed())
+		m := <-u.Recv
+		Ω(m.Group).Should(Equal(byte(252)))
+		Ω(m.Node).Should(Equal(byte(3)))
+		Ω(m.Kind).Should(Equal(byte(jeesim.KindOwTemp)))
+		Ω(m.Data).Should(Equal([]byte{70, 71}))
+		Ω(m.Rx).Should(Equal(&gears.RxInfo{Gateway: gw.Addr().String()}))
+	})
+
+	It("receives the GW RSSI", func() {
+		Ω(gw.Send(3, jeesim.KindOwTemp, []byte{70}, false)).Should(Succeed())
+		<-u.Recv
+		Ω(gw.SendRssi()).Should(Succeed())
+		m := <-u.Recv
+		Ω(m.Node).Should(Equal(byte(31)))
+		Ω(m.Kind).Should(Equal(byte(GW_RSSI_MODULE)))
+		Ω(m.Data).Should(HaveLen(4 + 2*gwRssiNodes))
+		r, err := gwRssiDecoder{}.Decode(m)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(r[0].Value).Should(Equal(1.0)) // the temperature, the hello is not RF
+		Ω(r[4].Name).Should(Equal("rcv_rssi/i03"))
+	})
+
+	It("receives the GW RSSI as framed by rf12-udp-gw", func() {
+		conn, err := net.DialUDP("udp4", nil, u.sock.(*net.UDPConn).LocalAddr().(*net.UDPAddr))
+		Ω(err).ShouldNot(HaveOccurred())
+		defer conn.Close()
+		// bcast_push, group, node 31, GW_RSSI_MODULE, 4 counters, rcvRssi[30], ackRssi[30]
+		pkt := []byte{0, 252, 31, 8, 5, 6, 7, 8}
+		pkt = append(pkt, make([]byte, 2*gwRssiNodes)...)
+		pkt[8+2] = 70 // rcvRssi of node 3
+		_, err = conn.Write(pkt)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		m := <-u.Recv
+		Ω(m.Node).Should(Equal(byte(31)))
+		Ω(m.Kind).Should(Equal(byte(GW_RSSI_MODULE)))
+		Ω(m.Data).Should(Equal(pkt[4:]))
+		r, err := gwRssiDecoder{}.Decode(m)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(r[0].Value).Should(Equal(5.0))
+		Ω(r[4].Name).Should(Equal("rcv_rssi/i03"))
+		Ω(r[4].Value).Should(Equal(70.0))
+	})
+
+	It("delivers data_req packets and gets the ACK", func() {
+		reply := make(chan error, 1)
+		u.Xmit <- XmitRequest{gears.RFMessage{Group: 252, Node: 3, DoAck: true, Kind: 7,
+			Data: []byte{1, 2}}, reply}
+		Ω(<-reply).Should(BeNil())
+		Ω(<-gw.Delivered).Should(Equal(jeesim.Packet{Node: 3, Kind: 7, Data: []byte{1, 2},
+			Ack: true}))
+	})
+
+	It("follows a gateway that moves", func() {
+		old := gw.Addr()
+		Ω(gw.Move()).Should(Succeed())
+		<-u.Recv
+		Ω(gw.Addr()).ShouldNot(Equal(old))
+		Ω(u.groupMap.mapGroupToAddr(252).(*net.UDPAddr).Port).Should(Equal(gw.Addr().Port))
+		reply := make(chan error, 1)
+		u.Xmit <- XmitRequest{gears.RFMessage{Group: 252, Node: 3, DoAck: true, Kind: 7}, reply}
+		Ω(<-reply).Should(BeNil())
 	})
 
+	It("retransmits lost packets", func() {
+		gw.SetLoss(1)
+		Ω(gw.Send(3, jeesim.KindOwTemp, []byte{70}, true)).Should(Equal(jeesim.ErrNoAck))
+		reply := make(chan error, 1)
+		u.Xmit <- XmitRequest{gears.RFMessage{Group: 252, Node: 3, DoAck: true}, reply}
+		Ω(<-reply).Should(Equal(gears.AckTimeoutError))
+		Ω(u.Recv).Should(BeEmpty())
+	})
+
+	It("holds messages for sleeping nodes until they wake up", func() {
+		u.Sleepy = func(group, node byte) bool { return node == 5 }
+		_, held := u.Post(gears.RFMessage{Group: 252, Node: 3, Kind: 7})
+		Ω(held).Should(BeFalse())
+
+		events := u.mailbox.subscribe(252, 5)
+		s, held := u.Post(gears.RFMessage{Group: 252, Node: 5, DoAck: true, Kind: 7,
+			Data: []byte{1}})
+		Ω(held).Should(BeTrue())
+		Ω(s.State).Should(Equal(gears.MailQueued))
+		<-events
+		Consistently(gw.Delivered).ShouldNot(Receive())
+
+		Ω(gw.Send(5, jeesim.KindOwTemp, []byte{70}, true)).Should(Succeed())
+		Ω((<-u.Recv).Node).Should(Equal(byte(5)))
+		Ω(<-gw.Delivered).Should(Equal(jeesim.Packet{Node: 5, Kind: 7, Data: []byte{1},
+			Ack: true}))
+		s = <-events
+		Ω(s.State).Should(Equal(gears.MailDelivered))
+		Ω(u.mailbox.list(0, 0)).Should(BeEmpty())
+		u.mailbox.unsubscribe(events)
+	})
+
+	It("boots nodes through the gateway", func() {
+		node := gw.NewNode(101, [16]byte{1, 2, 3, 4})
+		changed, err := node.Boot()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(changed).Should(BeTrue())
+		Ω(node.Id).Should(Equal(byte(3)))
+		Ω(node.SwId).Should(Equal(uint16(101)))
+	})
+})
+
+var _ = Describe("UDPGw with several gateways per group", func() {
+	var u *UDPGateway
+	var gw1, gw2 *jeesim.Gateway
+
+	BeforeEach(func() {
+		sock, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+		Ω(err).ShouldNot(HaveOccurred())
+		u = &UDPGateway{
+			Recv: make(chan gears.RFMessage, 10), Xmit: make(chan XmitRequest, 10),
+			Boot: NewBooter("test_config1.json", nil), sock: sock,
+		}
+		go u.Run()
+		hub := sock.LocalAddr().(*net.UDPAddr)
+		gw1, err = jeesim.NewGateway(hub, 252)
+		Ω(err).ShouldNot(HaveOccurred())
+		<-u.Recv
+		gw2, err = jeesim.NewGateway(hub, 252)
+		Ω(err).ShouldNot(HaveOccurred())
+		<-u.Recv
+	})
+
+	AfterEach(func() {
+		gw1.Close()
+		gw2.Close()
+		close(u.Xmit)
+		u.sock.Close()
+	})
+
+	It("drops the copies of a packet", func() {
+		Ω(gw1.Send(3, jeesim.KindOwTemp, []byte{70}, false)).Should(Succeed())
+		Ω(gw2.Send(3, jeesim.KindOwTemp, []byte{70}, false)).Should(Succeed())
+		Ω(gw2.Send(4, jeesim.KindOwTemp, []byte{70}, false)).Should(Succeed())
+		Ω((<-u.Recv).Node).Should(Equal(byte(3)))
+		Ω((<-u.Recv).Node).Should(Equal(byte(4)))
+		Consistently(u.Recv).ShouldNot(Receive())
+
+		gws := u.Gateways()
+		Ω(gws).Should(HaveLen(2))
+		Ω(gws[0].Addr).Should(Equal(gw2.Addr().String()))
+		Ω(gws[0].Nodes).Should(Equal([]gears.NodeReception{
+			{Node: 3, Heard: 1, First: 0, LastAt: gws[0].Nodes[0].LastAt},
+			{Node: 4, Heard: 1, First: 1, LastAt: gws[0].Nodes[1].LastAt}}))
+		Ω(gws[1].Nodes).Should(HaveLen(1))
+		Ω(gws[1].Nodes[0].First).Should(Equal(1))
+	})
+
+	It("sends to a node through the gateway that heard it first", func() {
+		Ω(gw1.Send(3, jeesim.KindOwTemp, []byte{70}, false)).Should(Succeed())
+		Ω(gw2.Send(3, jeesim.KindOwTemp, []byte{70}, false)).Should(Succeed())
+		<-u.Recv
+		reply := make(chan error, 1)
+		u.Xmit <- XmitRequest{gears.RFMessage{Group: 252, Node: 3, DoAck: true, Kind: 7}, reply}
+		Ω(<-reply).Should(BeNil())
+		Ω(gw1.Delivered).Should(Receive())
+		Ω(gw2.Delivered).ShouldNot(Receive())
+	})
+
+	It("broadcasts through all gateways", func() {
+		reply := make(chan error, 1)
+		u.Xmit <- XmitRequest{gears.RFMessage{Group: 252, Node: 0, Kind: 7}, reply}
+		Ω(<-reply).Should(BeNil())
+		Eventually(gw1.Delivered).Should(Receive())
+		Eventually(gw2.Delivered).Should(Receive())
+	})
+
+	It("reports the reception metadata and routes by RSSI", func() {
+		gw1.GwId, gw2.GwId = 1, 2
+		gw1.SetRssi(3, -95)
+		gw2.SetRssi(3, -60)
+		Ω(gw1.Send(3, jeesim.KindOwTemp, []byte{70, 71}, false)).Should(Succeed())
+		Ω(gw2.Send(3, jeesim.KindOwTemp, []byte{70, 71}, false)).Should(Succeed())
+		m := <-u.Recv
+		Ω(m.Data).Should(Equal([]byte{70, 71}))
+		Ω(m.Rx).Should(Equal(&gears.RxInfo{Gateway: gw1.Addr().String(), GwId: 1, Rssi: -95,
+			Seq: 1}))
+		Consistently(u.Recv).ShouldNot(Receive())
+		Ω(u.groupMap.mapNodeToAddr(252, 3).(*net.UDPAddr).Port).Should(Equal(gw2.Addr().Port))
+		Ω(u.Gateways()[0].Nodes[0].Rssi).Should(Equal(-60))
+	})
+
+	It("ACKs retransmissions without processing them again", func() {
+		Ω(gw1.Send(3, jeesim.KindOwTemp, []byte{70}, true)).Should(Succeed())
+		Ω(gw1.Send(3, jeesim.KindOwTemp, []byte{70}, true)).Should(Succeed())
+		Ω((<-u.Recv).Node).Should(Equal(byte(3)))
+		Consistently(u.Recv).ShouldNot(Receive())
+	})
 })
@@ -16,6 +16,7 @@
 #define WATERLEVEL_MODULE   7
 #define GW_RSSI_MODULE      8
 #define THERMOCOUPLE_MODULE 9
+#define SLOWSERVO_MODULE    10
 
 // Interface to be implemented by modules
 class Configured {
@@ -0,0 +1,306 @@
+// Copyright 2014 by Thorsten von Eicken, see LICENSE in top-level directory
+
+// RF network simulator for Widuino, see README.md for details
+//
+// Impersonates one or more UDP/RF gateways and the nodes behind them so the hub can be run
+// against a realistic network without any hardware. What the network looks like and what
+// happens to it over time is described by a scenario file.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/tve/widuino/hub/jeesim"
+)
+
+var hubAddr = flag.String("hub", "localhost:9999", "host:port of the hub's UDP gateway")
+var scenarioFile = flag.String("scenario", "scenario.json", "scenario to run")
+
+//===== Scenario
+
+// A duration is a time.Duration that reads from JSON strings like "1m30s"
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	*d = duration(v)
+	return err
+}
+
+// A nodeConfig describes a node and the packets it sends
+type nodeConfig struct {
+	Node   byte     // RF node ID
+	Kind   string   // owtemp, waterlevel, log, or raw
+	KindId byte     // kind byte of raw packets
+	Every  duration // interval between packets
+	Ack    bool     // request ACKs, i.e., send bcast_req instead of bcast_push
+	Values []int    // owtemp: degrees F, waterlevel: raw ADC readings, raw: payload bytes
+	Text   string   // log: message text
+	Type   uint16   // node type announced when rebooting
+	HwId   string   // hardware ID used when rebooting, 32 hex digits
+	Rssi   int      // signal strength in dBm the gateway hears the node with, 0 for random
+}
+
+// A gatewayConfig describes a gateway and the nodes in its RF group
+type gatewayConfig struct {
+	Group     byte
+	GwId      byte     // gateway ID to report with each packet, 0 to send no reception info
+	RssiEvery duration // interval between GW RSSI packets, 0 for none
+	Nodes     []nodeConfig
+}
+
+// An event changes the network at some point into the scenario
+type event struct {
+	At     duration // time since the start of the scenario
+	Group  byte     // gateway the event applies to
+	Node   byte     // node the event applies to, for reboots
+	Loss   *float64 // set the gateway's packet loss probability
+	Reboot bool     // reboot the node, it goes through the JeeBoot sequence
+	Down   duration // how long the node is silent when rebooting
+	Move   bool     // move the gateway to a new address
+	Stop   bool     // end the scenario
+}
+
+type scenario struct {
+	Gateways []gatewayConfig
+	Events   []event
+}
+
+func readScenario(file string) (*scenario, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var s scenario
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err.Error())
+	}
+	for _, g := range s.Gateways {
+		for _, n := range g.Nodes {
+			if n.Node < 1 || n.Node > 30 {
+				return nil, fmt.Errorf("%s: group %d: bad node ID %d", file, g.Group, n.Node)
+			}
+			if n.Rssi < -127 || n.Rssi > 0 {
+				return nil, fmt.Errorf("%s: RFg%di%d: bad RSSI %d", file, g.Group, n.Node, n.Rssi)
+			}
+			if n.Every <= 0 {
+				return nil, fmt.Errorf("%s: RFg%di%d: no interval", file, g.Group, n.Node)
+			}
+			if _, _, err := n.payload(); err != nil {
+				return nil, fmt.Errorf("%s: RFg%di%d: %s", file, g.Group, n.Node, err.Error())
+			}
+		}
+	}
+	sort.Sort(eventsByTime(s.Events))
+	return &s, nil
+}
+
+type eventsByTime []event
+
+func (e eventsByTime) Len() int           { return len(e) }
+func (e eventsByTime) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e eventsByTime) Less(i, j int) bool { return e[i].At < e[j].At }
+
+// payload returns the kind byte and data of the node's next packet, sensor values get a
+// little noise added
+func (c *nodeConfig) payload() (byte, []byte, error) {
+	switch c.Kind {
+	case "owtemp":
+		data := make([]byte, len(c.Values))
+		for i, v := range c.Values {
+			data[i] = byte(int8(v + rand.Intn(3) - 1))
+		}
+		return jeesim.KindOwTemp, data, nil
+	case "waterlevel":
+		if len(c.Values) != 2 {
+			return 0, nil, fmt.Errorf("waterlevel needs 2 values")
+		}
+		data := make([]byte, 4)
+		for i, v := range c.Values {
+			binary.LittleEndian.PutUint16(data[2*i:], uint16(v+rand.Intn(11)-5))
+		}
+		return jeesim.KindWaterLevel, data, nil
+	case "log":
+		return jeesim.KindLog, []byte(c.Text), nil
+	case "raw":
+		data := make([]byte, len(c.Values))
+		for i, v := range c.Values {
+			data[i] = byte(v)
+		}
+		return c.KindId, data, nil
+	}
+	return 0, nil, fmt.Errorf("unknown kind %q", c.Kind)
+}
+
+//===== Simulated network
+
+type simNode struct {
+	config nodeConfig
+	gw     *jeesim.Gateway
+	mutex  sync.Mutex
+	id     byte      // current node ID, changes if the hub assigns a new one at reboot
+	downTo time.Time // the node is silent until then
+}
+
+type simGateway struct {
+	config gatewayConfig
+	gw     *jeesim.Gateway
+	nodes  map[byte]*simNode // configured node ID -> node
+}
+
+// run sends the node's packets until the scenario ends
+func (n *simNode) run() {
+	for range time.Tick(time.Duration(n.config.Every)) {
+		n.mutex.Lock()
+		id, down := n.id, time.Now().Before(n.downTo)
+		n.mutex.Unlock()
+		if down {
+			continue
+		}
+		kind, data, _ := n.config.payload()
+		err := n.gw.Send(id, kind, data, n.config.Ack)
+		if err != nil {
+			glog.Warningf("RFg%di%d: %s", n.gw.Group, id, err.Error())
+		} else {
+			glog.V(1).Infof("RFg%di%d: sent kind=%d % x", n.gw.Group, id, kind, data)
+		}
+	}
+}
+
+// reboot silences the node and then runs the JeeBoot sequence, the node keeps the node ID
+// it gets from the hub
+func (n *simNode) reboot(down time.Duration) {
+	n.mutex.Lock()
+	n.downTo = time.Now().Add(down)
+	id := n.id
+	n.mutex.Unlock()
+	glog.Infof("RFg%di%d: rebooting", n.gw.Group, id)
+	time.Sleep(down)
+
+	var hwId [16]byte
+	if n.config.HwId != "" {
+		b, _ := hex.DecodeString(n.config.HwId)
+		copy(hwId[:], b)
+	} else {
+		hwId[0], hwId[1] = n.gw.Group, n.config.Node
+	}
+	node := n.gw.NewNode(n.config.Type, hwId)
+	node.Id = id
+	changed, err := node.Boot()
+	if err != nil {
+		glog.Warningf("RFg%di%d: boot failed: %s", n.gw.Group, id, err.Error())
+		return
+	}
+	glog.Infof("RFg%di%d: booted as RFg%di%d sw=%d (%d bytes, new=%v)", n.gw.Group, id,
+		node.Group, node.Id, node.SwId, len(node.Image), changed)
+	n.mutex.Lock()
+	n.id = node.Id
+	n.mutex.Unlock()
+}
+
+// run sends the gateway's RSSI packets and logs what the hub sends to the nodes
+func (g *simGateway) run() {
+	if g.config.RssiEvery > 0 {
+		go func() {
+			for range time.Tick(time.Duration(g.config.RssiEvery)) {
+				if err := g.gw.SendRssi(); err != nil {
+					glog.Warningf("GW %d: %s", g.gw.Group, err.Error())
+				}
+			}
+		}()
+	}
+	for p := range g.gw.Delivered {
+		glog.Infof("RFg%di%d: received kind=%d % x ack=%v", g.gw.Group, p.Node, p.Kind,
+			p.Data, p.Ack)
+	}
+}
+
+// apply applies an event to the network
+func apply(e event, gateways map[byte]*simGateway) {
+	g := gateways[e.Group]
+	if g == nil {
+		glog.Warningf("Event at %s: no gateway for group %d", time.Duration(e.At), e.Group)
+		return
+	}
+	if e.Loss != nil {
+		glog.Infof("GW %d: packet loss %.0f%%", e.Group, *e.Loss*100)
+		g.gw.SetLoss(*e.Loss)
+	}
+	if e.Move {
+		if err := g.gw.Move(); err != nil {
+			glog.Warningf("GW %d: cannot move: %s", e.Group, err.Error())
+		} else {
+			glog.Infof("GW %d: moved to %s", e.Group, g.gw.Addr())
+		}
+	}
+	if e.Reboot {
+		n := g.nodes[e.Node]
+		if n == nil {
+			glog.Warningf("Event at %s: no node RFg%di%d", time.Duration(e.At), e.Group, e.Node)
+			return
+		}
+		go n.reboot(time.Duration(e.Down))
+	}
+}
+
+//===== Main
+
+func main() {
+	flag.Parse()
+
+	s, err := readScenario(*scenarioFile)
+	if err != nil {
+		glog.Fatal(err.Error())
+	}
+	addr, err := net.ResolveUDPAddr("udp4", *hubAddr)
+	if err != nil {
+		glog.Fatalf("Cannot resolve %s: %s", *hubAddr, err.Error())
+	}
+
+	gateways := make(map[byte]*simGateway)
+	for _, gc := range s.Gateways {
+		gw, err := jeesim.NewGateway(addr, gc.Group)
+		if err != nil {
+			glog.Fatalf("Cannot start gateway for group %d: %s", gc.Group, err.Error())
+		}
+		gw.GwId = gc.GwId
+		g := &simGateway{config: gc, gw: gw, nodes: make(map[byte]*simNode)}
+		for _, nc := range gc.Nodes {
+			gw.SetRssi(nc.Node, nc.Rssi)
+			n := &simNode{config: nc, gw: gw, id: nc.Node}
+			g.nodes[nc.Node] = n
+			go n.run()
+		}
+		gateways[gc.Group] = g
+		go g.run()
+		glog.Infof("GW %d: %d nodes at %s", gc.Group, len(gc.Nodes), gw.Addr())
+	}
+
+	start := time.Now()
+	for _, e := range s.Events {
+		time.Sleep(start.Add(time.Duration(e.At)).Sub(time.Now()))
+		if e.Stop {
+			glog.Infof("Scenario done after %s", time.Duration(e.At))
+			glog.Flush()
+			return
+		}
+		apply(e, gateways)
+	}
+	select {} // run until killed
+}